@@ -1,6 +1,7 @@
 package control
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -15,11 +16,22 @@ import (
 // "SAFECOOKIE" and "NULL" authentication methods are not available and
 // "HASHEDPASSWORD" is.
 func (c *Conn) Authenticate(password string) error {
-	if c.Authenticated {
+	return c.AuthenticateContext(context.Background(), password)
+}
+
+// AuthenticateContext is Authenticate with a context.
+func (c *Conn) AuthenticateContext(ctx context.Context, password string) error {
+	select {
+	case c.authLock <- struct{}{}:
+		defer func() { <-c.authLock }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if c.IsAuthenticated() {
 		return nil
 	}
 	// Determine the supported authentication methods, and the cookie path.
-	pi, err := c.ProtocolInfo()
+	pi, err := c.ProtocolInfoContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -43,7 +55,7 @@ func (c *Conn) Authenticate(password string) error {
 		if _, err := rand.Read(clientNonce[:]); err != nil {
 			return c.protoErr("Failed to generate clientNonce: %v", err)
 		}
-		resp, err := c.SendRequest("AUTHCHALLENGE %s %s", "SAFECOOKIE", hex.EncodeToString(clientNonce[:]))
+		resp, err := c.SendCommand(ctx, NewCommand("AUTHCHALLENGE").Arg("SAFECOOKIE", hex.EncodeToString(clientNonce[:])))
 		if err != nil {
 			return err
 		}
@@ -94,15 +106,25 @@ func (c *Conn) Authenticate(password string) error {
 		return c.protoErr("No supported authentication methods")
 	}
 	// Send it
-	if err = c.sendAuthenticate(authBytes); err == nil {
+	if err = c.sendAuthenticate(ctx, authBytes); err == nil {
+		c.stateLock.Lock()
 		c.Authenticated = true
+		c.stateLock.Unlock()
 	}
 	return err
 }
 
-func (c *Conn) sendAuthenticate(byts []byte) error {
-	if len(byts) == 0 {
-		return c.sendRequestIgnoreResponse("AUTHENTICATE")
+// IsAuthenticated returns true if Authenticate has been called successfully.
+func (c *Conn) IsAuthenticated() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.Authenticated
+}
+
+func (c *Conn) sendAuthenticate(ctx context.Context, byts []byte) error {
+	cmd := NewCommand("AUTHENTICATE")
+	if len(byts) > 0 {
+		cmd.Arg(hex.EncodeToString(byts))
 	}
-	return c.sendRequestIgnoreResponse("AUTHENTICATE %v", hex.EncodeToString(byts))
+	return c.sendCommandIgnoreResponse(ctx, cmd)
 }
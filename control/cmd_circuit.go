@@ -1,22 +1,30 @@
 package control
 
 import (
+	"context"
 	"strings"
 )
 
 // ExtendCircuit invokes EXTENDCIRCUIT and returns the circuit ID on success.
 func (c *Conn) ExtendCircuit(circuitID string, path []string, purpose string) (string, error) {
+	return c.ExtendCircuitContext(context.Background(), circuitID, path, purpose)
+}
+
+// ExtendCircuitContext is ExtendCircuit with a context.
+func (c *Conn) ExtendCircuitContext(
+	ctx context.Context, circuitID string, path []string, purpose string,
+) (string, error) {
 	if circuitID == "" {
 		circuitID = "0"
 	}
-	cmd := "EXTENDCIRCUIT " + circuitID
+	cmd := NewCommand("EXTENDCIRCUIT").Arg(circuitID)
 	if len(path) > 0 {
-		cmd += " " + strings.Join(path, ",")
+		cmd.Arg(strings.Join(path, ","))
 	}
 	if purpose != "" {
-		cmd += " purpose=" + purpose
+		cmd.KeyVal("purpose", purpose)
 	}
-	resp, err := c.SendRequest(cmd)
+	resp, err := c.SendCommand(ctx, cmd)
 	if err != nil {
 		return "", err
 	}
@@ -25,14 +33,20 @@ func (c *Conn) ExtendCircuit(circuitID string, path []string, purpose string) (s
 
 // SetCircuitPurpose invokes SETCIRCUITPURPOSE.
 func (c *Conn) SetCircuitPurpose(circuitID string, purpose string) error {
-	return c.sendRequestIgnoreResponse("SETCIRCUITPURPOSE %v purpose=%v", circuitID, purpose)
+	return c.SetCircuitPurposeContext(context.Background(), circuitID, purpose)
+}
+
+// SetCircuitPurposeContext is SetCircuitPurpose with a context.
+func (c *Conn) SetCircuitPurposeContext(ctx context.Context, circuitID string, purpose string) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("SETCIRCUITPURPOSE").Arg(circuitID).KeyVal("purpose", purpose))
 }
 
 // CloseCircuit invokes CLOSECIRCUIT.
 func (c *Conn) CloseCircuit(circuitID string, flags []string) error {
-	cmd := "CLOSECIRCUIT " + circuitID
-	for _, flag := range flags {
-		cmd += " " + flag
-	}
-	return c.sendRequestIgnoreResponse(cmd)
+	return c.CloseCircuitContext(context.Background(), circuitID, flags)
+}
+
+// CloseCircuitContext is CloseCircuit with a context.
+func (c *Conn) CloseCircuitContext(ctx context.Context, circuitID string, flags []string) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("CLOSECIRCUIT").Arg(circuitID).Arg(flags...))
 }
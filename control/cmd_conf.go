@@ -1,34 +1,51 @@
 package control
 
 import (
-	"strings"
+	"context"
 
 	"github.com/cretz/bine/torutil"
 )
 
 // SetConf invokes SETCONF.
 func (c *Conn) SetConf(entries ...*KeyVal) error {
-	return c.sendSetConf("SETCONF", entries)
+	return c.SetConfContext(context.Background(), entries...)
+}
+
+// SetConfContext is SetConf with a context.
+func (c *Conn) SetConfContext(ctx context.Context, entries ...*KeyVal) error {
+	return c.sendSetConf(ctx, "SETCONF", entries)
 }
 
 // ResetConf invokes RESETCONF.
 func (c *Conn) ResetConf(entries ...*KeyVal) error {
-	return c.sendSetConf("RESETCONF", entries)
+	return c.ResetConfContext(context.Background(), entries...)
 }
 
-func (c *Conn) sendSetConf(cmd string, entries []*KeyVal) error {
+// ResetConfContext is ResetConf with a context.
+func (c *Conn) ResetConfContext(ctx context.Context, entries ...*KeyVal) error {
+	return c.sendSetConf(ctx, "RESETCONF", entries)
+}
+
+func (c *Conn) sendSetConf(ctx context.Context, keyword string, entries []*KeyVal) error {
+	cmd := NewCommand(keyword)
 	for _, entry := range entries {
-		cmd += " " + entry.Key
 		if entry.ValSet() {
-			cmd += "=" + torutil.EscapeSimpleQuotedStringIfNeeded(entry.Val)
+			cmd.KeyMaybeQuotedVal(entry.Key, entry.Val)
+		} else {
+			cmd.Arg(entry.Key)
 		}
 	}
-	return c.sendRequestIgnoreResponse(cmd)
+	return c.sendCommandIgnoreResponse(ctx, cmd)
 }
 
 // GetConf invokes GETCONF and returns the values for the requested keys.
 func (c *Conn) GetConf(keys ...string) ([]*KeyVal, error) {
-	resp, err := c.SendRequest("GETCONF %v", strings.Join(keys, " "))
+	return c.GetConfContext(context.Background(), keys...)
+}
+
+// GetConfContext is GetConf with a context.
+func (c *Conn) GetConfContext(ctx context.Context, keys ...string) ([]*KeyVal, error) {
+	resp, err := c.SendCommand(ctx, NewCommand("GETCONF").Arg(keys...))
 	if err != nil {
 		return nil, err
 	}
@@ -52,14 +69,24 @@ func (c *Conn) GetConf(keys ...string) ([]*KeyVal, error) {
 
 // SaveConf invokes SAVECONF.
 func (c *Conn) SaveConf(force bool) error {
-	cmd := "SAVECONF"
+	return c.SaveConfContext(context.Background(), force)
+}
+
+// SaveConfContext is SaveConf with a context.
+func (c *Conn) SaveConfContext(ctx context.Context, force bool) error {
+	cmd := NewCommand("SAVECONF")
 	if force {
-		cmd += " FORCE"
+		cmd.Arg("FORCE")
 	}
-	return c.sendRequestIgnoreResponse(cmd)
+	return c.sendCommandIgnoreResponse(ctx, cmd)
 }
 
 // LoadConf invokes LOADCONF.
 func (c *Conn) LoadConf(conf string) error {
-	return c.sendRequestIgnoreResponse("+LOADCONF\r\n%v\r\n.", conf)
+	return c.LoadConfContext(context.Background(), conf)
+}
+
+// LoadConfContext is LoadConf with a context.
+func (c *Conn) LoadConfContext(ctx context.Context, conf string) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("LOADCONF").Body(conf))
 }
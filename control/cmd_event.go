@@ -107,34 +107,70 @@ func EventCodes() []EventCode {
 	return ret
 }
 
-// ErrEventWaitSynchronousResponseOccurred is returned from EventWait (see docs)
+// ErrEventWaitSynchronousResponseOccurred was returned from EventWait when a
+// non-event response was read while waiting.
+//
+// Deprecated: Responses are read by the connection's background reader, so
+// synchronous responses no longer interrupt EventWait and this is never
+// returned.
 var ErrEventWaitSynchronousResponseOccurred = errors.New("Synchronous event occurred during EventWait")
 
-// EventWait waits for the predicate to be satisified or a non-event message to
-// come through. If a non-event comes through, the error
-// ErrEventWaitSynchronousResponseOccurred is returned. If there is an error in
-// the predicate or if the context completes or there is an error internally
-// handling the event, the error is returned. Otherwise, the event that true was
-// returned from the predicate for is returned.
+// EventWait waits for the predicate to be satisified. If there is an error in
+// the predicate or if the context completes or the connection's reader stops,
+// the error is returned. Otherwise, the event that true was returned from the
+// predicate for is returned.
 func (c *Conn) EventWait(
 	ctx context.Context, events []EventCode, predicate func(Event) (bool, error),
+) (Event, error) {
+	return c.eventWaitAfter(ctx, events, nil, predicate)
+}
+
+// eventWaitAfter is EventWait that also runs start, if not nil, in the
+// background once the listener is added. If start fails, that error is
+// returned.
+func (c *Conn) eventWaitAfter(
+	ctx context.Context, events []EventCode, start func(context.Context) error, predicate func(Event) (bool, error),
 ) (Event, error) {
 	eventCh := make(chan Event, 10)
-	defer close(eventCh)
-	if err := c.AddEventListener(eventCh, events...); err != nil {
+	if err := c.AddEventListenerContext(ctx, eventCh, events...); err != nil {
 		return nil, err
 	}
-	defer c.RemoveEventListener(eventCh, events...)
+	defer func() {
+		// The reader may be blocked sending to us, so keep draining until
+		// the listener is removed. Removal waits for a send in progress and
+		// the reader skips the listener from then on.
+		drainDone := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-eventCh:
+				case <-drainDone:
+					return
+				}
+			}
+		}()
+		c.RemoveEventListener(eventCh, events...)
+		close(drainDone)
+		close(eventCh)
+	}()
 	eventCtx, eventCancel := context.WithCancel(ctx)
 	defer eventCancel()
 	errCh := make(chan error, 1)
 	go func() { errCh <- c.HandleEvents(eventCtx) }()
+	startErrCh := make(chan error, 1)
+	if start != nil {
+		go func() { startErrCh <- start(eventCtx) }()
+	}
 	for {
 		select {
 		case <-eventCtx.Done():
 			return nil, eventCtx.Err()
 		case err := <-errCh:
 			return nil, err
+		case err := <-startErrCh:
+			if err != nil {
+				return nil, err
+			}
 		case event := <-eventCh:
 			if ok, err := predicate(event); err != nil {
 				return nil, err
@@ -145,50 +181,32 @@ func (c *Conn) EventWait(
 	}
 }
 
-// HandleEvents loops until the context is closed dispatching async events. Can
-// dispatch events even after context is done and of course during synchronous
-// request. This will always end with an error, either from ctx.Done() or from
-// an error reading/handling the event.
+// HandleEvents blocks until the context is closed or the connection's reader
+// stops. Events are dispatched by the connection's background reader, so this
+// is not needed to receive events, but it is a convenient way to wait on the
+// connection. This will always end with an error, either from ctx.Done() or
+// from the error that stopped the reader.
 func (c *Conn) HandleEvents(ctx context.Context) error {
-	errCh := make(chan error, 1)
-	go func() {
-		for ctx.Err() == nil {
-			if err := c.HandleNextEvent(); err != nil {
-				errCh <- err
-				break
-			}
-		}
-	}()
 	select {
-	case err := <-errCh:
-		return err
+	case <-c.readDone:
+		return c.readErr
 	case <-ctx.Done():
 		return ctx.Err()
 	}
 }
 
-// HandleNextEvent attempts to read and handle the next event. It will return on
-// first message seen, event or not. Otherwise it will wait until there is a
-// message read.
+// HandleNextEvent waits until the background reader has handled the next
+// message, event or not. An error is only returned if the reader stopped.
 func (c *Conn) HandleNextEvent() error {
-	c.readLock.Lock()
-	defer c.readLock.Unlock()
-	// We'll just peek for the next 3 bytes and see if they are async
-	byts, err := c.conn.R.Peek(3)
-	if err != nil {
-		return err
-	}
-	statusCode, err := strconv.Atoi(string(byts))
-	if err != nil || statusCode != StatusAsyncEvent {
-		return err
-	}
-	// Read the entire thing and handle it
-	resp, err := c.ReadResponse()
-	if err != nil {
-		return err
+	c.readStateLock.Lock()
+	responseReadCh := c.responseReadCh
+	c.readStateLock.Unlock()
+	select {
+	case <-responseReadCh:
+		return nil
+	case <-c.readDone:
+		return c.readErr
 	}
-	c.relayAsyncEvents(resp)
-	return nil
 }
 
 // AddEventListener adds the given channel as an event listener for the given
@@ -196,14 +214,18 @@ func (c *Conn) HandleNextEvent() error {
 // Callers are expected to call RemoveEventListener for the channel and all
 // event codes used here before closing the channel. If no events are provided,
 // this is essentially a no-op. The EventCodeUnrecognized event code can be used
-// to listen for unrecognized events.
+// to listen for unrecognized events. Events are delivered with
+// EventDeliveryBlock, use AddEventListenerWithConf for other policies.
 func (c *Conn) AddEventListener(ch chan<- Event, events ...EventCode) error {
-	c.addEventListenerToMap(ch, events...)
-	// If there is an error updating the events, remove what we just added
-	err := c.sendSetEvents()
-	if err != nil {
-		c.removeEventListenerFromMap(ch, events...)
-	}
+	return c.AddEventListenerContext(context.Background(), ch, events...)
+}
+
+// AddEventListenerContext is AddEventListener with a context. If the context
+// completes before Tor acknowledges the new events, the listener is removed
+// again. This uses EventDeliveryBlock unless the channel was already added
+// with a different configuration via AddEventListenerWithConf.
+func (c *Conn) AddEventListenerContext(ctx context.Context, ch chan<- Event, events ...EventCode) error {
+	_, err := c.AddEventListenerWithConf(ctx, ch, nil, events...)
 	return err
 }
 
@@ -211,33 +233,58 @@ func (c *Conn) AddEventListener(ch chan<- Event, events ...EventCode) error {
 // event codes. It is not an error to remove a channel from events
 // AddEventListener was not called for. Tor is notified about events which may
 // no longer be listened to. If no events are provided, this is essentially a
-// no-op.
+// no-op. Once the channel is removed from all of its event codes, nothing more
+// is sent to it and it can be closed. If the reader is blocked sending to the
+// channel at that time, this waits for the send, so the channel must be
+// received from until this returns.
 func (c *Conn) RemoveEventListener(ch chan<- Event, events ...EventCode) error {
+	return c.RemoveEventListenerContext(context.Background(), ch, events...)
+}
+
+// RemoveEventListenerContext is RemoveEventListener with a context. The channel
+// is removed locally even if the context completes before Tor acknowledges the
+// change.
+func (c *Conn) RemoveEventListenerContext(ctx context.Context, ch chan<- Event, events ...EventCode) error {
 	c.removeEventListenerFromMap(ch, events...)
-	return c.sendSetEvents()
+	return c.sendSetEvents(ctx)
 }
 
-func (c *Conn) addEventListenerToMap(ch chan<- Event, events ...EventCode) {
+func (c *Conn) addEventListenerToMap(
+	ch chan<- Event, conf *EventListenerConf, events ...EventCode,
+) *EventListenerStats {
 	c.eventListenersLock.Lock()
 	defer c.eventListenersLock.Unlock()
+	listener := c.eventListenersByChan[ch]
+	if listener == nil && len(events) == 0 {
+		// Nothing to register
+		return &EventListenerStats{}
+	} else if listener == nil {
+		listener = newEventListener(ch, conf)
+		if listener.stop != nil {
+			go listener.forward(func() { c.disconnectEventListener(listener) })
+		}
+		c.eventListenersByChan[ch] = listener
+	}
 	for _, event := range events {
 		// Must completely replace the array, never mutate it
 		prevArr := c.eventListeners[event]
-		newArr := make([]chan<- Event, len(prevArr)+1)
+		newArr := make([]*eventListener, len(prevArr)+1)
 		copy(newArr, prevArr)
-		newArr[len(newArr)-1] = ch
+		newArr[len(newArr)-1] = listener
 		c.eventListeners[event] = newArr
+		listener.refs++
 	}
+	return listener.stats
 }
 
 func (c *Conn) removeEventListenerFromMap(ch chan<- Event, events ...EventCode) {
 	c.eventListenersLock.Lock()
-	defer c.eventListenersLock.Unlock()
+	var stopped *eventListener
 	for _, event := range events {
 		arr := c.eventListeners[event]
 		index := -1
 		for i, listener := range arr {
-			if listener == ch {
+			if listener.ch == ch {
 				index = i
 				break
 			}
@@ -247,23 +294,42 @@ func (c *Conn) removeEventListenerFromMap(ch chan<- Event, events ...EventCode)
 				delete(c.eventListeners, event)
 			} else {
 				// Must completely replace the array, never mutate it
-				newArr := make([]chan<- Event, len(arr)-1)
+				newArr := make([]*eventListener, len(arr)-1)
 				copy(newArr, arr[:index])
 				copy(newArr[index:], arr[index+1:])
 				c.eventListeners[event] = newArr
 			}
+			listener := arr[index]
+			listener.refs--
+			if listener.refs == 0 {
+				delete(c.eventListenersByChan, ch)
+				stopped = listener
+			}
+		}
+	}
+	c.eventListenersLock.Unlock()
+	// Make sure the reader and forwarder are done with the channel before
+	// returning
+	if stopped != nil {
+		stopped.markRemoved()
+		if stopped.stop != nil {
+			close(stopped.stop)
+			<-stopped.stopped
 		}
 	}
 }
 
-func (c *Conn) sendSetEvents() error {
+func (c *Conn) sendSetEvents(ctx context.Context) error {
 	c.eventListenersLock.RLock()
-	cmd := "SETEVENTS"
+	cmd := NewCommand("SETEVENTS")
 	for event := range c.eventListeners {
-		cmd += " " + string(event)
+		// Unrecognized is not a real event code, the others are enough
+		if event != EventCodeUnrecognized {
+			cmd.Arg(string(event))
+		}
 	}
 	c.eventListenersLock.RUnlock()
-	return c.sendRequestIgnoreResponse(cmd)
+	return c.sendCommandIgnoreResponse(ctx, cmd)
 }
 
 func (c *Conn) relayAsyncEvents(resp *Response) {
@@ -285,22 +351,34 @@ func (c *Conn) relayAsyncEvents(resp *Response) {
 		// Otherwise, the reply line has the data
 		code, data, _ = torutil.PartitionString(resp.Reply, ' ')
 	}
-	// Only relay if there are chans
+	// Only relay if there are listeners
 	eventCode := EventCode(code)
 	c.eventListenersLock.RLock()
-	chans := c.eventListeners[eventCode]
+	listeners := c.eventListeners[eventCode]
 	if _, ok := recognizedEventCodesByCode[eventCode]; !ok {
-		chans = append(chans, c.eventListeners[EventCodeUnrecognized]...)
+		// Don't send twice to a listener for both the code and unrecognized
+		listeners = listeners[:len(listeners):len(listeners)]
+	UnrecognizedListeners:
+		for _, unrecognized := range c.eventListeners[EventCodeUnrecognized] {
+			for _, listener := range listeners {
+				if listener == unrecognized {
+					continue UnrecognizedListeners
+				}
+			}
+			listeners = append(listeners, unrecognized)
+		}
 	}
 	c.eventListenersLock.RUnlock()
-	if len(chans) == 0 {
+	if len(listeners) == 0 {
 		return
 	}
 	// Parse the event and only send if known event
 	if event := ParseEvent(eventCode, data, dataArray); event != nil {
-		for _, ch := range chans {
-			// Just send, if closed or blocking, that's not our problem
-			ch <- event
+		for _, listener := range listeners {
+			// Delivery is per the listener's policy, see EventDeliveryPolicy
+			if !listener.deliver(event) {
+				c.disconnectEventListener(listener)
+			}
 		}
 	}
 }
@@ -445,7 +523,7 @@ func ParseCircuitEvent(raw string) *CircuitEvent {
 			event.SocksPassword = val
 		default:
 			if first {
-				event.Path = strings.Split(val, ",")
+				event.Path = strings.Split(attr, ",")
 			}
 		}
 		first = false
@@ -663,9 +741,11 @@ func ParseStatusEvent(typ EventCode, raw string) *StatusEvent {
 	event.Severity, raw, _ = torutil.PartitionString(raw, ' ')
 	var ok bool
 	event.Action, raw, ok = torutil.PartitionString(raw, ' ')
-	var attr string
-	for ok {
-		attr, raw, ok = torutil.PartitionString(raw, ' ')
+	if !ok {
+		return event
+	}
+	// Quoted values can have spaces, e.g. bootstrap summaries
+	for _, attr := range splitQuotedArgs(raw) {
 		key, val, _ := torutil.PartitionString(attr, '=')
 		event.Arguments[key], _ = torutil.UnescapeSimpleQuotedStringIfNeeded(val)
 	}
@@ -0,0 +1,453 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+)
+
+// This file has typed accessors over GETINFO for common keys. GetInfo can
+// still be used for any key.
+
+// getInfoRaw invokes GETINFO and returns the values without unquoting.
+// Multi-line values have their leading CRLF removed.
+func (c *Conn) getInfoRaw(ctx context.Context, keys ...string) (map[string]string, error) {
+	resp, err := c.SendCommand(ctx, NewCommand("GETINFO").Arg(keys...))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(resp.Data))
+	for _, data := range resp.Data {
+		key, val, _ := torutil.PartitionString(data, '=')
+		ret[key] = strings.TrimPrefix(val, "\r\n")
+	}
+	for _, key := range keys {
+		if _, ok := ret[key]; !ok {
+			return nil, c.protoErr("Missing GETINFO value for %v", key)
+		}
+	}
+	return ret, nil
+}
+
+func (c *Conn) getInfoLines(ctx context.Context, key string) ([]string, error) {
+	vals, err := c.getInfoRaw(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, line := range strings.Split(vals[key], "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret, nil
+}
+
+// splitQuotedArgs splits on spaces that are not in quoted strings.
+func splitQuotedArgs(str string) []string {
+	ret := []string{}
+	for str = strings.TrimLeft(str, " "); str != ""; str = strings.TrimLeft(str, " ") {
+		end, quoted, escaping := 0, false, false
+		for ; end < len(str) && (quoted || str[end] != ' '); end++ {
+			if escaping {
+				escaping = false
+			} else if str[end] == '\\' {
+				escaping = true
+			} else if str[end] == '"' {
+				quoted = !quoted
+			}
+		}
+		ret = append(ret, str[:end])
+		str = str[end:]
+	}
+	return ret
+}
+
+// TorVersion is a parsed Tor version, e.g. "0.4.7.13" or
+// "0.4.8.1-alpha (git-abcdef)".
+type TorVersion struct {
+	Raw    string
+	Major  int
+	Minor  int
+	Micro  int
+	Patch  int
+	Status string
+	Extra  string
+}
+
+// ParseTorVersion parses a Tor version.
+func ParseTorVersion(raw string) (*TorVersion, error) {
+	ret := &TorVersion{Raw: raw}
+	version, extra, _ := torutil.PartitionString(raw, ' ')
+	ret.Extra = strings.Trim(extra, "()")
+	version, ret.Status, _ = torutil.PartitionString(version, '-')
+	pieces := strings.Split(version, ".")
+	if len(pieces) < 3 || len(pieces) > 4 {
+		return nil, fmt.Errorf("Invalid Tor version: %v", raw)
+	}
+	nums := []*int{&ret.Major, &ret.Minor, &ret.Micro, &ret.Patch}
+	for i, piece := range pieces {
+		var err error
+		if *nums[i], err = strconv.Atoi(piece); err != nil {
+			return nil, fmt.Errorf("Invalid Tor version: %v", raw)
+		}
+	}
+	return ret, nil
+}
+
+// AtLeast returns true if the version is the same as or newer than the given
+// numbers, ignoring status.
+func (t *TorVersion) AtLeast(major, minor, micro, patch int) bool {
+	mine := []int{t.Major, t.Minor, t.Micro, t.Patch}
+	for i, other := range []int{major, minor, micro, patch} {
+		if mine[i] != other {
+			return mine[i] > other
+		}
+	}
+	return true
+}
+
+// GetInfoVersion invokes GETINFO version and parses it.
+func (c *Conn) GetInfoVersion() (*TorVersion, error) {
+	return c.GetInfoVersionContext(context.Background())
+}
+
+// GetInfoVersionContext is GetInfoVersion with a context.
+func (c *Conn) GetInfoVersionContext(ctx context.Context) (*TorVersion, error) {
+	vals, err := c.getInfoRaw(ctx, "version")
+	if err != nil {
+		return nil, err
+	}
+	return ParseTorVersion(vals["version"])
+}
+
+// CircuitStatus is an entry of GETINFO circuit-status. It has the same
+// grammar, and therefore fields, as CircuitEvent.
+type CircuitStatus CircuitEvent
+
+// GetInfoCircuitStatus invokes GETINFO circuit-status and parses it.
+func (c *Conn) GetInfoCircuitStatus() ([]*CircuitStatus, error) {
+	return c.GetInfoCircuitStatusContext(context.Background())
+}
+
+// GetInfoCircuitStatusContext is GetInfoCircuitStatus with a context.
+func (c *Conn) GetInfoCircuitStatusContext(ctx context.Context) ([]*CircuitStatus, error) {
+	lines, err := c.getInfoLines(ctx, "circuit-status")
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*CircuitStatus, len(lines))
+	for i, line := range lines {
+		ret[i] = (*CircuitStatus)(ParseCircuitEvent(line))
+	}
+	return ret, nil
+}
+
+// StreamStatus is an entry of GETINFO stream-status. It has the same grammar,
+// and therefore fields, as StreamEvent though only StreamID, Status,
+// CircuitID, TargetAddress, and TargetPort are set.
+type StreamStatus StreamEvent
+
+// GetInfoStreamStatus invokes GETINFO stream-status and parses it.
+func (c *Conn) GetInfoStreamStatus() ([]*StreamStatus, error) {
+	return c.GetInfoStreamStatusContext(context.Background())
+}
+
+// GetInfoStreamStatusContext is GetInfoStreamStatus with a context.
+func (c *Conn) GetInfoStreamStatusContext(ctx context.Context) ([]*StreamStatus, error) {
+	lines, err := c.getInfoLines(ctx, "stream-status")
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*StreamStatus, len(lines))
+	for i, line := range lines {
+		ret[i] = (*StreamStatus)(ParseStreamEvent(line))
+	}
+	return ret, nil
+}
+
+// EntryGuard is an entry of GETINFO entry-guards.
+type EntryGuard struct {
+	Raw         string
+	Fingerprint string
+	Nickname    string
+	// Status is "up", "never-connected", "down", "unusable", or "unlisted".
+	Status string
+	// Since is when the guard went down or became unusable, zero if not set.
+	Since time.Time
+}
+
+// ParseEntryGuard parses an entry of GETINFO entry-guards.
+func ParseEntryGuard(raw string) *EntryGuard {
+	ret := &EntryGuard{Raw: raw}
+	name, rest, _ := torutil.PartitionString(raw, ' ')
+	if strings.HasPrefix(name, "$") {
+		ret.Fingerprint = name[1:]
+		if i := strings.IndexAny(ret.Fingerprint, "~="); i >= 0 {
+			ret.Fingerprint, ret.Nickname = ret.Fingerprint[:i], ret.Fingerprint[i+1:]
+		}
+	} else {
+		ret.Nickname = name
+	}
+	ret.Status, rest, _ = torutil.PartitionString(rest, ' ')
+	if rest != "" {
+		ret.Since = parseISOTime(rest)
+	}
+	return ret
+}
+
+// GetInfoEntryGuards invokes GETINFO entry-guards and parses it.
+func (c *Conn) GetInfoEntryGuards() ([]*EntryGuard, error) {
+	return c.GetInfoEntryGuardsContext(context.Background())
+}
+
+// GetInfoEntryGuardsContext is GetInfoEntryGuards with a context.
+func (c *Conn) GetInfoEntryGuardsContext(ctx context.Context) ([]*EntryGuard, error) {
+	lines, err := c.getInfoLines(ctx, "entry-guards")
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*EntryGuard, len(lines))
+	for i, line := range lines {
+		ret[i] = ParseEntryGuard(line)
+	}
+	return ret, nil
+}
+
+// BootstrapPhase is GETINFO status/bootstrap-phase, which is the same as the
+// last BOOTSTRAP status event.
+type BootstrapPhase struct {
+	Raw string
+	// Severity is "NOTICE" normally, or "WARN" or "ERR" on problems.
+	Severity string
+	// Progress is the percentage, 100 when complete.
+	Progress int
+	Tag      string
+	Summary  string
+	// Below are only set on problems
+	Warning        string
+	Reason         string
+	Count          int
+	Recommendation string
+	Host           string
+	HostAddr       string
+	// Arguments has all arguments, including the ones above.
+	Arguments map[string]string
+}
+
+// ParseBootstrapPhase parses the value of GETINFO status/bootstrap-phase or
+// the data of a BOOTSTRAP status event.
+func ParseBootstrapPhase(raw string) (*BootstrapPhase, error) {
+	status := ParseStatusEvent(EventCodeStatusClient, raw)
+	if status.Action != "BOOTSTRAP" {
+		return nil, fmt.Errorf("Invalid bootstrap phase: %v", raw)
+	}
+	ret := &BootstrapPhase{
+		Raw:            raw,
+		Severity:       status.Severity,
+		Tag:            status.Arguments["TAG"],
+		Summary:        status.Arguments["SUMMARY"],
+		Warning:        status.Arguments["WARNING"],
+		Reason:         status.Arguments["REASON"],
+		Recommendation: status.Arguments["RECOMMENDATION"],
+		Host:           status.Arguments["HOST"],
+		HostAddr:       status.Arguments["HOSTADDR"],
+		Arguments:      status.Arguments,
+	}
+	var err error
+	if ret.Progress, err = strconv.Atoi(status.Arguments["PROGRESS"]); err != nil {
+		return nil, fmt.Errorf("Invalid bootstrap progress: %v", raw)
+	}
+	if count, ok := status.Arguments["COUNT"]; ok {
+		ret.Count, _ = strconv.Atoi(count)
+	}
+	return ret, nil
+}
+
+// GetInfoBootstrapPhase invokes GETINFO status/bootstrap-phase and parses it.
+func (c *Conn) GetInfoBootstrapPhase() (*BootstrapPhase, error) {
+	return c.GetInfoBootstrapPhaseContext(context.Background())
+}
+
+// GetInfoBootstrapPhaseContext is GetInfoBootstrapPhase with a context.
+func (c *Conn) GetInfoBootstrapPhaseContext(ctx context.Context) (*BootstrapPhase, error) {
+	vals, err := c.getInfoRaw(ctx, "status/bootstrap-phase")
+	if err != nil {
+		return nil, err
+	}
+	return ParseBootstrapPhase(vals["status/bootstrap-phase"])
+}
+
+// GetInfoOnions invokes GETINFO onions/current, or onions/detached if detached
+// is true, and returns the onion service IDs.
+func (c *Conn) GetInfoOnions(detached bool) ([]string, error) {
+	return c.GetInfoOnionsContext(context.Background(), detached)
+}
+
+// GetInfoOnionsContext is GetInfoOnions with a context.
+func (c *Conn) GetInfoOnionsContext(ctx context.Context, detached bool) ([]string, error) {
+	key := "onions/current"
+	if detached {
+		key = "onions/detached"
+	}
+	lines, err := c.getInfoLines(ctx, key)
+	// Tor errors instead of returning an empty list
+	if isNoOnionsErr(err) {
+		return []string{}, nil
+	}
+	return lines, err
+}
+
+func isNoOnionsErr(err error) bool {
+	var ctrlErr *Error
+	return errors.As(err, &ctrlErr) && strings.Contains(ctrlErr.Reply, "No onion services")
+}
+
+// Traffic is the total bytes read and written by Tor.
+type Traffic struct {
+	Read    uint64
+	Written uint64
+}
+
+// GetInfoTraffic invokes GETINFO traffic/read and traffic/written.
+func (c *Conn) GetInfoTraffic() (*Traffic, error) {
+	return c.GetInfoTrafficContext(context.Background())
+}
+
+// GetInfoTrafficContext is GetInfoTraffic with a context.
+func (c *Conn) GetInfoTrafficContext(ctx context.Context) (*Traffic, error) {
+	vals, err := c.getInfoRaw(ctx, "traffic/read", "traffic/written")
+	if err != nil {
+		return nil, err
+	}
+	ret := &Traffic{}
+	if ret.Read, err = strconv.ParseUint(vals["traffic/read"], 10, 64); err != nil {
+		return nil, c.protoErr("Invalid traffic/read: %v", vals["traffic/read"])
+	} else if ret.Written, err = strconv.ParseUint(vals["traffic/written"], 10, 64); err != nil {
+		return nil, c.protoErr("Invalid traffic/written: %v", vals["traffic/written"])
+	}
+	return ret, nil
+}
+
+// Accounting is the set of GETINFO accounting/* values.
+type Accounting struct {
+	// Enabled is whether accounting is on. No other fields are set if not.
+	Enabled bool
+	// Hibernating is "awake", "soft", or "hard".
+	Hibernating      string
+	BytesRead        uint64
+	BytesWritten     uint64
+	BytesLeftRead    uint64
+	BytesLeftWritten uint64
+	IntervalStart    time.Time
+	IntervalWake     time.Time
+	IntervalEnd      time.Time
+}
+
+// GetInfoAccounting invokes GETINFO for the accounting/* keys.
+func (c *Conn) GetInfoAccounting() (*Accounting, error) {
+	return c.GetInfoAccountingContext(context.Background())
+}
+
+// GetInfoAccountingContext is GetInfoAccounting with a context.
+func (c *Conn) GetInfoAccountingContext(ctx context.Context) (*Accounting, error) {
+	vals, err := c.getInfoRaw(ctx, "accounting/enabled")
+	if err != nil || vals["accounting/enabled"] != "1" {
+		return &Accounting{}, err
+	}
+	vals, err = c.getInfoRaw(ctx, "accounting/hibernating", "accounting/bytes", "accounting/bytes-left",
+		"accounting/interval-start", "accounting/interval-wake", "accounting/interval-end")
+	if err != nil {
+		return nil, err
+	}
+	ret := &Accounting{
+		Enabled:       true,
+		Hibernating:   vals["accounting/hibernating"],
+		IntervalStart: parseISOTime(vals["accounting/interval-start"]),
+		IntervalWake:  parseISOTime(vals["accounting/interval-wake"]),
+		IntervalEnd:   parseISOTime(vals["accounting/interval-end"]),
+	}
+	parsePair := func(key string, read *uint64, written *uint64) error {
+		readStr, writtenStr, _ := torutil.PartitionString(vals[key], ' ')
+		var err error
+		if *read, err = strconv.ParseUint(readStr, 10, 64); err == nil {
+			*written, err = strconv.ParseUint(writtenStr, 10, 64)
+		}
+		if err != nil {
+			return c.protoErr("Invalid %v: %v", key, vals[key])
+		}
+		return nil
+	}
+	if err = parsePair("accounting/bytes", &ret.BytesRead, &ret.BytesWritten); err == nil {
+		err = parsePair("accounting/bytes-left", &ret.BytesLeftRead, &ret.BytesLeftWritten)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ListenerType is the type of listener for GetInfoListeners.
+type ListenerType string
+
+// Listener types
+const (
+	ListenerTypeOR         ListenerType = "or"
+	ListenerTypeDir        ListenerType = "dir"
+	ListenerTypeSocks      ListenerType = "socks"
+	ListenerTypeTrans      ListenerType = "trans"
+	ListenerTypeNATD       ListenerType = "natd"
+	ListenerTypeDNS        ListenerType = "dns"
+	ListenerTypeControl    ListenerType = "control"
+	ListenerTypeExtOR      ListenerType = "extor"
+	ListenerTypeHTTPTunnel ListenerType = "httptunnel"
+)
+
+// ParseListeners parses the value of a GETINFO net/listeners/* key. TCP
+// listeners are *net.TCPAddr and Unix socket listeners are *net.UnixAddr.
+func ParseListeners(raw string) ([]net.Addr, error) {
+	ret := []net.Addr{}
+	for _, piece := range splitQuotedArgs(raw) {
+		addrStr, err := torutil.UnescapeSimpleQuotedStringIfNeeded(piece)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid listener %v: %v", piece, err)
+		}
+		if strings.HasPrefix(addrStr, "unix:") {
+			ret = append(ret, &net.UnixAddr{Net: "unix", Name: addrStr[5:]})
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid listener %v: %v", addrStr, err)
+		}
+		addr := &net.TCPAddr{IP: net.ParseIP(host)}
+		if addr.IP == nil {
+			return nil, fmt.Errorf("Invalid listener IP: %v", addrStr)
+		} else if addr.Port, err = strconv.Atoi(portStr); err != nil {
+			return nil, fmt.Errorf("Invalid listener port: %v", addrStr)
+		}
+		ret = append(ret, addr)
+	}
+	return ret, nil
+}
+
+// GetInfoListeners invokes GETINFO net/listeners/<type> and parses it.
+func (c *Conn) GetInfoListeners(typ ListenerType) ([]net.Addr, error) {
+	return c.GetInfoListenersContext(context.Background(), typ)
+}
+
+// GetInfoListenersContext is GetInfoListeners with a context.
+func (c *Conn) GetInfoListenersContext(ctx context.Context, typ ListenerType) ([]net.Addr, error) {
+	key := "net/listeners/" + string(typ)
+	vals, err := c.getInfoRaw(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return ParseListeners(vals[key])
+}
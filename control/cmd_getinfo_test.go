@@ -0,0 +1,132 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control/controltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetInfoTyped(t *testing.T) {
+	server := controltest.NewServer()
+	server.TorVersion = "0.4.8.1-alpha (git-abcdef0123456789)"
+	conn := newTestConn(t, server)
+	// Version
+	version, err := conn.GetInfoVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 4, 8, 1}, []int{version.Major, version.Minor, version.Micro, version.Patch})
+	require.Equal(t, "alpha", version.Status)
+	require.Equal(t, "git-abcdef0123456789", version.Extra)
+	require.True(t, version.AtLeast(0, 4, 7, 13))
+	require.True(t, version.AtLeast(0, 4, 8, 1))
+	require.False(t, version.AtLeast(0, 4, 8, 2))
+	// Circuits, single and multiple
+	server.SetInfo("circuit-status", "1 BUILT $AAAA~a,$BBBB~b PURPOSE=GENERAL")
+	circs, err := conn.GetInfoCircuitStatus()
+	require.NoError(t, err)
+	require.Len(t, circs, 1)
+	server.SetInfo("circuit-status", "1 BUILT $AAAA~a,$BBBB~b PURPOSE=GENERAL\n"+
+		"2 LAUNCHED BUILD_FLAGS=NEED_CAPACITY PURPOSE=HS_SERVICE_INTRO TIME_CREATED=2023-01-02T03:04:05.678901")
+	circs, err = conn.GetInfoCircuitStatus()
+	require.NoError(t, err)
+	require.Len(t, circs, 2)
+	require.Equal(t, "1", circs[0].CircuitID)
+	require.Equal(t, "BUILT", circs[0].Status)
+	require.Equal(t, []string{"$AAAA~a", "$BBBB~b"}, circs[0].Path)
+	require.Equal(t, "2", circs[1].CircuitID)
+	require.Empty(t, circs[1].Path)
+	require.Equal(t, []string{"NEED_CAPACITY"}, circs[1].BuildFlags)
+	require.Equal(t, "HS_SERVICE_INTRO", circs[1].Purpose)
+	// Empty circuits
+	server.SetInfo("circuit-status", "")
+	circs, err = conn.GetInfoCircuitStatus()
+	require.NoError(t, err)
+	require.Empty(t, circs)
+	// Streams
+	server.SetInfo("stream-status", "5 SUCCEEDED 1 example.com:443")
+	streams, err := conn.GetInfoStreamStatus()
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	require.Equal(t, "example.com", streams[0].TargetAddress)
+	require.Equal(t, 443, streams[0].TargetPort)
+	// Guards
+	server.SetInfo("entry-guards", "$AAAA~a up\n$BBBB=b down 2023-01-02 03:04:05\n$CCCC never-connected")
+	guards, err := conn.GetInfoEntryGuards()
+	require.NoError(t, err)
+	require.Len(t, guards, 3)
+	require.Equal(t, &EntryGuard{Raw: "$AAAA~a up", Fingerprint: "AAAA", Nickname: "a", Status: "up"}, guards[0])
+	require.Equal(t, time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), guards[1].Since)
+	require.Equal(t, "CCCC", guards[2].Fingerprint)
+	require.Equal(t, "never-connected", guards[2].Status)
+	// Bootstrap, with spaces in the summary
+	server.SetInfo("status/bootstrap-phase", `WARN BOOTSTRAP PROGRESS=14 TAG=handshake `+
+		`SUMMARY="Handshaking with a relay" WARNING="Connection refused" REASON=CONNECTREFUSED COUNT=3 `+
+		`RECOMMENDATION=ignore HOST=AAAA HOSTADDR="1.2.3.4:9001"`)
+	phase, err := conn.GetInfoBootstrapPhase()
+	require.NoError(t, err)
+	require.Equal(t, "WARN", phase.Severity)
+	require.Equal(t, 14, phase.Progress)
+	require.Equal(t, "Handshaking with a relay", phase.Summary)
+	require.Equal(t, "Connection refused", phase.Warning)
+	require.Equal(t, 3, phase.Count)
+	require.Equal(t, "1.2.3.4:9001", phase.HostAddr)
+	// Onions, empty is an error in Tor
+	onions, err := conn.GetInfoOnions(false)
+	require.NoError(t, err)
+	require.Empty(t, onions)
+	server.SetInfo("onions/current", "abc\ndef")
+	onions, err = conn.GetInfoOnions(false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"abc", "def"}, onions)
+	// Traffic
+	server.SetInfo("traffic/read", "123")
+	server.SetInfo("traffic/written", "18446744073709551615")
+	traffic, err := conn.GetInfoTraffic()
+	require.NoError(t, err)
+	require.Equal(t, &Traffic{Read: 123, Written: 18446744073709551615}, traffic)
+	// Accounting
+	server.SetInfo("accounting/enabled", "0")
+	accounting, err := conn.GetInfoAccounting()
+	require.NoError(t, err)
+	require.False(t, accounting.Enabled)
+	server.SetInfo("accounting/enabled", "1")
+	server.SetInfo("accounting/hibernating", "soft")
+	server.SetInfo("accounting/bytes", "10 20")
+	server.SetInfo("accounting/bytes-left", "30 40")
+	server.SetInfo("accounting/interval-start", "2023-01-01 00:00:00")
+	server.SetInfo("accounting/interval-wake", "2023-01-01 01:00:00")
+	server.SetInfo("accounting/interval-end", "2023-02-01 00:00:00")
+	accounting, err = conn.GetInfoAccounting()
+	require.NoError(t, err)
+	require.True(t, accounting.Enabled)
+	require.Equal(t, "soft", accounting.Hibernating)
+	require.Equal(t, []uint64{10, 20, 30, 40}, []uint64{accounting.BytesRead, accounting.BytesWritten,
+		accounting.BytesLeftRead, accounting.BytesLeftWritten})
+	require.Equal(t, time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), accounting.IntervalEnd)
+	// Listeners
+	server.SetInfo("net/listeners/socks", `"127.0.0.1:9050" "[::1]:9050" "unix:/tmp/some dir/socks"`)
+	listeners, err := conn.GetInfoListeners(ListenerTypeSocks)
+	require.NoError(t, err)
+	require.Equal(t, []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9050},
+		&net.TCPAddr{IP: net.ParseIP("::1"), Port: 9050},
+		&net.UnixAddr{Net: "unix", Name: "/tmp/some dir/socks"},
+	}, listeners)
+	// Unknown keys are still available raw
+	server.SetInfo("some/new-key", "val")
+	vals, err := conn.GetInfo("some/new-key")
+	require.NoError(t, err)
+	require.Equal(t, "val", vals[0].Val)
+}
+
+func TestIsNoOnionsErr(t *testing.T) {
+	err := &Error{Code: 551, Reply: "No onion services of the specified type."}
+	require.True(t, isNoOnionsErr(err))
+	require.True(t, isNoOnionsErr(fmt.Errorf("Wrapped: %w", err)))
+	require.False(t, isNoOnionsErr(errors.New("No onion services")))
+	require.False(t, isNoOnionsErr(nil))
+}
@@ -1,23 +1,188 @@
 package control
 
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
 // GetHiddenServiceDescriptorAsync invokes HSFETCH.
 func (c *Conn) GetHiddenServiceDescriptorAsync(address string, server string) error {
-	cmd := "HSFETCH " + address
+	return c.GetHiddenServiceDescriptorAsyncContext(context.Background(), address, server)
+}
+
+// GetHiddenServiceDescriptorAsyncContext is GetHiddenServiceDescriptorAsync
+// with a context.
+func (c *Conn) GetHiddenServiceDescriptorAsyncContext(ctx context.Context, address string, server string) error {
+	cmd := NewCommand("HSFETCH").Arg(address)
 	if server != "" {
-		cmd += " SERVER=" + server
+		cmd.KeyVal("SERVER", server)
 	}
-	return c.sendRequestIgnoreResponse(cmd)
+	return c.sendCommandIgnoreResponse(ctx, cmd)
 }
 
 // PostHiddenServiceDescriptorAsync invokes HSPOST.
 func (c *Conn) PostHiddenServiceDescriptorAsync(desc string, servers []string, address string) error {
-	cmd := "+HSPOST"
+	return c.PostHiddenServiceDescriptorAsyncContext(context.Background(), desc, servers, address)
+}
+
+// PostHiddenServiceDescriptorAsyncContext is PostHiddenServiceDescriptorAsync
+// with a context.
+func (c *Conn) PostHiddenServiceDescriptorAsyncContext(
+	ctx context.Context, desc string, servers []string, address string,
+) error {
+	cmd := NewCommand("HSPOST")
 	for _, server := range servers {
-		cmd += " SERVER=" + server
+		cmd.KeyVal("SERVER", server)
 	}
 	if address != "" {
-		cmd += "HSADDRESS=" + address
+		cmd.KeyVal("HSADDRESS", address)
+	}
+	return c.sendCommandIgnoreResponse(ctx, cmd.Body(desc))
+}
+
+// HSDescFailedError is returned by GetHiddenServiceDescriptor and
+// PostHiddenServiceDescriptor when every HSDir tried has failed.
+type HSDescFailedError struct {
+	// Address is the onion service ID without the ".onion" suffix
+	Address string
+	// Upload is true for HSPOST, false for HSFETCH
+	Upload bool
+	// Failures are the HS_DESC FAILED events, one per failed HSDir
+	Failures []*HSDescEvent
+}
+
+// Reasons returns the number of failures for each reason.
+func (h *HSDescFailedError) Reasons() map[string]int {
+	ret := map[string]int{}
+	for _, failure := range h.Failures {
+		ret[failure.Reason]++
+	}
+	return ret
+}
+
+func (h *HSDescFailedError) Error() string {
+	action := "fetching"
+	if h.Upload {
+		action = "uploading"
+	}
+	failures := make([]string, len(h.Failures))
+	for i, failure := range h.Failures {
+		failures[i] = failure.HSDir + " (" + failure.Reason + ")"
+	}
+	return fmt.Sprintf("Failed %v descriptor for %v on all HSDirs: %v", action, h.Address, strings.Join(failures, ", "))
+}
+
+// GetHiddenServiceDescriptor invokes HSFETCH and waits for the descriptor.
+// Servers, if any, are the HSDirs to use. The address can have a ".onion"
+// suffix. If all HSDirs fail, the error is an *HSDescFailedError.
+func (c *Conn) GetHiddenServiceDescriptor(address string, servers ...string) (*HSDescContentEvent, error) {
+	return c.GetHiddenServiceDescriptorContext(context.Background(), address, servers...)
+}
+
+// GetHiddenServiceDescriptorContext is GetHiddenServiceDescriptor with a
+// context.
+func (c *Conn) GetHiddenServiceDescriptorContext(
+	ctx context.Context, address string, servers ...string,
+) (*HSDescContentEvent, error) {
+	address = strings.TrimSuffix(address, ".onion")
+	cmd := NewCommand("HSFETCH").Arg(address)
+	for _, server := range servers {
+		cmd.KeyVal("SERVER", server)
+	}
+	// Track the HSDirs and descriptor IDs requested so only their failures
+	// count. Content for failures has an empty body.
+	pending := map[string]bool{}
+	descIDs := map[string]bool{}
+	failed := &HSDescFailedError{Address: address}
+	event, err := c.eventWaitAfter(ctx, []EventCode{EventCodeHSDesc, EventCodeHSDescContent},
+		func(ctx context.Context) error { return c.sendCommandIgnoreResponse(ctx, cmd) },
+		func(evt Event) (bool, error) {
+			switch evt := evt.(type) {
+			case *HSDescEvent:
+				if evt.Address != address {
+					return false, nil
+				}
+				switch evt.Action {
+				case "REQUESTED":
+					pending[evt.HSDir] = true
+					if evt.DescID != "" {
+						descIDs[evt.DescID] = true
+					}
+				case "FAILED":
+					// Fetches Tor starts itself can be for the same HSDir
+					matchesDescID := evt.DescID == "" || len(descIDs) == 0 || descIDs[evt.DescID]
+					if pending[evt.HSDir] && matchesDescID {
+						delete(pending, evt.HSDir)
+						failed.Failures = append(failed.Failures, evt)
+						if len(pending) == 0 {
+							return false, failed
+						}
+					}
+				}
+			case *HSDescContentEvent:
+				matchesDescID := len(descIDs) == 0 || descIDs[evt.DescID]
+				return evt.Address == address && matchesDescID && evt.Descriptor != "", nil
+			}
+			return false, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return event.(*HSDescContentEvent), nil
+}
+
+// PostHiddenServiceDescriptor invokes HSPOST and waits for the first HSDir to
+// accept the descriptor. Unlike PostHiddenServiceDescriptorAsync, the address
+// is required since it is used to match events. If all HSDirs fail, the error
+// is an *HSDescFailedError.
+//
+// Note, upload events only identify the address and HSDir, so events for an
+// upload Tor starts itself for the same service and HSDir, such as a periodic
+// re-upload, can be mistaken for this call's and succeed or fail it early.
+func (c *Conn) PostHiddenServiceDescriptor(desc string, servers []string, address string) (*HSDescEvent, error) {
+	return c.PostHiddenServiceDescriptorContext(context.Background(), desc, servers, address)
+}
+
+// PostHiddenServiceDescriptorContext is PostHiddenServiceDescriptor with a
+// context.
+func (c *Conn) PostHiddenServiceDescriptorContext(
+	ctx context.Context, desc string, servers []string, address string,
+) (*HSDescEvent, error) {
+	address = strings.TrimSuffix(address, ".onion")
+	if address == "" {
+		return nil, fmt.Errorf("Address required to wait for upload")
+	}
+	// Track the HSDirs uploaded to so only their failures count
+	pending := map[string]bool{}
+	failed := &HSDescFailedError{Address: address, Upload: true}
+	event, err := c.eventWaitAfter(ctx, []EventCode{EventCodeHSDesc},
+		func(ctx context.Context) error {
+			return c.PostHiddenServiceDescriptorAsyncContext(ctx, desc, servers, address)
+		},
+		func(evt Event) (bool, error) {
+			hs, _ := evt.(*HSDescEvent)
+			if hs == nil || hs.Address != address {
+				return false, nil
+			}
+			switch hs.Action {
+			case "UPLOAD":
+				pending[hs.HSDir] = true
+			case "FAILED":
+				if pending[hs.HSDir] {
+					delete(pending, hs.HSDir)
+					failed.Failures = append(failed.Failures, hs)
+					if len(pending) == 0 {
+						return false, failed
+					}
+				}
+			case "UPLOADED":
+				return true, nil
+			}
+			return false, nil
+		})
+	if err != nil {
+		return nil, err
 	}
-	cmd += "\r\n" + desc + "\r\n."
-	return c.sendRequestIgnoreResponse(cmd)
+	return event.(*HSDescEvent), nil
 }
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control/controltest"
+	"github.com/stretchr/testify/require"
+)
+
+const testOnion = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid"
+
+func TestGetHiddenServiceDescriptor(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	// Respond with events for each server, the first two fail
+	server.Handle("HSFETCH", func(req *controltest.Request) []string {
+		go func() {
+			// Failures before any request and for HSDirs not requested from
+			// don't count
+			server.Emit("HS_DESC", "FAILED "+testOnion+" NO_AUTH $AAAA~a descid REASON=NOT_FOUND")
+			hsDirs := []string{"$AAAA~a", "$BBBB~b", "$CCCC~c"}
+			for _, hsDir := range hsDirs {
+				server.Emit("HS_DESC", "REQUESTED "+testOnion+" NO_AUTH "+hsDir+" descid")
+			}
+			// Unrelated events are ignored
+			server.Emit("HS_DESC", "FAILED otheronion NO_AUTH $AAAA~a descid REASON=NOT_FOUND")
+			server.EmitRaw("HS_DESC_CONTENT", "650+HS_DESC_CONTENT otheronion descid $CCCC~c", "other", ".", "650 OK")
+			server.Emit("HS_DESC", "FAILED "+testOnion+" NO_AUTH $DDDD~d descid REASON=NOT_FOUND")
+			// Nor do failures of fetches for other descriptor IDs, e.g. ones Tor
+			// started itself
+			for _, hsDir := range hsDirs {
+				server.Emit("HS_DESC", "FAILED "+testOnion+" NO_AUTH "+hsDir+" otherdescid REASON=NOT_FOUND")
+			}
+			server.Emit("HS_DESC", "FAILED "+testOnion+" NO_AUTH $AAAA~a descid REASON=NOT_FOUND")
+			server.EmitRaw("HS_DESC_CONTENT", "650+HS_DESC_CONTENT "+testOnion+" descid $AAAA~a", ".", "650 OK")
+			server.Emit("HS_DESC", "FAILED "+testOnion+" NO_AUTH $BBBB~b descid REASON=QUERY_REJECTED")
+			server.Emit("HS_DESC", "RECEIVED "+testOnion+" NO_AUTH $CCCC~c descid")
+			server.EmitRaw("HS_DESC_CONTENT", "650+HS_DESC_CONTENT "+testOnion+" descid $CCCC~c",
+				"hs-descriptor 3", "descriptor-lifetime 180", ".", "650 OK")
+		}()
+		return controltest.Reply()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	event, err := conn.GetHiddenServiceDescriptorContext(ctx, testOnion+".onion")
+	require.NoError(t, err)
+	require.Equal(t, "$CCCC~c", event.HSDir)
+	require.Equal(t, "hs-descriptor 3\ndescriptor-lifetime 180", event.Descriptor)
+	// All fail
+	server.Handle("HSFETCH", func(req *controltest.Request) []string {
+		require.Equal(t, testOnion+" SERVER=$AAAA~a SERVER=$BBBB~b", req.Args)
+		go func() {
+			server.Emit("HS_DESC", "REQUESTED "+testOnion+" NO_AUTH $AAAA~a descid")
+			server.Emit("HS_DESC", "REQUESTED "+testOnion+" NO_AUTH $BBBB~b descid")
+			server.Emit("HS_DESC", "FAILED "+testOnion+" NO_AUTH $AAAA~a descid REASON=NOT_FOUND")
+			server.Emit("HS_DESC", "FAILED "+testOnion+" NO_AUTH $BBBB~b descid REASON=NOT_FOUND")
+		}()
+		return controltest.Reply()
+	})
+	_, err = conn.GetHiddenServiceDescriptorContext(ctx, testOnion, "$AAAA~a", "$BBBB~b")
+	var failedErr *HSDescFailedError
+	require.True(t, errors.As(err, &failedErr))
+	require.Len(t, failedErr.Failures, 2)
+	require.Equal(t, map[string]int{"NOT_FOUND": 2}, failedErr.Reasons())
+	require.Equal(t, "Failed fetching descriptor for "+testOnion+
+		" on all HSDirs: $AAAA~a (NOT_FOUND), $BBBB~b (NOT_FOUND)", err.Error())
+	// Command errors are returned
+	server.Handle("HSFETCH", func(req *controltest.Request) []string {
+		return controltest.ErrorReply(513, "Invalid argument")
+	})
+	_, err = conn.GetHiddenServiceDescriptorContext(ctx, "bad")
+	require.True(t, errors.Is(err, ErrUnrecognizedArgument))
+	// Context is honored
+	server.Handle("HSFETCH", func(req *controltest.Request) []string { return controltest.Reply() })
+	shortCtx, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer shortCancel()
+	_, err = conn.GetHiddenServiceDescriptorContext(shortCtx, testOnion)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestPostHiddenServiceDescriptor(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	server.Handle("HSPOST", func(req *controltest.Request) []string {
+		require.Equal(t, "HSADDRESS="+testOnion, req.Args)
+		require.Equal(t, "desc", req.Body)
+		go func() {
+			// Failures before any upload and for other HSDirs don't count
+			server.Emit("HS_DESC", "FAILED "+testOnion+" UNKNOWN $BBBB~b descid REASON=UPLOAD_REJECTED")
+			server.Emit("HS_DESC", "UPLOAD "+testOnion+" UNKNOWN $AAAA~a descid HSDIR_INDEX=idx")
+			server.Emit("HS_DESC", "FAILED "+testOnion+" UNKNOWN $CCCC~c descid REASON=UPLOAD_REJECTED")
+			server.Emit("HS_DESC", "UPLOAD "+testOnion+" UNKNOWN $BBBB~b descid HSDIR_INDEX=idx")
+			server.Emit("HS_DESC", "FAILED "+testOnion+" UNKNOWN $AAAA~a descid REASON=UPLOAD_REJECTED")
+			server.Emit("HS_DESC", "UPLOADED "+testOnion+" UNKNOWN $BBBB~b")
+		}()
+		return controltest.Reply()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	event, err := conn.PostHiddenServiceDescriptorContext(ctx, "desc", nil, testOnion)
+	require.NoError(t, err)
+	require.Equal(t, "$BBBB~b", event.HSDir)
+	// All fail
+	server.Handle("HSPOST", func(req *controltest.Request) []string {
+		go func() {
+			server.Emit("HS_DESC", "UPLOAD "+testOnion+" UNKNOWN $AAAA~a descid HSDIR_INDEX=idx")
+			server.Emit("HS_DESC", "FAILED "+testOnion+" UNKNOWN $AAAA~a descid REASON=UPLOAD_REJECTED")
+		}()
+		return controltest.Reply()
+	})
+	_, err = conn.PostHiddenServiceDescriptorContext(ctx, "desc", []string{"$AAAA~a"}, testOnion+".onion")
+	require.EqualError(t, err, "Failed uploading descriptor for "+testOnion+" on all HSDirs: $AAAA~a (UPLOAD_REJECTED)")
+	// Address required
+	_, err = conn.PostHiddenServiceDescriptorContext(ctx, "desc", nil, "")
+	require.Error(t, err)
+}
@@ -1,28 +1,43 @@
 package control
 
 import (
-	"strings"
+	"context"
 
 	"github.com/cretz/bine/torutil"
 )
 
 // Signal invokes SIGNAL.
 func (c *Conn) Signal(signal string) error {
-	return c.sendRequestIgnoreResponse("SIGNAL %v", signal)
+	return c.SignalContext(context.Background(), signal)
+}
+
+// SignalContext is Signal with a context.
+func (c *Conn) SignalContext(ctx context.Context, signal string) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("SIGNAL").Arg(signal))
 }
 
 // Quit invokes QUIT.
 func (c *Conn) Quit() error {
-	return c.sendRequestIgnoreResponse("QUIT")
+	return c.QuitContext(context.Background())
+}
+
+// QuitContext is Quit with a context.
+func (c *Conn) QuitContext(ctx context.Context) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("QUIT"))
 }
 
 // MapAddresses invokes MAPADDRESS and returns mapped addresses.
 func (c *Conn) MapAddresses(addresses ...*KeyVal) ([]*KeyVal, error) {
-	cmd := "MAPADDRESS"
+	return c.MapAddressesContext(context.Background(), addresses...)
+}
+
+// MapAddressesContext is MapAddresses with a context.
+func (c *Conn) MapAddressesContext(ctx context.Context, addresses ...*KeyVal) ([]*KeyVal, error) {
+	cmd := NewCommand("MAPADDRESS")
 	for _, address := range addresses {
-		cmd += " " + address.Key + "=" + address.Val
+		cmd.KeyVal(address.Key, address.Val)
 	}
-	resp, err := c.SendRequest(cmd)
+	resp, err := c.SendCommand(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -38,7 +53,12 @@ func (c *Conn) MapAddresses(addresses ...*KeyVal) ([]*KeyVal, error) {
 
 // GetInfo invokes GETINTO and returns values for requested keys.
 func (c *Conn) GetInfo(keys ...string) ([]*KeyVal, error) {
-	resp, err := c.SendRequest("GETINFO %v", strings.Join(keys, " "))
+	return c.GetInfoContext(context.Background(), keys...)
+}
+
+// GetInfoContext is GetInfo with a context.
+func (c *Conn) GetInfoContext(ctx context.Context, keys ...string) ([]*KeyVal, error) {
+	resp, err := c.SendCommand(ctx, NewCommand("GETINFO").Arg(keys...))
 	if err != nil {
 		return nil, err
 	}
@@ -56,37 +76,61 @@ func (c *Conn) GetInfo(keys ...string) ([]*KeyVal, error) {
 
 // PostDescriptor invokes POSTDESCRIPTOR.
 func (c *Conn) PostDescriptor(descriptor string, purpose string, cache string) error {
-	cmd := "+POSTDESCRIPTOR"
+	return c.PostDescriptorContext(context.Background(), descriptor, purpose, cache)
+}
+
+// PostDescriptorContext is PostDescriptor with a context.
+func (c *Conn) PostDescriptorContext(ctx context.Context, descriptor string, purpose string, cache string) error {
+	cmd := NewCommand("POSTDESCRIPTOR")
 	if purpose != "" {
-		cmd += " purpose=" + purpose
+		cmd.KeyVal("purpose", purpose)
 	}
 	if cache != "" {
-		cmd += " cache=" + cache
+		cmd.KeyVal("cache", cache)
 	}
-	cmd += "\r\n" + descriptor + "\r\n."
-	return c.sendRequestIgnoreResponse(cmd)
+	return c.sendCommandIgnoreResponse(ctx, cmd.Body(descriptor))
 }
 
 // UseFeatures invokes USEFEATURE.
 func (c *Conn) UseFeatures(features ...string) error {
-	return c.sendRequestIgnoreResponse("USEFEATURE " + strings.Join(features, " "))
+	return c.UseFeaturesContext(context.Background(), features...)
+}
+
+// UseFeaturesContext is UseFeatures with a context.
+func (c *Conn) UseFeaturesContext(ctx context.Context, features ...string) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("USEFEATURE").Arg(features...))
 }
 
 // ResolveAsync invokes RESOLVE.
 func (c *Conn) ResolveAsync(address string, reverse bool) error {
-	cmd := "RESOLVE "
+	return c.ResolveAsyncContext(context.Background(), address, reverse)
+}
+
+// ResolveAsyncContext is ResolveAsync with a context.
+func (c *Conn) ResolveAsyncContext(ctx context.Context, address string, reverse bool) error {
+	cmd := NewCommand("RESOLVE")
 	if reverse {
-		cmd += "mode=reverse "
+		cmd.KeyVal("mode", "reverse")
 	}
-	return c.sendRequestIgnoreResponse(cmd + address)
+	return c.sendCommandIgnoreResponse(ctx, cmd.Arg(address))
 }
 
 // TakeOwnership invokes TAKEOWNERSHIP.
 func (c *Conn) TakeOwnership() error {
-	return c.sendRequestIgnoreResponse("TAKEOWNERSHIP")
+	return c.TakeOwnershipContext(context.Background())
+}
+
+// TakeOwnershipContext is TakeOwnership with a context.
+func (c *Conn) TakeOwnershipContext(ctx context.Context) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("TAKEOWNERSHIP"))
 }
 
 // DropGuards invokes DROPGUARDS.
 func (c *Conn) DropGuards() error {
-	return c.sendRequestIgnoreResponse("DROPGUARDS")
+	return c.DropGuardsContext(context.Background())
+}
+
+// DropGuardsContext is DropGuards with a context.
+func (c *Conn) DropGuardsContext(ctx context.Context) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("DROPGUARDS"))
 }
@@ -1,6 +1,7 @@
 package control
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
@@ -143,28 +144,34 @@ type AddOnionResponse struct {
 
 // AddOnion invokes ADD_ONION and returns its response.
 func (c *Conn) AddOnion(req *AddOnionRequest) (*AddOnionResponse, error) {
+	return c.AddOnionContext(context.Background(), req)
+}
+
+// AddOnionContext is AddOnion with a context.
+func (c *Conn) AddOnionContext(ctx context.Context, req *AddOnionRequest) (*AddOnionResponse, error) {
 	// Build command
 	if req.Key == nil {
 		return nil, c.protoErr("Key required")
 	}
-	cmd := "ADD_ONION " + string(req.Key.Type()) + ":" + req.Key.Blob()
+	cmd := NewCommand("ADD_ONION").Arg(string(req.Key.Type()) + ":" + req.Key.Blob())
 	if len(req.Flags) > 0 {
-		cmd += " Flags=" + strings.Join(req.Flags, ",")
+		cmd.KeyVal("Flags", strings.Join(req.Flags, ","))
 	}
 	if req.MaxStreams > 0 {
-		cmd += " MaxStreams=" + strconv.Itoa(req.MaxStreams)
+		cmd.KeyVal("MaxStreams", strconv.Itoa(req.MaxStreams))
 	}
 	for _, port := range req.Ports {
-		cmd += " Port=" + port.Key
+		target := port.Key
 		if port.Val != "" {
-			cmd += "," + port.Val
+			target += "," + port.Val
 		}
+		cmd.KeyVal("Port", target)
 	}
 	for _, blob := range req.ClientAuths {
-		cmd += " ClientAuthV3=" + blob
+		cmd.KeyVal("ClientAuthV3", blob)
 	}
 	// Invoke and read response
-	resp, err := c.SendRequest(cmd)
+	resp, err := c.SendCommand(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -185,5 +192,132 @@ func (c *Conn) AddOnion(req *AddOnionRequest) (*AddOnionResponse, error) {
 
 // DelOnion invokes DELONION.
 func (c *Conn) DelOnion(serviceID string) error {
-	return c.sendRequestIgnoreResponse("DEL_ONION %v", serviceID)
+	return c.DelOnionContext(context.Background(), serviceID)
+}
+
+// DelOnionContext is DelOnion with a context.
+func (c *Conn) DelOnionContext(ctx context.Context, serviceID string) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("DEL_ONION").Arg(serviceID))
+}
+
+// OnionClientAuthKeyTypeX25519 is the only supported key type for onion client
+// authorization.
+const OnionClientAuthKeyTypeX25519 = "x25519"
+
+// OnionClientAuth is a client authorization credential for a v3 onion
+// service as used by the ONION_CLIENT_AUTH_* commands.
+type OnionClientAuth struct {
+	// Address is the onion service ID without the ".onion" suffix.
+	Address string
+	// KeyType is the key type, OnionClientAuthKeyTypeX25519 if empty.
+	KeyType string
+	// PrivateKey is the 32-byte x25519 private key.
+	PrivateKey []byte
+	// ClientName is an optional nickname for the credential.
+	ClientName string
+	// Permanent is whether the credential is stored in ClientOnionAuthDir.
+	Permanent bool
+}
+
+// OnionClientAuthAddResponse is the response for AddOnionClientAuth.
+type OnionClientAuthAddResponse struct {
+	// Replaced is true if credentials for the service already existed.
+	Replaced bool
+	// Decrypted is true if a cached descriptor was decrypted with the
+	// credentials.
+	Decrypted bool
+}
+
+// AddOnionClientAuth invokes ONION_CLIENT_AUTH_ADD.
+func (c *Conn) AddOnionClientAuth(auth *OnionClientAuth) (*OnionClientAuthAddResponse, error) {
+	return c.AddOnionClientAuthContext(context.Background(), auth)
+}
+
+// AddOnionClientAuthContext is AddOnionClientAuth with a context.
+func (c *Conn) AddOnionClientAuthContext(
+	ctx context.Context, auth *OnionClientAuth,
+) (*OnionClientAuthAddResponse, error) {
+	keyType := auth.KeyType
+	if keyType == "" {
+		keyType = OnionClientAuthKeyTypeX25519
+	}
+	cmd := NewCommand("ONION_CLIENT_AUTH_ADD").Arg(strings.TrimSuffix(auth.Address, ".onion"),
+		keyType+":"+base64.StdEncoding.EncodeToString(auth.PrivateKey))
+	if auth.ClientName != "" {
+		cmd.KeyVal("ClientName", auth.ClientName)
+	}
+	if auth.Permanent {
+		cmd.KeyVal("Flags", "Permanent")
+	}
+	resp, err := c.SendCommand(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &OnionClientAuthAddResponse{
+		Replaced:  resp.Err.Code == StatusOkUnnecessary,
+		Decrypted: resp.Err.Code == StatusOkDecrypted,
+	}, nil
+}
+
+// RemoveOnionClientAuth invokes ONION_CLIENT_AUTH_REMOVE. The result is false
+// if there were no credentials for the address.
+func (c *Conn) RemoveOnionClientAuth(address string) (bool, error) {
+	return c.RemoveOnionClientAuthContext(context.Background(), address)
+}
+
+// RemoveOnionClientAuthContext is RemoveOnionClientAuth with a context.
+func (c *Conn) RemoveOnionClientAuthContext(ctx context.Context, address string) (bool, error) {
+	resp, err := c.SendCommand(ctx,
+		NewCommand("ONION_CLIENT_AUTH_REMOVE").Arg(strings.TrimSuffix(address, ".onion")))
+	if err != nil {
+		return false, err
+	}
+	return resp.Err.Code != StatusOkUnnecessary, nil
+}
+
+// ViewOnionClientAuth invokes ONION_CLIENT_AUTH_VIEW. If address is empty, all
+// credentials are returned.
+func (c *Conn) ViewOnionClientAuth(address string) ([]*OnionClientAuth, error) {
+	return c.ViewOnionClientAuthContext(context.Background(), address)
+}
+
+// ViewOnionClientAuthContext is ViewOnionClientAuth with a context.
+func (c *Conn) ViewOnionClientAuthContext(ctx context.Context, address string) ([]*OnionClientAuth, error) {
+	cmd := NewCommand("ONION_CLIENT_AUTH_VIEW")
+	if address != "" {
+		cmd.Arg(strings.TrimSuffix(address, ".onion"))
+	}
+	resp, err := c.SendCommand(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*OnionClientAuth{}
+	for _, data := range resp.Data {
+		if !strings.HasPrefix(data, "CLIENT ") {
+			continue
+		}
+		fields := strings.Fields(data)
+		if len(fields) < 3 {
+			return nil, c.protoErr("Invalid client auth: %v", data)
+		}
+		auth := &OnionClientAuth{Address: fields[1]}
+		keyType, blob, _ := torutil.PartitionString(fields[2], ':')
+		auth.KeyType = keyType
+		if auth.PrivateKey, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(blob, "=")); err != nil {
+			return nil, c.protoErr("Invalid client auth key: %v", err)
+		}
+		for _, field := range fields[3:] {
+			key, val, _ := torutil.PartitionString(field, '=')
+			switch key {
+			case "ClientName":
+				auth.ClientName = val
+			case "Flags":
+				for _, flag := range strings.Split(val, ",") {
+					auth.Permanent = auth.Permanent || flag == "Permanent"
+				}
+			}
+		}
+		ret = append(ret, auth)
+	}
+	return ret, nil
 }
@@ -0,0 +1,73 @@
+package control
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/cretz/bine/control/controltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnionClientAuth(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	key := bytes.Repeat([]byte{1}, 32)
+	keyStr := base64.StdEncoding.EncodeToString(key)
+	// Add replies depend on the client name
+	server.Handle("ONION_CLIENT_AUTH_ADD", func(req *controltest.Request) []string {
+		switch req.Args {
+		case testOnion + " x25519:" + keyStr:
+			return controltest.Reply()
+		case testOnion + " x25519:" + keyStr + " ClientName=bob Flags=Permanent":
+			return controltest.ErrorReply(StatusOkUnnecessary, "Client for onion existed and replaced")
+		case testOnion + " x25519:" + keyStr + " ClientName=alice":
+			return controltest.ErrorReply(StatusOkDecrypted, "Registered client and decrypted desc")
+		}
+		return controltest.ErrorReply(StatusErrSyntaxError, "Unexpected args: "+req.Args)
+	})
+	resp, err := conn.AddOnionClientAuth(&OnionClientAuth{Address: testOnion + ".onion", PrivateKey: key})
+	require.NoError(t, err)
+	require.Equal(t, &OnionClientAuthAddResponse{}, resp)
+	resp, err = conn.AddOnionClientAuth(&OnionClientAuth{
+		Address: testOnion, PrivateKey: key, ClientName: "bob", Permanent: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, &OnionClientAuthAddResponse{Replaced: true}, resp)
+	resp, err = conn.AddOnionClientAuth(&OnionClientAuth{Address: testOnion, PrivateKey: key, ClientName: "alice"})
+	require.NoError(t, err)
+	require.Equal(t, &OnionClientAuthAddResponse{Decrypted: true}, resp)
+	_, err = conn.AddOnionClientAuth(&OnionClientAuth{Address: testOnion, KeyType: "foo", PrivateKey: key})
+	require.Error(t, err)
+
+	// View parses each client line
+	server.Handle("ONION_CLIENT_AUTH_VIEW", func(req *controltest.Request) []string {
+		require.Equal(t, testOnion, req.Args)
+		return []string{
+			"250-ONION_CLIENT_AUTH_VIEW " + testOnion,
+			"250-CLIENT " + testOnion + " x25519:" + keyStr + " ClientName=bob Flags=Permanent",
+			"250-CLIENT " + testOnion + " x25519:" + keyStr,
+			"250 OK",
+		}
+	})
+	auths, err := conn.ViewOnionClientAuth(testOnion + ".onion")
+	require.NoError(t, err)
+	require.Equal(t, []*OnionClientAuth{
+		{Address: testOnion, KeyType: OnionClientAuthKeyTypeX25519, PrivateKey: key, ClientName: "bob", Permanent: true},
+		{Address: testOnion, KeyType: OnionClientAuthKeyTypeX25519, PrivateKey: key},
+	}, auths)
+
+	// Remove reports whether anything was removed
+	server.Handle("ONION_CLIENT_AUTH_REMOVE", func(req *controltest.Request) []string {
+		if req.Args == testOnion {
+			return controltest.Reply()
+		}
+		return controltest.ErrorReply(StatusOkUnnecessary, "No credentials for \""+req.Args+"\"")
+	})
+	found, err := conn.RemoveOnionClientAuth(testOnion + ".onion")
+	require.NoError(t, err)
+	require.True(t, found)
+	found, err = conn.RemoveOnionClientAuth("other")
+	require.NoError(t, err)
+	require.False(t, found)
+}
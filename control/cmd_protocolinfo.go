@@ -1,6 +1,7 @@
 package control
 
 import (
+	"context"
 	"strings"
 
 	"github.com/cretz/bine/torutil"
@@ -25,20 +26,52 @@ func (p *ProtocolInfo) HasAuthMethod(authMethod string) bool {
 }
 
 // ProtocolInfo invokes PROTOCOLINFO on first invocation and returns a cached
-// result on all others.
+// result on all others. PROTOCOLINFO is only ever sent once per connection
+// since Tor closes unauthenticated connections that send it twice.
 func (c *Conn) ProtocolInfo() (*ProtocolInfo, error) {
-	var err error
-	if c.protocolInfo == nil {
-		c.protocolInfo, err = c.sendProtocolInfo()
-	}
-	return c.protocolInfo, err
+	return c.ProtocolInfoContext(context.Background())
 }
 
-func (c *Conn) sendProtocolInfo() (*ProtocolInfo, error) {
-	resp, err := c.SendRequest("PROTOCOLINFO")
-	if err != nil {
-		return nil, err
+// ProtocolInfoContext is ProtocolInfo with a context. If the context completes
+// after PROTOCOLINFO is written, the reply is still handled in the background
+// and cached for the next call.
+func (c *Conn) ProtocolInfoContext(ctx context.Context) (*ProtocolInfo, error) {
+	c.protocolInfoLock.Lock()
+	done := c.protocolInfoDone
+	if done == nil {
+		request := NewCommand("PROTOCOLINFO").String()
+		replyCh, err := c.writeRequest(ctx, request)
+		if err != nil {
+			c.protocolInfoLock.Unlock()
+			return nil, err
+		}
+		done = make(chan struct{})
+		c.protocolInfoDone = done
+		go func() {
+			resp, err := (<-replyCh).result(request)
+			var info *ProtocolInfo
+			if err == nil {
+				info, err = c.parseProtocolInfo(resp)
+			}
+			c.protocolInfoLock.Lock()
+			c.protocolInfo, c.protocolInfoErr = info, err
+			c.protocolInfoLock.Unlock()
+			close(done)
+		}()
 	}
+	c.protocolInfoLock.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.protocolInfoLock.Lock()
+	defer c.protocolInfoLock.Unlock()
+	return c.protocolInfo, c.protocolInfoErr
+}
+
+func (c *Conn) parseProtocolInfo(resp *Response) (*ProtocolInfo, error) {
+	var err error
 	// Check data vals
 	ret := &ProtocolInfo{RawResponse: resp}
 	for _, piece := range resp.Data {
@@ -1,31 +1,47 @@
 package control
 
 import (
+	"context"
 	"strconv"
 )
 
 // AttachStream invokes ATTACHSTREAM.
 func (c *Conn) AttachStream(streamID string, circuitID string, hopNum int) error {
+	return c.AttachStreamContext(context.Background(), streamID, circuitID, hopNum)
+}
+
+// AttachStreamContext is AttachStream with a context.
+func (c *Conn) AttachStreamContext(ctx context.Context, streamID string, circuitID string, hopNum int) error {
 	if circuitID == "" {
 		circuitID = "0"
 	}
-	cmd := "ATTACHSTREAM " + streamID + " " + circuitID
+	cmd := NewCommand("ATTACHSTREAM").Arg(streamID, circuitID)
 	if hopNum > 0 {
-		cmd += " HOP=" + strconv.Itoa(hopNum)
+		cmd.KeyVal("HOP", strconv.Itoa(hopNum))
 	}
-	return c.sendRequestIgnoreResponse(cmd)
+	return c.sendCommandIgnoreResponse(ctx, cmd)
 }
 
 // RedirectStream invokes REDIRECTSTREAM.
 func (c *Conn) RedirectStream(streamID string, address string, port int) error {
-	cmd := "REDIRECTSTREAM " + streamID + " " + address
+	return c.RedirectStreamContext(context.Background(), streamID, address, port)
+}
+
+// RedirectStreamContext is RedirectStream with a context.
+func (c *Conn) RedirectStreamContext(ctx context.Context, streamID string, address string, port int) error {
+	cmd := NewCommand("REDIRECTSTREAM").Arg(streamID, address)
 	if port > 0 {
-		cmd += " " + strconv.Itoa(port)
+		cmd.Arg(strconv.Itoa(port))
 	}
-	return c.sendRequestIgnoreResponse(cmd)
+	return c.sendCommandIgnoreResponse(ctx, cmd)
 }
 
 // CloseStream invokes CLOSESTREAM.
 func (c *Conn) CloseStream(streamID string, reason string) error {
-	return c.sendRequestIgnoreResponse("CLOSESTREAM %v %v", streamID, reason)
+	return c.CloseStreamContext(context.Background(), streamID, reason)
+}
+
+// CloseStreamContext is CloseStream with a context.
+func (c *Conn) CloseStreamContext(ctx context.Context, streamID string, reason string) error {
+	return c.sendCommandIgnoreResponse(ctx, NewCommand("CLOSESTREAM").Arg(streamID, reason))
 }
@@ -0,0 +1,177 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cretz/bine/torutil"
+)
+
+// Command is a control protocol request built from typed pieces so that values
+// can't corrupt the command or inject other commands. Create one with
+// NewCommand, add to it with the chainable methods, and send it with
+// SendCommand. Unsafe values are not sent; the first one makes the command
+// invalid and is reported by Err and SendCommand.
+type Command struct {
+	keyword string
+	args    []string
+	body    []string
+	hasBody bool
+	err     error
+}
+
+// NewCommand creates a Command for the given keyword, e.g. "GETINFO". The
+// keyword must be letters, digits, and underscores.
+func NewCommand(keyword string) *Command {
+	c := &Command{keyword: keyword}
+	if keyword == "" {
+		c.err = fmt.Errorf("Missing command keyword")
+	}
+	for _, r := range keyword {
+		if !(r >= 'A' && r <= 'Z') && !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '_' {
+			c.err = fmt.Errorf("Invalid command keyword %q", keyword)
+			break
+		}
+	}
+	return c
+}
+
+// checkWord returns an error if the value is empty or has spaces, quotes,
+// control characters, or non-ASCII bytes. The desc describes the value.
+func checkWord(desc string, val string, disallow string) error {
+	if val == "" {
+		return fmt.Errorf("Empty %v", desc)
+	}
+	for i := 0; i < len(val); i++ {
+		if b := val[i]; b <= ' ' || b >= 0x7f || b == '"' || strings.IndexByte(disallow, b) >= 0 {
+			return fmt.Errorf("Invalid %v %q: unsafe character %q", desc, val, b)
+		}
+	}
+	return nil
+}
+
+// checkQuotable returns an error if the value has characters that can't be in a
+// quoted string even with escaping.
+func checkQuotable(desc string, val string) error {
+	for i := 0; i < len(val); i++ {
+		if b := val[i]; (b < ' ' && b != '\r' && b != '\n' && b != '\t') || b == 0x7f {
+			return fmt.Errorf("Invalid %v %q: unsafe character %q", desc, val, b)
+		}
+	}
+	return nil
+}
+
+func (c *Command) add(arg string, err error) *Command {
+	if c.err == nil {
+		if err != nil {
+			c.err = fmt.Errorf("%v for %v", err, c.keyword)
+		} else {
+			c.args = append(c.args, arg)
+		}
+	}
+	return c
+}
+
+// Arg adds unquoted arguments. Each must be non-empty and have no spaces,
+// quotes, or control characters.
+func (c *Command) Arg(args ...string) *Command {
+	for _, arg := range args {
+		c.add(arg, checkWord("argument", arg, ""))
+	}
+	return c
+}
+
+// QuotedArg adds a quoted string argument, escaping as needed.
+func (c *Command) QuotedArg(arg string) *Command {
+	return c.add(torutil.EscapeSimpleQuotedString(arg), checkQuotable("argument", arg))
+}
+
+// KeyVal adds an unquoted key=value argument. Both must follow the same rules
+// as Arg and the key can't contain "=".
+func (c *Command) KeyVal(key string, val string) *Command {
+	err := checkWord("key", key, "=")
+	if err == nil {
+		err = checkWord("value", val, "")
+	}
+	return c.add(key+"="+val, err)
+}
+
+// KeyQuotedVal adds a key="value" argument, escaping the value as needed. The
+// key must follow the same rules as KeyVal.
+func (c *Command) KeyQuotedVal(key string, val string) *Command {
+	err := checkWord("key", key, "=")
+	if err == nil {
+		err = checkQuotable("value", val)
+	}
+	return c.add(key+"="+torutil.EscapeSimpleQuotedString(val), err)
+}
+
+// KeyMaybeQuotedVal is KeyVal if the value is safe unquoted, otherwise it is
+// KeyQuotedVal. An empty value results in key="".
+func (c *Command) KeyMaybeQuotedVal(key string, val string) *Command {
+	if checkWord("value", val, "") == nil {
+		return c.KeyVal(key, val)
+	}
+	return c.KeyQuotedVal(key, val)
+}
+
+// Body sets the multi-line data sent after the command line, making this a
+// "+" command. Line endings are normalized and lines starting with a period
+// are escaped per the dot-encoding rules.
+func (c *Command) Body(body string) *Command {
+	if c.err != nil {
+		return c
+	}
+	body = strings.TrimSuffix(strings.Replace(body, "\r\n", "\n", -1), "\n")
+	if err := checkQuotable("body", body); err != nil {
+		c.err = fmt.Errorf("%v for %v", err, c.keyword)
+		return c
+	} else if strings.IndexByte(body, '\r') >= 0 {
+		c.err = fmt.Errorf("Invalid body for %v: carriage return without newline", c.keyword)
+		return c
+	}
+	c.body = strings.Split(body, "\n")
+	for i, line := range c.body {
+		if strings.HasPrefix(line, ".") {
+			c.body[i] = "." + line
+		}
+	}
+	c.hasBody = true
+	return c
+}
+
+// Err returns the error for the first unsafe value given, or nil if the
+// command is valid.
+func (c *Command) Err() error { return c.err }
+
+// String returns the command as sent on the wire without the final CRLF. It is
+// only meaningful if Err is nil.
+func (c *Command) String() string {
+	line := c.keyword
+	if c.hasBody {
+		line = "+" + line
+	}
+	if len(c.args) > 0 {
+		line += " " + strings.Join(c.args, " ")
+	}
+	if !c.hasBody {
+		return line
+	}
+	return line + "\r\n" + strings.Join(c.body, "\r\n") + "\r\n."
+}
+
+// SendCommand sends the command as a synchronous request, see
+// SendRequestContext. If the command is invalid, nothing is sent and its error
+// is returned.
+func (c *Conn) SendCommand(ctx context.Context, cmd *Command) (*Response, error) {
+	if cmd.err != nil {
+		return nil, cmd.err
+	}
+	return c.sendRequest(ctx, cmd.String())
+}
+
+func (c *Conn) sendCommandIgnoreResponse(ctx context.Context, cmd *Command) error {
+	_, err := c.SendCommand(ctx, cmd)
+	return err
+}
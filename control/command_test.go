@@ -0,0 +1,67 @@
+package control
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cretz/bine/control/controltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandString(t *testing.T) {
+	assert := func(expected string, cmd *Command) {
+		require.NoError(t, cmd.Err())
+		require.Equal(t, expected, cmd.String())
+	}
+	assert("GETINFO version", NewCommand("GETINFO").Arg("version"))
+	assert("MAPADDRESS 1.2.3.4=100%.onion", NewCommand("MAPADDRESS").KeyVal("1.2.3.4", "100%.onion"))
+	assert(`SETCONF A=1 B="x y" C="a\r\nb" D=""`,
+		NewCommand("SETCONF").KeyMaybeQuotedVal("A", "1").KeyMaybeQuotedVal("B", "x y").
+			KeyMaybeQuotedVal("C", "a\r\nb").KeyMaybeQuotedVal("D", ""))
+	assert(`AUTHENTICATE "pass \"word\""`, NewCommand("AUTHENTICATE").QuotedArg(`pass "word"`))
+	assert("+LOADCONF\r\nA 1\r\n..B\r\n\r\n.", NewCommand("LOADCONF").Body("A 1\n.B\r\n\n"))
+	assert("+HSPOST SERVER=x HSADDRESS=y\r\ndesc\r\n.", NewCommand("HSPOST").KeyVal("SERVER", "x").
+		KeyVal("HSADDRESS", "y").Body("desc"))
+}
+
+func TestCommandRejectsUnsafe(t *testing.T) {
+	assert := func(cmd *Command) {
+		require.Error(t, cmd.Err())
+	}
+	assert(NewCommand(""))
+	assert(NewCommand("GETINFO\r\nSIGNAL"))
+	assert(NewCommand("GETINFO").Arg("version\r\nSIGNAL HALT"))
+	assert(NewCommand("GETINFO").Arg(""))
+	assert(NewCommand("GETINFO").Arg("a b"))
+	assert(NewCommand("GETINFO").Arg(`"a"`))
+	assert(NewCommand("MAPADDRESS").KeyVal("a=b", "c"))
+	assert(NewCommand("MAPADDRESS").KeyVal("a", "c\nSIGNAL HALT"))
+	assert(NewCommand("SETCONF").KeyQuotedVal("a\n", "b"))
+	assert(NewCommand("SETCONF").KeyQuotedVal("a", "b\x00"))
+	assert(NewCommand("LOADCONF").Body("a\rb"))
+	// The first error sticks
+	cmd := NewCommand("GETINFO").Arg("a\n").Arg("b")
+	require.Contains(t, cmd.Err().Error(), `"a\n"`)
+}
+
+func TestCommandsRejectInjection(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	before := len(server.Requests())
+	require.Error(t, conn.SetConf(NewKeyVal("SocksPort\r\nSIGNAL HALT", "9050")))
+	_, err := conn.MapAddresses(NewKeyVal("1.2.3.4", "example.com\r\nSIGNAL HALT"))
+	require.Error(t, err)
+	_, err = conn.AddOnion(&AddOnionRequest{
+		Key:   GenKey(KeyAlgoED25519V3),
+		Ports: []*KeyVal{NewKeyVal("80", "127.0.0.1:80\r\nSIGNAL HALT")},
+	})
+	require.Error(t, err)
+	_, err = conn.SendCommand(context.Background(), NewCommand("SIGNAL").Arg("HALT\n"))
+	require.Error(t, err)
+	// Nothing was sent
+	require.Len(t, server.Requests(), before)
+	// Values with percent signs are sent as-is
+	require.NoError(t, conn.SetConf(NewKeyVal("Nickname", "100%")))
+	val, _ := server.Conf("Nickname")
+	require.Equal(t, "100%", val)
+}
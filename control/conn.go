@@ -1,6 +1,7 @@
 package control
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/textproto"
@@ -8,79 +9,236 @@ import (
 )
 
 // Conn is the connection to the Tor control port.
+//
+// A single background goroutine, started by NewConn, reads everything Tor
+// sends. Asynchronous events are relayed to listeners and all other responses
+// are matched in FIFO order to the requests that were sent. This means methods
+// on Conn may be called from multiple goroutines at once and have their
+// requests in flight simultaneously.
 type Conn struct {
 	// DebugWriter is the writer that debug logs for this library (not Tor
 	// itself) will be written to. If nil, no debug logs are generated/written.
+	// The background reader uses it too, so it must not be changed once the
+	// Conn is created. Use NewConnWithDebugWriter to set it.
 	DebugWriter io.Writer
 
 	// This is the underlying connection.
 	conn *textproto.Conn
 
-	// This is set lazily by ProtocolInfo().
-	protocolInfo *ProtocolInfo
+	// The lock for protocolInfoDone, protocolInfo, and protocolInfoErr. It is
+	// held while PROTOCOLINFO is written.
+	protocolInfoLock sync.Mutex
+	// Nil until PROTOCOLINFO is written, then closed once its reply is
+	// handled.
+	protocolInfoDone chan struct{}
+	// These are set lazily by ProtocolInfo().
+	protocolInfo    *ProtocolInfo
+	protocolInfoErr error
+
+	// The lock for Authenticated
+	stateLock sync.Mutex
 
 	// True if Authenticate has been called successfully.
+	//
+	// Deprecated: Use IsAuthenticated. Reading this field directly races with
+	// an Authenticate call on another goroutine.
 	Authenticated bool
 
-	// The lock fot eventListeners
+	// This single-slot channel is held during Authenticate so concurrent
+	// calls don't authenticate twice.
+	authLock chan struct{}
+
+	// The lock fot eventListeners and eventListenersByChan
 	eventListenersLock sync.RWMutex
 	// The value slices can be traversed outside of lock, they are completely
 	// replaced on change, never mutated. But the map itself must be locked on
 	// when reading or writing.
-	eventListeners map[EventCode][]chan<- Event
+	eventListeners map[EventCode][]*eventListener
+	// Each channel has a single listener no matter how many event codes it is
+	// registered for.
+	eventListenersByChan map[chan<- Event]*eventListener
+
+	// This single-slot channel is held while a request is written and its
+	// reply is queued. It guarantees the order of pendingReplies matches the
+	// order the requests are written in. It's a channel instead of a mutex so
+	// acquiring it can be abandoned when a context is done.
+	writeLock chan struct{}
+
+	// The lock for pendingReplies, readErr, and responseReadCh.
+	readStateLock sync.Mutex
+	// Reply channels for written requests in the order they were written. The
+	// reader pops the first one off on every synchronous response.
+	pendingReplies []chan<- *pendingReply
+	// The error that stopped the reader. Only set after readDone is closed.
+	readErr error
+	// Closed and replaced after every response the reader handles.
+	responseReadCh chan struct{}
+	// Closed when the reader stops.
+	readDone chan struct{}
+}
 
-	// This mutex is locked on when an entire response needs to be read. It
-	// helps synchronize accesses to the response by the asynchronous response
-	// listeners and the synchronous responses.
-	readLock sync.Mutex
+type pendingReply struct {
+	resp *Response
+	err  error
 }
 
-// NewConn creates a Conn from the given textproto connection.
+// NewConn creates a Conn from the given textproto connection. This starts the
+// background reader for the connection which runs until the connection is
+// closed or a read fails.
 func NewConn(conn *textproto.Conn) *Conn {
-	return &Conn{
-		conn:           conn,
-		eventListeners: map[EventCode][]chan<- Event{},
-	}
+	return NewConnWithDebugWriter(conn, nil)
 }
 
-func (c *Conn) sendRequestIgnoreResponse(format string, args ...interface{}) error {
-	_, err := c.SendRequest(format, args...)
-	return err
+// NewConnWithDebugWriter is NewConn with the DebugWriter set before the
+// background reader starts. The debug writer can be nil.
+func NewConnWithDebugWriter(conn *textproto.Conn, debugWriter io.Writer) *Conn {
+	c := &Conn{
+		DebugWriter:          debugWriter,
+		conn:                 conn,
+		authLock:             make(chan struct{}, 1),
+		eventListeners:       map[EventCode][]*eventListener{},
+		eventListenersByChan: map[chan<- Event]*eventListener{},
+		responseReadCh:       make(chan struct{}),
+		readDone:             make(chan struct{}),
+		writeLock:            make(chan struct{}, 1),
+	}
+	go c.readResponses()
+	return c
 }
 
 // SendRequest sends a synchronous request to Tor and awaits the response. If
-// the response errors, the error result will be set, but the response will be
-// set also. This is usually not directly used by callers, but instead called by
-// higher-level methods.
+// the response errors, the error result will be an *Error, but the response
+// will be set also. This is usually not directly used by callers, but instead
+// called by higher-level methods. It is safe to call concurrently, replies are
+// matched to requests in the order the requests were written.
+//
+// The format and args are formatted with fmt.Sprintf and sent as-is, so values
+// that may contain CR, LF, or other unsafe characters must not be given. Use
+// SendCommand for those.
 func (c *Conn) SendRequest(format string, args ...interface{}) (*Response, error) {
-	if c.debugEnabled() {
-		c.debugf("Write line: %v", fmt.Sprintf(format, args...))
-	}
-	id, err := c.conn.Cmd(format, args...)
+	return c.SendRequestContext(context.Background(), format, args...)
+}
+
+// SendRequestContext is SendRequest with a context. If the context completes
+// before the request is written, it is never sent. If it completes after the
+// request is written, the context error is returned and the reply, whenever it
+// arrives, is read and discarded so the connection stays usable for the next
+// request.
+func (c *Conn) SendRequestContext(ctx context.Context, format string, args ...interface{}) (*Response, error) {
+	return c.sendRequest(ctx, fmt.Sprintf(format, args...))
+}
+
+func (c *Conn) sendRequest(ctx context.Context, request string) (*Response, error) {
+	replyCh, err := c.writeRequest(ctx, request)
 	if err != nil {
 		return nil, err
 	}
-	c.readLock.Lock()
-	defer c.readLock.Unlock()
-	c.conn.StartResponse(id)
-	defer c.conn.EndResponse(id)
-	// Get the first non-async response
-	var resp *Response
+	select {
+	case reply := <-replyCh:
+		return reply.result(request)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// result returns the reply's response, and an *Error if it is not OK.
+func (p *pendingReply) result(request string) (*Response, error) {
+	if p.err == nil && !p.resp.IsOk() {
+		return p.resp, newError(request, p.resp)
+	}
+	return p.resp, p.err
+}
+
+// writeRequest writes the request and returns the channel its reply will be
+// sent on. The channel is buffered so the reader never blocks on it even if
+// nobody is receiving.
+func (c *Conn) writeRequest(ctx context.Context, request string) (<-chan *pendingReply, error) {
+	select {
+	case c.writeLock <- struct{}{}:
+		defer func() { <-c.writeLock }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// Check once more now that we have the lock, in case both were ready
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Queue the reply before writing, the reply may come back before the write
+	// call returns
+	replyCh := make(chan *pendingReply, 1)
+	c.readStateLock.Lock()
+	if c.readErr != nil {
+		c.readStateLock.Unlock()
+		return nil, c.readErr
+	}
+	c.pendingReplies = append(c.pendingReplies, replyCh)
+	c.readStateLock.Unlock()
+	c.debugf("Write line: %v", request)
+	if err := c.conn.PrintfLine("%s", request); err != nil {
+		c.removePendingReply(replyCh)
+		return nil, err
+	}
+	return replyCh, nil
+}
+
+func (c *Conn) removePendingReply(replyCh chan<- *pendingReply) {
+	c.readStateLock.Lock()
+	defer c.readStateLock.Unlock()
+	for i, pending := range c.pendingReplies {
+		if pending == replyCh {
+			c.pendingReplies = append(c.pendingReplies[:i:i], c.pendingReplies[i+1:]...)
+			return
+		}
+	}
+}
+
+// readResponses is the reader loop started by NewConn. It relays async events
+// and hands every other response to the oldest pending request.
+func (c *Conn) readResponses() {
+	var err error
 	for {
-		if resp, err = c.ReadResponse(); err != nil || !resp.IsAsync() {
+		var resp *Response
+		if resp, err = c.ReadResponse(); err != nil {
 			break
 		}
-		c.relayAsyncEvents(resp)
+		if resp.IsAsync() {
+			c.relayAsyncEvents(resp)
+		} else {
+			c.readStateLock.Lock()
+			var replyCh chan<- *pendingReply
+			if len(c.pendingReplies) > 0 {
+				replyCh = c.pendingReplies[0]
+				c.pendingReplies = c.pendingReplies[1:]
+			}
+			c.readStateLock.Unlock()
+			if replyCh == nil {
+				c.debugf("Discarding response with no pending request: %v", resp.Reply)
+			} else {
+				replyCh <- &pendingReply{resp: resp}
+			}
+		}
+		c.readStateLock.Lock()
+		close(c.responseReadCh)
+		c.responseReadCh = make(chan struct{})
+		c.readStateLock.Unlock()
 	}
-	if err == nil && !resp.IsOk() {
-		err = resp.Err
+	// Fail everything still waiting and anything sent from here on
+	c.debugf("Reader stopped: %v", err)
+	c.readStateLock.Lock()
+	c.readErr = err
+	pending := c.pendingReplies
+	c.pendingReplies = nil
+	close(c.readDone)
+	c.readStateLock.Unlock()
+	for _, replyCh := range pending {
+		replyCh <- &pendingReply{err: err}
 	}
-	return resp, err
 }
 
 // Close sends a QUIT and closes the underlying Tor connection. This does not
 // error if the QUIT is not accepted but does relay any error that occurs while
-// closing the underlying connection.
+// closing the underlying connection. The background reader stops once the
+// connection is closed.
 func (c *Conn) Close() error {
 	// Ignore the response and ignore the error
 	c.Quit()
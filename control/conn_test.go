@@ -0,0 +1,371 @@
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control/controltest"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConn(t *testing.T, server *controltest.Server) *Conn {
+	conn := NewConn(textproto.NewConn(server.Pipe()))
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+	})
+	require.NoError(t, conn.Authenticate(""))
+	return conn
+}
+
+// newPipeTestConn returns a connection and the other end of its pipe for tests
+// that need to control exactly when lines are read and written.
+func newPipeTestConn(t *testing.T) (*Conn, *textproto.Conn) {
+	client, peer := net.Pipe()
+	conn := NewConn(textproto.NewConn(client))
+	t.Cleanup(func() {
+		peer.Close()
+		conn.Close()
+	})
+	return conn, textproto.NewConn(peer)
+}
+
+func TestConnPipelinedRequests(t *testing.T) {
+	conn, peer := newPipeTestConn(t)
+	ch := make(chan Event, 1)
+	listenerErr := make(chan error, 1)
+	go func() { listenerErr <- conn.AddEventListener(ch, EventCodeCircuit) }()
+	line, err := peer.ReadLine()
+	require.NoError(t, err)
+	require.Equal(t, "SETEVENTS CIRC", line)
+	require.NoError(t, peer.PrintfLine("250 OK"))
+	require.NoError(t, <-listenerErr)
+	// All requests are written before any reply is read
+	results := map[string]chan string{}
+	for i := 0; i < 3; i++ {
+		key := "key" + strconv.Itoa(i)
+		result := make(chan string, 1)
+		results[key] = result
+		go func() {
+			vals, err := conn.GetInfo(key)
+			require.NoError(t, err)
+			result <- vals[0].Val
+		}()
+	}
+	keys := make([]string, 3)
+	for i := range keys {
+		line, err := peer.ReadLine()
+		require.NoError(t, err)
+		require.Contains(t, line, "GETINFO key")
+		keys[i] = line[len("GETINFO "):]
+	}
+	// Replies are matched in order and events between them are dispatched
+	for i, key := range keys {
+		require.NoError(t, peer.PrintfLine("250-%v=val-%v", key, key))
+		require.NoError(t, peer.PrintfLine("250 OK"))
+		if i == 0 {
+			require.NoError(t, peer.PrintfLine("650 CIRC 5 BUILT"))
+		}
+	}
+	for key, result := range results {
+		require.Equal(t, "val-"+key, <-result)
+	}
+	require.Equal(t, "5", (<-ch).(*CircuitEvent).CircuitID)
+}
+
+func TestConnReaderStopFailsInFlightRequests(t *testing.T) {
+	conn, peer := newPipeTestConn(t)
+	result := make(chan error, 1)
+	go func() {
+		_, err := conn.GetInfo("version")
+		result <- err
+	}()
+	_, err := peer.ReadLine()
+	require.NoError(t, err)
+	// Closing before the reply fails the waiting request and later ones
+	require.NoError(t, peer.Close())
+	require.Error(t, <-result)
+	_, err = conn.GetInfo("version")
+	require.Error(t, err)
+	require.Error(t, conn.HandleEvents(context.Background()))
+}
+
+func TestConnConcurrentRequests(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i)
+			server.SetInfo(key, "val"+strconv.Itoa(i))
+			vals, err := conn.GetInfo(key)
+			require.NoError(t, err)
+			require.Equal(t, []*KeyVal{NewKeyVal(key, "val"+strconv.Itoa(i))}, vals)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConnContextDiscardsLateReply(t *testing.T) {
+	server := controltest.NewServer()
+	release := make(chan struct{})
+	server.Handle("SLOW", func(*controltest.Request) []string {
+		<-release
+		return []string{"250 slow"}
+	})
+	conn := newTestConn(t, server)
+	// Time out waiting on the reply
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := conn.SendRequestContext(ctx, "SLOW")
+	require.Equal(t, context.DeadlineExceeded, err)
+	// Let it reply, and confirm the next request gets its own reply
+	close(release)
+	server.SetInfo("foo", "bar")
+	vals, err := conn.GetInfo("foo")
+	require.NoError(t, err)
+	require.Equal(t, []*KeyVal{NewKeyVal("foo", "bar")}, vals)
+	// Done contexts don't even send
+	_, err = conn.GetInfoContext(ctx, "foo")
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestConnContextCancelInFlight(t *testing.T) {
+	conn, peer := newPipeTestConn(t)
+	// Three requests in flight in a known order, the middle one canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make([]chan string, 3)
+	errs := make([]chan error, 3)
+	for i := range results {
+		results[i], errs[i] = make(chan string, 1), make(chan error, 1)
+		reqCtx := context.Background()
+		if i == 1 {
+			reqCtx = ctx
+		}
+		go func(i int) {
+			vals, err := conn.GetInfoContext(reqCtx, "key"+strconv.Itoa(i))
+			if err != nil {
+				errs[i] <- err
+			} else {
+				results[i] <- vals[0].Val
+			}
+		}(i)
+		line, err := peer.ReadLine()
+		require.NoError(t, err)
+		require.Equal(t, "GETINFO key"+strconv.Itoa(i), line)
+	}
+	cancel()
+	require.Equal(t, context.Canceled, <-errs[1])
+	// The late reply for the canceled request is discarded
+	for i := range results {
+		require.NoError(t, peer.PrintfLine("250-key%v=val%v", i, i))
+		require.NoError(t, peer.PrintfLine("250 OK"))
+	}
+	require.Equal(t, "val0", <-results[0])
+	require.Equal(t, "val2", <-results[2])
+}
+
+func TestConnAuthenticateSafeCookie(t *testing.T) {
+	cookieFile := filepath.Join(t.TempDir(), "cookie")
+	cookie := make([]byte, 32)
+	_, err := rand.Read(cookie)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(cookieFile, cookie, 0600))
+	server := controltest.NewServer()
+	server.AuthMethods = []string{"COOKIE", "SAFECOOKIE"}
+	server.CookieFile = cookieFile
+	conn := NewConn(textproto.NewConn(server.Pipe()))
+	defer conn.Close()
+	defer server.Close()
+	// Unauthenticated requests fail
+	_, err = conn.GetInfo("version")
+	require.Error(t, err)
+	require.NoError(t, conn.Authenticate(""))
+	require.True(t, conn.IsAuthenticated())
+	vals, err := conn.GetInfo("version")
+	require.NoError(t, err)
+	require.Equal(t, server.TorVersion, vals[0].Val)
+}
+
+func TestConnConcurrentAuthenticate(t *testing.T) {
+	server := controltest.NewServer()
+	conn := NewConnWithDebugWriter(textproto.NewConn(server.Pipe()), ioutil.Discard)
+	defer conn.Close()
+	defer server.Close()
+	// Only one PROTOCOLINFO and AUTHENTICATE should be sent
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, conn.Authenticate(""))
+		}()
+	}
+	wg.Wait()
+	require.True(t, conn.IsAuthenticated())
+	keywords := []string{}
+	for _, req := range server.Requests() {
+		keywords = append(keywords, req.Keyword)
+	}
+	require.Equal(t, []string{"PROTOCOLINFO", "AUTHENTICATE"}, keywords)
+}
+
+func TestConnProtocolInfoContextDone(t *testing.T) {
+	server := controltest.NewServer()
+	conn := NewConn(textproto.NewConn(server.Pipe()))
+	defer conn.Close()
+	defer server.Close()
+	seen, release := make(chan struct{}), make(chan struct{})
+	server.Handle("PROTOCOLINFO", func(*controltest.Request) []string {
+		close(seen)
+		<-release
+		return controltest.Reply("PROTOCOLINFO 1", "AUTH METHODS=NULL", `VERSION Tor="1.2.3"`)
+	})
+	// Cancel once PROTOCOLINFO is written
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-seen
+		cancel()
+	}()
+	_, err := conn.ProtocolInfoContext(ctx)
+	require.Equal(t, context.Canceled, err)
+	// The next call gets the same reply without sending again
+	close(release)
+	info, err := conn.ProtocolInfo()
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3", info.TorVersion)
+	require.NoError(t, conn.Authenticate(""))
+	require.Len(t, server.Requests(), 2)
+}
+
+func TestConnReaderStopFailsRequests(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	server.Close()
+	_, err := conn.GetInfo("version")
+	require.Error(t, err)
+	require.Error(t, conn.HandleEvents(context.Background()))
+}
+
+func TestEventDeliveryPolicies(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	ctx := context.Background()
+	newestCh := make(chan Event, 2)
+	newest, err := conn.AddEventListenerWithConf(ctx, newestCh,
+		&EventListenerConf{Policy: EventDeliveryDropNewest}, EventCodeCircuit)
+	require.NoError(t, err)
+	disconnectCh := make(chan Event)
+	disconnected := make(chan struct{})
+	disconnect, err := conn.AddEventListenerWithConf(ctx, disconnectCh, &EventListenerConf{
+		Policy:       EventDeliveryDisconnect,
+		OnDisconnect: func() { close(disconnected) },
+	}, EventCodeCircuit)
+	require.NoError(t, err)
+	closedCh := make(chan Event)
+	closed, err := conn.AddEventListenerWithConf(ctx, closedCh, nil, EventCodeCircuit)
+	require.NoError(t, err)
+	close(closedCh)
+	// A blocking listener that is fully drained to know when all were read
+	blockingCh := make(chan Event, 10)
+	require.NoError(t, conn.AddEventListener(blockingCh, EventCodeCircuit))
+	for i := 0; i < 5; i++ {
+		server.Emit("CIRC", strconv.Itoa(i)+" BUILT")
+	}
+	for i := 0; i < 5; i++ {
+		require.Equal(t, strconv.Itoa(i), (<-blockingCh).(*CircuitEvent).CircuitID)
+	}
+	<-disconnected
+	require.Equal(t, uint64(2), newest.Delivered())
+	require.Equal(t, uint64(3), newest.Dropped())
+	require.True(t, disconnect.Disconnected())
+	require.Equal(t, uint64(1), disconnect.Dropped())
+	require.True(t, closed.Disconnected())
+	require.Equal(t, "0", (<-newestCh).(*CircuitEvent).CircuitID)
+	require.Equal(t, "1", (<-newestCh).(*CircuitEvent).CircuitID)
+}
+
+func TestEventDeliveryDropOldest(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	// Buffer of 3 and an unbuffered channel nobody reads yet
+	ch := make(chan Event)
+	stats, err := conn.AddEventListenerWithConf(context.Background(), ch,
+		&EventListenerConf{Policy: EventDeliveryDropOldest, BufferSize: 3}, EventCodeCircuit)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		server.Emit("CIRC", strconv.Itoa(i)+" BUILT")
+	}
+	// Wait for everything to be queued, the forwarder may hold one
+	require.Eventually(t, func() bool { return stats.Dropped() >= 6 }, time.Second, 10*time.Millisecond)
+	last := ""
+	for last != "9" {
+		last = (<-ch).(*CircuitEvent).CircuitID
+	}
+	require.Equal(t, uint64(10), stats.Delivered()+stats.Dropped())
+	require.NoError(t, conn.RemoveEventListener(ch, EventCodeCircuit))
+	close(ch)
+}
+
+func TestEventListenerRemoveWhileDelivering(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	// The reader delivers to a snapshot of all three in order. Each event on
+	// the first means the snapshot for it is taken and the reader then blocks
+	// on the second with the third still to go.
+	signalCh := make(chan Event, 10)
+	require.NoError(t, conn.AddEventListener(signalCh, EventCodeCircuit))
+	blockCh := make(chan Event)
+	require.NoError(t, conn.AddEventListener(blockCh, EventCodeCircuit))
+	ch := make(chan Event, 10)
+	stats, err := conn.AddEventListenerWithConf(context.Background(), ch, nil, EventCodeCircuit)
+	require.NoError(t, err)
+	// The pipe is unbuffered, so emit in the background while the reader blocks
+	emitted := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			server.Emit("CIRC", strconv.Itoa(i)+" BUILT")
+		}
+		close(emitted)
+	}()
+	<-signalCh
+	<-blockCh
+	require.Equal(t, "0", (<-ch).(*CircuitEvent).CircuitID)
+	// Once the next event is signaled, remove and close the third. Tor isn't
+	// told since the reader can't read the reply yet.
+	require.Equal(t, "1", (<-signalCh).(*CircuitEvent).CircuitID)
+	conn.removeEventListenerFromMap(ch, EventCodeCircuit)
+	close(ch)
+	<-blockCh
+	<-signalCh
+	<-blockCh
+	<-emitted
+	// Nothing was sent to the closed channel
+	require.False(t, stats.Disconnected())
+	require.Equal(t, uint64(0), stats.Dropped())
+	require.Equal(t, uint64(1), stats.Delivered())
+}
+
+func lastRequest(server *controltest.Server, keyword string) string {
+	reqs := server.Requests()
+	for i := len(reqs) - 1; i >= 0; i-- {
+		if reqs[i].Keyword == keyword {
+			if reqs[i].Args == "" {
+				return reqs[i].Keyword
+			}
+			return reqs[i].Keyword + " " + reqs[i].Args
+		}
+	}
+	return ""
+}
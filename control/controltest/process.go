@@ -0,0 +1,185 @@
+package controltest
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/bine/process"
+)
+
+// Creator returns a process.Creator whose processes serve this server instead
+// of running Tor. It can be set as tor.StartConf.ProcessCreator. The process
+// applies the command line arguments it is given to the server's configuration
+// and honors DataDirectory, CookieAuthentication, ControlPort (including
+// "auto" with ControlPortWriteToFile and "unix:" paths), ControlSocket, and
+// SocksPort "auto".
+// The process exits when its context is done or when the server is closed
+// (e.g. via SIGNAL HALT). Only one process should be started per server.
+func (s *Server) Creator() process.Creator {
+	return creator{s}
+}
+
+type creator struct{ server *Server }
+
+func (c creator) New(ctx context.Context, args ...string) (process.Process, error) {
+	return &fakeProcess{server: c.server, ctx: ctx, args: args}, nil
+}
+
+type fakeProcess struct {
+	server *Server
+	ctx    context.Context
+	args   []string
+	doneCh chan struct{}
+	// Only set on context completion before doneCh is closed
+	waitErr error
+}
+
+// Args that are flags and therefore don't have a value after them
+var flagArgs = map[string]bool{
+	"hush":                    true,
+	"quiet":                   true,
+	"verify-config":           true,
+	"list-torrc-options":      true,
+	"list-deprecated-options": true,
+	"version":                 true,
+}
+
+func (p *fakeProcess) Start() error {
+	if p.doneCh != nil {
+		return fmt.Errorf("Already started")
+	}
+	// Apply the args as config
+	for i := 0; i < len(p.args); i++ {
+		arg := p.args[i]
+		if arg == "-f" {
+			i++
+			continue
+		} else if !strings.HasPrefix(arg, "--") {
+			return fmt.Errorf("Unrecognized arg: %v", arg)
+		} else if flagArgs[arg[2:]] {
+			continue
+		} else if i+1 >= len(p.args) {
+			return fmt.Errorf("Missing value for %v", arg)
+		}
+		p.server.SetConf(arg[2:], p.args[i+1])
+		i++
+	}
+	if val, _ := p.server.Conf("CookieAuthentication"); val == "1" {
+		if err := p.writeCookie(); err != nil {
+			return err
+		}
+	}
+	if err := p.listenControl(); err != nil {
+		p.server.Close()
+		return err
+	}
+	if err := p.listenSocks(); err != nil {
+		p.server.Close()
+		return err
+	}
+	p.doneCh = make(chan struct{})
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			p.waitErr = p.ctx.Err()
+			p.server.Close()
+		case <-p.server.Done():
+		}
+		close(p.doneCh)
+	}()
+	return nil
+}
+
+func (p *fakeProcess) writeCookie() error {
+	dataDir, _ := p.server.Conf("DataDirectory")
+	if dataDir == "" {
+		return fmt.Errorf("Cookie auth requires DataDirectory")
+	}
+	cookie := make([]byte, 32)
+	if _, err := rand.Read(cookie); err != nil {
+		return err
+	}
+	cookieFile := filepath.Join(dataDir, "control_auth_cookie")
+	if err := ioutil.WriteFile(cookieFile, cookie, 0600); err != nil {
+		return err
+	}
+	p.server.CookieFile = cookieFile
+	p.server.AuthMethods = []string{"COOKIE", "SAFECOOKIE"}
+	return nil
+}
+
+func (p *fakeProcess) listenControl() error {
+	if controlSocket, _ := p.server.Conf("ControlSocket"); controlSocket != "" && controlSocket != "0" {
+		if _, err := p.server.ListenOn("unix", strings.TrimPrefix(controlSocket, "unix:")); err != nil {
+			return err
+		}
+	}
+	controlPort, ok := p.server.Conf("ControlPort")
+	if !ok {
+		return nil
+	}
+	var l net.Listener
+	var err error
+	switch {
+	case strings.EqualFold(controlPort, "auto"):
+		l, err = p.server.Listen()
+	case strings.HasPrefix(controlPort, "unix:"):
+		l, err = p.server.ListenOn("unix", strings.Trim(controlPort[5:], "\""))
+	default:
+		l, err = p.server.ListenOn("tcp", "127.0.0.1:"+controlPort)
+	}
+	if err != nil {
+		return err
+	}
+	if portFile, _ := p.server.Conf("ControlPortWriteToFile"); portFile != "" {
+		contents := "PORT=" + l.Addr().String() + "\n"
+		if l.Addr().Network() == "unix" {
+			contents = "UNIX_PORT=" + l.Addr().String() + "\n"
+		}
+		return ioutil.WriteFile(portFile, []byte(contents), 0600)
+	}
+	return nil
+}
+
+func (p *fakeProcess) listenSocks() error {
+	if socksPort, _ := p.server.Conf("SocksPort"); !strings.EqualFold(socksPort, "auto") {
+		return nil
+	}
+	// A real listener so the address is valid, but it just hangs up
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-p.server.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	p.server.SetConf("SocksPort", l.Addr().String())
+	return nil
+}
+
+func (p *fakeProcess) Wait() error {
+	if p.doneCh == nil {
+		return fmt.Errorf("Not started")
+	}
+	<-p.doneCh
+	return p.waitErr
+}
+
+func (p *fakeProcess) EmbeddedControlConn() (net.Conn, error) {
+	return p.server.Pipe(), nil
+}
@@ -0,0 +1,820 @@
+// Package controltest implements a scriptable, in-process fake of the Tor
+// control port for testing without a Tor executable.
+//
+// A Server speaks enough of the control protocol for the control and tor
+// packages to work against it: PROTOCOLINFO, AUTHCHALLENGE, AUTHENTICATE (NULL,
+// SAFECOOKIE, and HASHEDPASSWORD), GETINFO, GETCONF, SETCONF, RESETCONF,
+// ADD_ONION, DEL_ONION, SETEVENTS, SIGNAL, and QUIT. Any command can be
+// overridden or added with Handle, and asynchronous events can be emitted at
+// any time with Emit. The Creator method returns a process.Creator so
+// tor.Start can be used with the server as if it were Tor.
+package controltest
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// Request is a command received by the Server.
+type Request struct {
+	// Keyword is the upper-cased command keyword (e.g. "GETINFO").
+	Keyword string
+
+	// Args is the remainder of the first line after the keyword and space.
+	Args string
+
+	// Body is the dot-decoded body for multi-line ("+" prefixed) commands
+	// without the final CRLF. It is empty otherwise.
+	Body string
+
+	// Conn is the connection the request came in on.
+	Conn *ServerConn
+}
+
+// Handler handles a request and returns the reply lines without CRLFs (e.g.
+// []string{"250 OK"}). Use Reply and ErrorReply to build common replies.
+type Handler func(req *Request) []string
+
+// Reply returns the lines for a 250 reply whose mid lines are the given lines
+// and whose end line is "250 OK". Lines with newlines are expected to be
+// "key=value" and are sent as a dot-encoded value.
+func Reply(lines ...string) []string {
+	ret := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		if strings.Contains(line, "\n") {
+			key, val, _ := torutil.PartitionString(line, '=')
+			valLines := strings.Split(strings.Replace(val, "\r\n", "\n", -1), "\n")
+			for i, valLine := range valLines {
+				if strings.HasPrefix(valLine, ".") {
+					valLines[i] = "." + valLine
+				}
+			}
+			ret = append(ret, "250+"+key+"=\n"+strings.Join(valLines, "\n")+"\n.")
+		} else {
+			ret = append(ret, "250-"+line)
+		}
+	}
+	return append(ret, "250 OK")
+}
+
+// ErrorReply returns the single line for an error reply.
+func ErrorReply(code int, msg string) []string {
+	return []string{fmt.Sprintf("%03d %v", code, msg)}
+}
+
+// Server is a fake Tor control port. Fields should be set before the server
+// is used and not changed after. Use NewServer to create one.
+type Server struct {
+	// TorVersion is the version reported by PROTOCOLINFO and GETINFO version.
+	TorVersion string
+
+	// AuthMethods are the methods reported by PROTOCOLINFO. If it contains
+	// "SAFECOOKIE", CookieFile must be set and contain a 32-byte cookie. If it
+	// contains "HASHEDPASSWORD", Password is what must be sent.
+	AuthMethods []string
+
+	// CookieFile is the path reported by PROTOCOLINFO and read for SAFECOOKIE.
+	CookieFile string
+
+	// Password is the password expected for HASHEDPASSWORD.
+	Password string
+
+	// SimulateNetwork, if true, emits bootstrap completion when DisableNetwork
+	// is set to 0 and emits HS_DESC UPLOAD/UPLOADED events for onion services
+	// once the network is enabled. NewServer sets this to true.
+	SimulateNetwork bool
+
+	lock     sync.Mutex
+	info     map[string]string
+	conf     map[string]string
+	handlers map[string]Handler
+	onions   map[string]bool
+	conns    map[*ServerConn]struct{}
+	requests []*Request
+	lns      []net.Listener
+	closed   bool
+	closedCh chan struct{}
+}
+
+// NewServer creates a Server that accepts NULL authentication.
+func NewServer() *Server {
+	return &Server{
+		TorVersion:      "0.4.7.13",
+		AuthMethods:     []string{"NULL"},
+		SimulateNetwork: true,
+		info:            map[string]string{},
+		conf:            map[string]string{},
+		handlers:        map[string]Handler{},
+		onions:          map[string]bool{},
+		conns:           map[*ServerConn]struct{}{},
+		closedCh:        make(chan struct{}),
+	}
+}
+
+// Handle sets the handler for the given command keyword, replacing any built-in
+// behavior. Handlers are not subject to authentication checks.
+func (s *Server) Handle(keyword string, h Handler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlers[strings.ToUpper(keyword)] = h
+}
+
+// SetInfo sets a GETINFO value. This takes precedence over built-in keys.
+func (s *Server) SetInfo(key, val string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.info[key] = val
+}
+
+// SetConf sets a configuration value as if SETCONF was called.
+func (s *Server) SetConf(key, val string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.conf[s.confKey(key)] = val
+}
+
+// Conf returns the configuration value and whether it is set.
+func (s *Server) Conf(key string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	val, ok := s.conf[s.confKey(key)]
+	return val, ok
+}
+
+// Onions returns the service IDs of the onion services currently added.
+func (s *Server) Onions() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make([]string, 0, len(s.onions))
+	for id := range s.onions {
+		ret = append(ret, id)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Requests returns all requests received so far, in order.
+func (s *Server) Requests() []*Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := make([]*Request, len(s.requests))
+	copy(ret, s.requests)
+	return ret
+}
+
+// Listen creates a TCP listener on a random loopback port and serves it in the
+// background until the server is closed.
+func (s *Server) Listen() (net.Listener, error) {
+	return s.ListenOn("tcp", "127.0.0.1:0")
+}
+
+// ListenOn is Listen for the given network and address.
+func (s *Server) ListenOn(network, address string) (net.Listener, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return nil, fmt.Errorf("Server closed")
+	}
+	s.lns = append(s.lns, l)
+	s.lock.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.ServeConn(conn)
+		}
+	}()
+	return l, nil
+}
+
+// Pipe returns the client side of an in-memory connection whose other side is
+// served in the background.
+func (s *Server) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	return client
+}
+
+// Emit sends a single-line asynchronous event (i.e. "650 <code> <data>") to
+// every connection that has enabled the event code via SETEVENTS.
+func (s *Server) Emit(code, data string) {
+	line := "650 " + code
+	if data != "" {
+		line += " " + data
+	}
+	s.EmitRaw(code, line)
+}
+
+// EmitRaw sends the given raw lines, without CRLFs, to every connection that
+// has enabled the event code via SETEVENTS.
+func (s *Server) EmitRaw(code string, lines ...string) {
+	s.lock.Lock()
+	conns := make([]*ServerConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+	for _, conn := range conns {
+		if conn.HasEvent(code) {
+			conn.WriteLines(lines...)
+		}
+	}
+}
+
+// Done returns a channel that is closed when the server is closed, including
+// by SIGNAL HALT or SHUTDOWN.
+func (s *Server) Done() <-chan struct{} { return s.closedCh }
+
+// Close closes all listeners and connections.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.closedCh)
+	lns, conns := s.lns, s.conns
+	s.lns, s.conns = nil, map[*ServerConn]struct{}{}
+	s.lock.Unlock()
+	for _, l := range lns {
+		l.Close()
+	}
+	for conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// ServerConn is a single connection to the Server.
+type ServerConn struct {
+	server        *Server
+	conn          net.Conn
+	writeLock     sync.Mutex
+	lock          sync.Mutex
+	events        map[string]bool
+	authenticated bool
+	clientNonce   []byte
+	serverNonce   []byte
+	addedOnions   []string
+}
+
+// Authenticated returns whether the connection has authenticated.
+func (s *ServerConn) Authenticated() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.authenticated
+}
+
+// HasEvent returns whether the event code has been enabled via SETEVENTS.
+func (s *ServerConn) HasEvent(code string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.events[code]
+}
+
+// WriteLines writes the lines, adding CRLFs. Errors are ignored.
+func (s *ServerConn) WriteLines(lines ...string) {
+	var buf strings.Builder
+	for _, line := range lines {
+		buf.WriteString(strings.Replace(line, "\n", "\r\n", -1))
+		buf.WriteString("\r\n")
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	io.WriteString(s.conn, buf.String())
+}
+
+// Close closes the connection.
+func (s *ServerConn) Close() error { return s.conn.Close() }
+
+// ServeConn serves the control protocol on the given connection until it is
+// closed or QUIT is received.
+func (s *Server) ServeConn(conn net.Conn) {
+	c := &ServerConn{server: s, conn: conn, events: map[string]bool{}}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		req, err := s.readRequest(r, c)
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.requests = append(s.requests, req)
+		h := s.handlers[req.Keyword]
+		s.lock.Unlock()
+		if h == nil {
+			h = s.builtInHandler(req)
+		}
+		c.WriteLines(h(req)...)
+		switch req.Keyword {
+		case "QUIT":
+			return
+		case "AUTHENTICATE":
+			// Tor hangs up on failed auth
+			if !c.Authenticated() {
+				return
+			}
+		}
+		s.afterRequest(req)
+	}
+}
+
+func (s *Server) readRequest(r *bufio.Reader, c *ServerConn) (*Request, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	req := &Request{Conn: c}
+	multiLine := strings.HasPrefix(line, "+")
+	if multiLine {
+		line = line[1:]
+	}
+	req.Keyword, req.Args, _ = torutil.PartitionString(line, ' ')
+	req.Keyword = strings.ToUpper(req.Keyword)
+	if multiLine {
+		var body []string
+		for {
+			if line, err = r.ReadString('\n'); err != nil {
+				return nil, err
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if line == "." {
+				break
+			}
+			body = append(body, strings.TrimPrefix(line, "."))
+		}
+		req.Body = strings.Join(body, "\n")
+	}
+	return req, nil
+}
+
+func (s *Server) builtInHandler(req *Request) Handler {
+	switch req.Keyword {
+	case "PROTOCOLINFO", "AUTHCHALLENGE", "AUTHENTICATE", "QUIT":
+	default:
+		if !req.Conn.Authenticated() {
+			return func(*Request) []string { return ErrorReply(514, "Authentication required.") }
+		}
+	}
+	switch req.Keyword {
+	case "PROTOCOLINFO":
+		return s.handleProtocolInfo
+	case "AUTHCHALLENGE":
+		return s.handleAuthChallenge
+	case "AUTHENTICATE":
+		return s.handleAuthenticate
+	case "QUIT":
+		return func(*Request) []string { return []string{"250 closing connection"} }
+	case "GETINFO":
+		return s.handleGetInfo
+	case "GETCONF":
+		return s.handleGetConf
+	case "SETCONF", "RESETCONF":
+		return s.handleSetConf
+	case "ADD_ONION":
+		return s.handleAddOnion
+	case "DEL_ONION":
+		return s.handleDelOnion
+	case "SETEVENTS":
+		return s.handleSetEvents
+	case "SIGNAL":
+		return s.handleSignal
+	default:
+		return func(req *Request) []string {
+			return ErrorReply(510, fmt.Sprintf("Unrecognized command \"%v\"", req.Keyword))
+		}
+	}
+}
+
+// afterRequest simulates what Tor does asynchronously after some requests.
+func (s *Server) afterRequest(req *Request) {
+	switch req.Keyword {
+	case "SIGNAL":
+		switch strings.ToUpper(req.Args) {
+		case "HALT", "SHUTDOWN":
+			s.Close()
+		}
+	case "SETCONF":
+		if s.SimulateNetwork && s.networkEnabled() && strings.Contains(strings.ToLower(req.Args), "disablenetwork") {
+			s.Emit("STATUS_CLIENT", bootstrapDoneStatus)
+			s.publishOnions(s.Onions()...)
+		}
+	case "ADD_ONION":
+		if s.SimulateNetwork && s.networkEnabled() {
+			s.publishOnions(req.Conn.takeAddedOnions()...)
+		}
+	case "SETEVENTS":
+		// Replay what was missed, as if Tor had just finished these
+		if s.SimulateNetwork && s.networkEnabled() {
+			if req.Conn.HasEvent("STATUS_CLIENT") {
+				req.Conn.WriteLines("650 STATUS_CLIENT " + bootstrapDoneStatus)
+			}
+			if req.Conn.HasEvent("HS_DESC") {
+				for _, id := range s.Onions() {
+					req.Conn.WriteLines(hsDescUploadLines(id)...)
+				}
+			}
+		}
+	}
+}
+
+const bootstrapDoneStatus = "NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY=\"Done\""
+
+func (s *Server) networkEnabled() bool {
+	val, _ := s.Conf("DisableNetwork")
+	return val != "1"
+}
+
+func (s *Server) publishOnions(ids ...string) {
+	for _, id := range ids {
+		s.EmitRaw("HS_DESC", hsDescUploadLines(id)...)
+	}
+}
+
+func hsDescUploadLines(id string) []string {
+	hsDir := "$" + strings.Repeat("A", 40)
+	return []string{
+		"650 HS_DESC UPLOAD " + id + " UNKNOWN " + hsDir + " " + id,
+		"650 HS_DESC UPLOADED " + id + " UNKNOWN " + hsDir,
+	}
+}
+
+func (s *Server) handleProtocolInfo(*Request) []string {
+	auth := "AUTH METHODS=" + strings.Join(s.AuthMethods, ",")
+	if s.CookieFile != "" {
+		auth += " COOKIEFILE=" + torutil.EscapeSimpleQuotedString(s.CookieFile)
+	}
+	return Reply("PROTOCOLINFO 1", auth, "VERSION Tor="+torutil.EscapeSimpleQuotedString(s.TorVersion))
+}
+
+func (s *Server) hasAuthMethod(method string) bool {
+	for _, m := range s.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) readCookie() ([]byte, error) {
+	byts, err := ioutil.ReadFile(s.CookieFile)
+	if err == nil && len(byts) != 32 {
+		err = fmt.Errorf("Invalid cookie length")
+	}
+	return byts, err
+}
+
+func (s *Server) handleAuthChallenge(req *Request) []string {
+	typ, nonceHex, _ := torutil.PartitionString(req.Args, ' ')
+	if typ != "SAFECOOKIE" || !s.hasAuthMethod("SAFECOOKIE") {
+		return ErrorReply(513, "AUTHCHALLENGE only supports SAFECOOKIE authentication")
+	}
+	clientNonce, err := hex.DecodeString(nonceHex)
+	if err != nil || len(clientNonce) != 32 {
+		return ErrorReply(513, "Invalid base16 client nonce")
+	}
+	cookie, err := s.readCookie()
+	if err != nil {
+		return ErrorReply(515, "Unable to read cookie")
+	}
+	serverNonce := make([]byte, 32)
+	if _, err = rand.Read(serverNonce); err != nil {
+		return ErrorReply(551, "Unable to generate nonce")
+	}
+	req.Conn.lock.Lock()
+	req.Conn.clientNonce, req.Conn.serverNonce = clientNonce, serverNonce
+	req.Conn.lock.Unlock()
+	serverHash := safeCookieHash("Tor safe cookie authentication server-to-controller hash",
+		cookie, clientNonce, serverNonce)
+	return []string{fmt.Sprintf("250 AUTHCHALLENGE SERVERHASH=%X SERVERNONCE=%X", serverHash, serverNonce)}
+}
+
+func safeCookieHash(key string, cookie, clientNonce, serverNonce []byte) []byte {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write(cookie)
+	m.Write(clientNonce)
+	m.Write(serverNonce)
+	return m.Sum(nil)
+}
+
+func (s *Server) handleAuthenticate(req *Request) []string {
+	ok := false
+	if s.hasAuthMethod("NULL") {
+		ok = true
+	} else if given, err := decodeAuthArg(req.Args); err == nil {
+		req.Conn.lock.Lock()
+		clientNonce, serverNonce := req.Conn.clientNonce, req.Conn.serverNonce
+		req.Conn.lock.Unlock()
+		if s.hasAuthMethod("SAFECOOKIE") && clientNonce != nil {
+			if cookie, err := s.readCookie(); err == nil {
+				ok = hmac.Equal(given, safeCookieHash("Tor safe cookie authentication controller-to-server hash",
+					cookie, clientNonce, serverNonce))
+			}
+		}
+		if !ok && s.hasAuthMethod("HASHEDPASSWORD") && s.Password != "" {
+			ok = string(given) == s.Password
+		}
+	}
+	if !ok {
+		return ErrorReply(515, "Authentication failed")
+	}
+	req.Conn.lock.Lock()
+	req.Conn.authenticated = true
+	req.Conn.lock.Unlock()
+	return []string{"250 OK"}
+}
+
+func decodeAuthArg(arg string) ([]byte, error) {
+	if strings.HasPrefix(arg, "\"") {
+		str, err := torutil.UnescapeSimpleQuotedString(arg)
+		return []byte(str), err
+	}
+	return hex.DecodeString(arg)
+}
+
+func (s *Server) handleGetInfo(req *Request) []string {
+	var lines []string
+	for _, key := range strings.Fields(req.Args) {
+		val, errReply := s.getInfo(key)
+		if errReply != nil {
+			return errReply
+		}
+		lines = append(lines, key+"="+val)
+	}
+	return Reply(lines...)
+}
+
+// getInfo returns the value for key or, on failure, the error reply.
+func (s *Server) getInfo(key string) (string, []string) {
+	s.lock.Lock()
+	val, ok := s.info[key]
+	s.lock.Unlock()
+	if ok {
+		return val, nil
+	}
+	switch key {
+	case "version":
+		return s.TorVersion, nil
+	case "net/listeners/socks":
+		val, _ := s.Conf("SocksPort")
+		if val == "" || strings.EqualFold(val, "auto") {
+			val = "127.0.0.1:9050"
+		}
+		if !strings.Contains(val, ":") {
+			val = "127.0.0.1:" + val
+		}
+		return torutil.EscapeSimpleQuotedString(val), nil
+	case "onions/current", "onions/detached":
+		// Like Tor, an empty list is an error. Detached onions are not tracked.
+		onions := s.Onions()
+		if key == "onions/detached" || len(onions) == 0 {
+			return "", ErrorReply(551, "No onion services of the specified type.")
+		}
+		return strings.Join(onions, "\n"), nil
+	case "status/bootstrap-phase":
+		if s.networkEnabled() {
+			return bootstrapDoneStatus, nil
+		}
+		return "NOTICE BOOTSTRAP PROGRESS=0 TAG=starting SUMMARY=\"Starting\"", nil
+	case "config-text":
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		keys := make([]string, 0, len(s.conf))
+		for k := range s.conf {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		lines := make([]string, len(keys))
+		for i, k := range keys {
+			lines[i] = k + " " + s.conf[k]
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+	return "", ErrorReply(552, fmt.Sprintf("Unrecognized key \"%v\"", key))
+}
+
+// Must be called with the lock held or for immutable keys. Tor config keys are
+// case insensitive, so this finds an existing key case-insensitively.
+func (s *Server) confKey(key string) string {
+	for k := range s.conf {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+	}
+	return key
+}
+
+func (s *Server) handleGetConf(req *Request) []string {
+	var lines []string
+	for _, key := range strings.Fields(req.Args) {
+		if val, ok := s.Conf(key); ok {
+			lines = append(lines, key+"="+torutil.EscapeSimpleQuotedStringIfNeeded(val))
+		} else {
+			lines = append(lines, key)
+		}
+	}
+	if len(lines) == 0 {
+		return []string{"250 OK"}
+	}
+	ret := make([]string, len(lines))
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		ret[i] = "250" + sep + line
+	}
+	return ret
+}
+
+func (s *Server) handleSetConf(req *Request) []string {
+	args, err := splitArgs(req.Args)
+	if err != nil {
+		return ErrorReply(513, err.Error())
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, arg := range args {
+		key, val, ok := torutil.PartitionString(arg, '=')
+		if ok {
+			if val, err = torutil.UnescapeSimpleQuotedStringIfNeeded(val); err != nil {
+				return ErrorReply(513, err.Error())
+			}
+		}
+		if !ok || (val == "" && req.Keyword == "RESETCONF") {
+			delete(s.conf, s.confKey(key))
+		} else {
+			s.conf[s.confKey(key)] = val
+		}
+	}
+	return []string{"250 OK"}
+}
+
+// splitArgs splits on spaces outside of quoted strings.
+func splitArgs(str string) ([]string, error) {
+	var ret []string
+	var curr strings.Builder
+	inQuote, escaping := false, false
+	for _, ch := range str {
+		switch {
+		case escaping:
+			escaping = false
+		case ch == '\\' && inQuote:
+			escaping = true
+		case ch == '"':
+			inQuote = !inQuote
+		case ch == ' ' && !inQuote:
+			if curr.Len() > 0 {
+				ret = append(ret, curr.String())
+				curr.Reset()
+			}
+			continue
+		}
+		curr.WriteRune(ch)
+	}
+	if inQuote {
+		return nil, fmt.Errorf("Unterminated quoted string")
+	}
+	if curr.Len() > 0 {
+		ret = append(ret, curr.String())
+	}
+	return ret, nil
+}
+
+func (s *Server) handleAddOnion(req *Request) []string {
+	args := strings.Fields(req.Args)
+	if len(args) == 0 {
+		return ErrorReply(512, "Missing argument to ADD_ONION")
+	}
+	typ, blob, _ := torutil.PartitionString(args[0], ':')
+	var key ed25519.KeyPair
+	returnKey := false
+	switch typ {
+	case "NEW":
+		if blob != "BEST" && blob != "ED25519-V3" {
+			return ErrorReply(513, "Invalid key type")
+		}
+		var err error
+		if key, err = ed25519.GenerateKey(nil); err != nil {
+			return ErrorReply(551, "Failed to generate key")
+		}
+		returnKey = true
+	case "ED25519-V3":
+		byts, err := base64.StdEncoding.DecodeString(blob)
+		if err != nil || len(byts) != 64 {
+			return ErrorReply(513, "Failed to decode ED25519-V3 key")
+		}
+		key = ed25519.PrivateKey(byts).KeyPair()
+	default:
+		return ErrorReply(513, "Invalid key type")
+	}
+	hasPort := false
+	for _, arg := range args[1:] {
+		k, v, _ := torutil.PartitionString(arg, '=')
+		switch k {
+		case "Flags":
+			for _, flag := range strings.Split(v, ",") {
+				if flag == "DiscardPK" {
+					returnKey = false
+				}
+			}
+		case "Port":
+			hasPort = true
+		}
+	}
+	if !hasPort {
+		return ErrorReply(512, "Missing 'Port' argument")
+	}
+	id := torutil.OnionServiceIDFromV3PublicKey(key.PublicKey())
+	s.lock.Lock()
+	if s.onions[id] {
+		s.lock.Unlock()
+		return ErrorReply(550, "Onion address collision")
+	}
+	s.onions[id] = true
+	s.lock.Unlock()
+	lines := []string{"ServiceID=" + id}
+	if returnKey {
+		lines = append(lines, "PrivateKey=ED25519-V3:"+base64.StdEncoding.EncodeToString(key.PrivateKey()))
+	}
+	req.Conn.lock.Lock()
+	req.Conn.addedOnions = append(req.Conn.addedOnions, id)
+	req.Conn.lock.Unlock()
+	return Reply(lines...)
+}
+
+// takeAddedOnions returns and clears the onions added on this connection since
+// the last call.
+func (s *ServerConn) takeAddedOnions() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := s.addedOnions
+	s.addedOnions = nil
+	return ret
+}
+
+func (s *Server) handleDelOnion(req *Request) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.onions[req.Args] {
+		return ErrorReply(552, "Unknown Onion Service id")
+	}
+	delete(s.onions, req.Args)
+	return []string{"250 OK"}
+}
+
+func (s *Server) handleSetEvents(req *Request) []string {
+	events := map[string]bool{}
+	for _, code := range strings.Fields(req.Args) {
+		events[code] = true
+	}
+	req.Conn.lock.Lock()
+	defer req.Conn.lock.Unlock()
+	req.Conn.events = events
+	return []string{"250 OK"}
+}
+
+func (s *Server) handleSignal(req *Request) []string {
+	switch strings.ToUpper(req.Args) {
+	case "RELOAD", "HUP", "SHUTDOWN", "DUMP", "USR1", "DEBUG", "USR2", "HALT", "TERM", "INT",
+		"NEWNYM", "CLEARDNSCACHE", "HEARTBEAT", "ACTIVE", "DORMANT":
+		return []string{"250 OK"}
+	}
+	return ErrorReply(552, fmt.Sprintf("Unrecognized signal code \"%v\"", req.Args))
+}
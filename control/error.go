@@ -0,0 +1,115 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error is returned when Tor responds to a command with a failure status code.
+// It can be checked with errors.Is against the Err* categories in this package
+// and it wraps the response's *textproto.Error for compatibility. Errors in the
+// protocol itself, such as a malformed response, are not Errors; they remain
+// textproto.ProtocolError values.
+type Error struct {
+	// Code is the status code, e.g. StatusErrUnrecognizedEntity.
+	Code int
+
+	// Command is the first line of the command that failed with secrets
+	// redacted as RedactCommand does.
+	Command string
+
+	// Reply is the text on the final line of the response.
+	Reply string
+
+	// RawLines are all of the lines of the response, without CRLFs.
+	RawLines []string
+
+	// Response is the full response.
+	Response *Response
+}
+
+func newError(request string, resp *Response) *Error {
+	err := &Error{Code: resp.Err.Code, Command: request, Reply: resp.Reply, RawLines: resp.RawLines, Response: resp}
+	if i := strings.Index(err.Command, "\r\n"); i >= 0 {
+		err.Command = err.Command[:i]
+	}
+	err.Command = RedactCommand(err.Command)
+	return err
+}
+
+// Keyword is the command keyword, e.g. "GETINFO".
+func (e *Error) Keyword() string {
+	keyword := strings.TrimPrefix(e.Command, "+")
+	if i := strings.IndexByte(keyword, ' '); i >= 0 {
+		keyword = keyword[:i]
+	}
+	return keyword
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v failed: %03d %v", e.Keyword(), e.Code, e.Response.Err.Msg)
+}
+
+// Unwrap returns the response's *textproto.Error.
+func (e *Error) Unwrap() error { return e.Response.Err }
+
+// Is returns true if target is one of the Err* categories this error is in.
+func (e *Error) Is(target error) bool {
+	category, ok := target.(*errorCategory)
+	return ok && category.matches(e)
+}
+
+type errorCategory struct {
+	msg   string
+	codes []int
+	// If set, the reply must contain this (case insensitive)
+	replyContains string
+}
+
+func (e *errorCategory) Error() string { return e.msg }
+
+func (e *errorCategory) matches(err *Error) bool {
+	for _, code := range e.codes {
+		if code == err.Code {
+			return e.replyContains == "" ||
+				strings.Contains(strings.ToLower(err.Reply), strings.ToLower(e.replyContains))
+		}
+	}
+	return false
+}
+
+// Categories of Error for use with errors.Is. An Error can be in more than one.
+var (
+	// ErrResourceExhausted is for StatusErrResourceExhausted.
+	ErrResourceExhausted error = &errorCategory{msg: "Resource exhausted", codes: []int{StatusErrResourceExhausted}}
+	// ErrSyntax is for StatusErrSyntaxError and StatusErrSyntaxErrorArg.
+	ErrSyntax error = &errorCategory{msg: "Syntax error",
+		codes: []int{StatusErrSyntaxError, StatusErrSyntaxErrorArg}}
+	// ErrUnrecognizedCommand is for StatusErrUnrecognizedCmd and
+	// StatusErrUnimplementedCmd.
+	ErrUnrecognizedCommand error = &errorCategory{msg: "Unrecognized command",
+		codes: []int{StatusErrUnrecognizedCmd, StatusErrUnimplementedCmd}}
+	// ErrUnrecognizedArgument is for StatusErrUnrecognizedCmdArg.
+	ErrUnrecognizedArgument error = &errorCategory{msg: "Unrecognized command argument",
+		codes: []int{StatusErrUnrecognizedCmdArg}}
+	// ErrAuthenticationRequired is for StatusErrAuthenticationRequired.
+	ErrAuthenticationRequired error = &errorCategory{msg: "Authentication required",
+		codes: []int{StatusErrAuthenticationRequired}}
+	// ErrBadAuthentication is for StatusErrBadAuthentication.
+	ErrBadAuthentication error = &errorCategory{msg: "Bad authentication", codes: []int{StatusErrBadAuthentication}}
+	// ErrTor is for StatusErrUnspecifiedTorError and StatusErrInternalError.
+	ErrTor error = &errorCategory{msg: "Tor error", codes: []int{StatusErrUnspecifiedTorError, StatusErrInternalError}}
+	// ErrUnrecognizedEntity is for StatusErrUnrecognizedEntity.
+	ErrUnrecognizedEntity error = &errorCategory{msg: "Unrecognized entity", codes: []int{StatusErrUnrecognizedEntity}}
+	// ErrInvalidConfigValue is for StatusErrInvalidConfigValue.
+	ErrInvalidConfigValue error = &errorCategory{msg: "Invalid configuration value",
+		codes: []int{StatusErrInvalidConfigValue}}
+	// ErrInvalidDescriptor is for StatusErrInvalidDescriptor.
+	ErrInvalidDescriptor error = &errorCategory{msg: "Invalid descriptor", codes: []int{StatusErrInvalidDescriptor}}
+	// ErrUnmanagedEntity is for StatusErrUnmanagedEntity.
+	ErrUnmanagedEntity error = &errorCategory{msg: "Unmanaged entity", codes: []int{StatusErrUnmanagedEntity}}
+	// ErrOnionExists is for ADD_ONION failing because the onion service is
+	// already running. It is also in ErrTor.
+	ErrOnionExists error = &errorCategory{msg: "Onion address collision",
+		codes: []int{StatusErrUnspecifiedTorError}, replyContains: "Onion address collision"}
+)
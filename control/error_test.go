@@ -0,0 +1,56 @@
+package control
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+
+	"github.com/cretz/bine/control/controltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestError(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	// Unrecognized entity
+	_, err := conn.GetInfo("nope")
+	require.True(t, errors.Is(err, ErrUnrecognizedEntity))
+	require.False(t, errors.Is(err, ErrTor))
+	var ctrlErr *Error
+	require.True(t, errors.As(err, &ctrlErr))
+	require.Equal(t, StatusErrUnrecognizedEntity, ctrlErr.Code)
+	require.Equal(t, "GETINFO nope", ctrlErr.Command)
+	require.Equal(t, "GETINFO", ctrlErr.Keyword())
+	require.Equal(t, []string{ctrlErr.Response.RawLines[0]}, ctrlErr.RawLines)
+	require.Equal(t, `GETINFO failed: 552 Unrecognized entity: Unrecognized key "nope"`, err.Error())
+	// Still works as a textproto error
+	var textErr *textproto.Error
+	require.True(t, errors.As(err, &textErr))
+	require.Equal(t, StatusErrUnrecognizedEntity, textErr.Code)
+	// Onion collision is in two categories
+	req := &AddOnionRequest{Key: GenKey(KeyAlgoED25519V3), Ports: []*KeyVal{NewKeyVal("80", "127.0.0.1:80")}}
+	resp, err := conn.AddOnion(req)
+	require.NoError(t, err)
+	req.Key = resp.Key
+	_, err = conn.AddOnion(req)
+	require.True(t, errors.Is(err, ErrOnionExists))
+	require.True(t, errors.Is(err, ErrTor))
+	require.False(t, errors.Is(err, ErrUnrecognizedEntity))
+	// Private keys are redacted
+	require.True(t, errors.As(err, &ctrlErr))
+	require.Equal(t, "ADD_ONION ED25519-V3:<redacted> Port=80,127.0.0.1:80", ctrlErr.Command)
+	_, err = conn.AddOnionClientAuth(&OnionClientAuth{Address: "foo.onion", PrivateKey: make([]byte, 32)})
+	require.True(t, errors.As(err, &ctrlErr))
+	require.Equal(t, "ONION_CLIENT_AUTH_ADD foo x25519:<redacted>", ctrlErr.Command)
+	// Auth args are redacted
+	server.AuthMethods = []string{"HASHEDPASSWORD"}
+	server.Password = "secret"
+	conn = NewConn(textproto.NewConn(server.Pipe()))
+	defer conn.Close()
+	_, err = conn.GetInfo("version")
+	require.True(t, errors.Is(err, ErrAuthenticationRequired))
+	err = conn.Authenticate("wrong")
+	require.True(t, errors.Is(err, ErrBadAuthentication))
+	require.True(t, errors.As(err, &ctrlErr))
+	require.Equal(t, "AUTHENTICATE <redacted>", ctrlErr.Command)
+}
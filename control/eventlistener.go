@@ -0,0 +1,265 @@
+package control
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// EventDeliveryPolicy determines what happens when an event listener's channel
+// is not ready to receive an event.
+type EventDeliveryPolicy int
+
+const (
+	// EventDeliveryBlock blocks until the channel receives the event. This is
+	// the default and was the only behavior before policies existed. Note, a
+	// blocked listener holds up the connection's reader and therefore every
+	// other listener and every synchronous response.
+	EventDeliveryBlock EventDeliveryPolicy = iota
+	// EventDeliveryDropNewest discards the event being delivered if the
+	// channel is not ready to receive it.
+	EventDeliveryDropNewest
+	// EventDeliveryDropOldest queues events in a ring buffer of
+	// EventListenerConf.BufferSize that is drained into the channel by a
+	// separate goroutine. When the buffer is full, the oldest queued event is
+	// discarded to make room.
+	EventDeliveryDropOldest
+	// EventDeliveryDisconnect removes the listener from all of its event codes
+	// the first time the channel is not ready to receive an event. The event is
+	// counted as dropped.
+	EventDeliveryDisconnect
+)
+
+// DefaultEventListenerBufferSize is the ring buffer size used for
+// EventDeliveryDropOldest when EventListenerConf.BufferSize is not set.
+const DefaultEventListenerBufferSize = 100
+
+// EventListenerConf is the configuration for AddEventListenerWithConf.
+type EventListenerConf struct {
+	// Policy is what to do when the channel is not ready for an event. The
+	// default is EventDeliveryBlock.
+	Policy EventDeliveryPolicy
+
+	// BufferSize is the ring buffer size for EventDeliveryDropOldest. If 0,
+	// DefaultEventListenerBufferSize is used. This is ignored for other
+	// policies.
+	BufferSize int
+
+	// OnDisconnect, if set, is called in its own goroutine after the listener
+	// has been disconnected. A listener is disconnected by
+	// EventDeliveryDisconnect or, for any policy, if its channel was closed
+	// while still registered.
+	OnDisconnect func()
+}
+
+// EventListenerStats are the delivery counters for an event listener. All
+// methods are safe for concurrent use.
+type EventListenerStats struct {
+	delivered    uint64
+	dropped      uint64
+	disconnected uint32
+}
+
+// Delivered is the number of events sent on the channel.
+func (e *EventListenerStats) Delivered() uint64 { return atomic.LoadUint64(&e.delivered) }
+
+// Dropped is the number of events discarded per the delivery policy.
+func (e *EventListenerStats) Dropped() uint64 { return atomic.LoadUint64(&e.dropped) }
+
+// Disconnected is true if the listener was disconnected instead of removed
+// with RemoveEventListener. See EventListenerConf.OnDisconnect.
+func (e *EventListenerStats) Disconnected() bool { return atomic.LoadUint32(&e.disconnected) == 1 }
+
+type eventListener struct {
+	ch    chan<- Event
+	conf  EventListenerConf
+	stats *EventListenerStats
+
+	// Number of event code slots this listener occupies. Guarded by
+	// Conn.eventListenersLock.
+	refs int
+
+	// Held by the reader while delivering. Removed is set under it once the
+	// listener is removed from every event code, so nothing is sent to the
+	// channel after removal even though the reader delivers to a snapshot of
+	// the listeners.
+	sendLock sync.Mutex
+	removed  bool
+
+	// Only used for EventDeliveryDropOldest
+	bufLock  sync.Mutex
+	buf      []Event
+	bufReady chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newEventListener(ch chan<- Event, conf *EventListenerConf) *eventListener {
+	l := &eventListener{ch: ch, stats: &EventListenerStats{}}
+	if conf != nil {
+		l.conf = *conf
+	}
+	if l.conf.Policy == EventDeliveryDropOldest {
+		if l.conf.BufferSize <= 0 {
+			l.conf.BufferSize = DefaultEventListenerBufferSize
+		}
+		l.bufReady = make(chan struct{}, 1)
+		l.stop = make(chan struct{})
+		l.stopped = make(chan struct{})
+	}
+	return l
+}
+
+// deliver is called by the reader and returns false if the listener should be
+// disconnected.
+func (l *eventListener) deliver(event Event) (ok bool) {
+	// A channel closed while still registered is treated as a disconnect
+	// instead of crashing the reader
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&l.stats.dropped, 1)
+			ok = false
+		}
+	}()
+	l.sendLock.Lock()
+	defer l.sendLock.Unlock()
+	if l.removed {
+		return true
+	}
+	switch l.conf.Policy {
+	case EventDeliveryDropNewest:
+		select {
+		case l.ch <- event:
+			atomic.AddUint64(&l.stats.delivered, 1)
+		default:
+			atomic.AddUint64(&l.stats.dropped, 1)
+		}
+	case EventDeliveryDropOldest:
+		l.bufLock.Lock()
+		if len(l.buf) >= l.conf.BufferSize {
+			l.buf[0] = nil
+			l.buf = l.buf[1:]
+			atomic.AddUint64(&l.stats.dropped, 1)
+		}
+		l.buf = append(l.buf, event)
+		l.bufLock.Unlock()
+		select {
+		case l.bufReady <- struct{}{}:
+		default:
+		}
+	case EventDeliveryDisconnect:
+		select {
+		case l.ch <- event:
+			atomic.AddUint64(&l.stats.delivered, 1)
+		default:
+			atomic.AddUint64(&l.stats.dropped, 1)
+			return false
+		}
+	default:
+		l.ch <- event
+		atomic.AddUint64(&l.stats.delivered, 1)
+	}
+	return true
+}
+
+// markRemoved waits for any delivery in progress and prevents any more.
+func (l *eventListener) markRemoved() {
+	l.sendLock.Lock()
+	l.removed = true
+	l.sendLock.Unlock()
+}
+
+// forward drains the ring buffer into the channel for EventDeliveryDropOldest
+// until stopped. The given func is called if the channel turns out to be
+// closed.
+func (l *eventListener) forward(onClosed func()) {
+	defer close(l.stopped)
+	defer func() {
+		if r := recover(); r != nil {
+			onClosed()
+		}
+	}()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.bufReady:
+		}
+		for {
+			l.bufLock.Lock()
+			if len(l.buf) == 0 {
+				l.bufLock.Unlock()
+				break
+			}
+			event := l.buf[0]
+			l.buf[0] = nil
+			l.buf = l.buf[1:]
+			l.bufLock.Unlock()
+			select {
+			case l.ch <- event:
+				atomic.AddUint64(&l.stats.delivered, 1)
+			case <-l.stop:
+				return
+			}
+		}
+	}
+}
+
+// AddEventListenerWithConf is AddEventListenerContext with a configuration for
+// how events are delivered to the channel. The configuration only applies when
+// the channel is not already a listener, otherwise the existing configuration
+// remains. The returned stats are for the channel. If conf is nil, the default
+// configuration is used.
+func (c *Conn) AddEventListenerWithConf(
+	ctx context.Context, ch chan<- Event, conf *EventListenerConf, events ...EventCode,
+) (*EventListenerStats, error) {
+	stats := c.addEventListenerToMap(ch, conf, events...)
+	// If there is an error updating the events, remove what we just added
+	err := c.sendSetEvents(ctx)
+	if err != nil {
+		c.removeEventListenerFromMap(ch, events...)
+	}
+	return stats, err
+}
+
+// disconnectEventListener is called by the reader to remove the listener from
+// every event code. Tor is notified in the background since the reader can't
+// wait on a response.
+func (c *Conn) disconnectEventListener(l *eventListener) {
+	c.eventListenersLock.Lock()
+	if c.eventListenersByChan[l.ch] != l {
+		// Already removed
+		c.eventListenersLock.Unlock()
+		return
+	}
+	delete(c.eventListenersByChan, l.ch)
+	for event, arr := range c.eventListeners {
+		newArr := make([]*eventListener, 0, len(arr))
+		for _, listener := range arr {
+			if listener != l {
+				newArr = append(newArr, listener)
+			}
+		}
+		if len(newArr) == 0 {
+			delete(c.eventListeners, event)
+		} else if len(newArr) != len(arr) {
+			c.eventListeners[event] = newArr
+		}
+	}
+	l.refs = 0
+	c.eventListenersLock.Unlock()
+	l.markRemoved()
+	atomic.StoreUint32(&l.stats.disconnected, 1)
+	c.debugf("Disconnected event listener after %v dropped event(s)", l.stats.Dropped())
+	go func() {
+		if l.stop != nil {
+			close(l.stop)
+		}
+		if err := c.sendSetEvents(context.Background()); err != nil {
+			c.debugf("Failed updating events after disconnect: %v", err)
+		}
+		if l.conf.OnDisconnect != nil {
+			l.conf.OnDisconnect()
+		}
+	}()
+}
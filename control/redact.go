@@ -0,0 +1,65 @@
+package control
+
+import "strings"
+
+const redacted = "<redacted>"
+
+// RedactCommand returns the first line of a command with its secrets replaced
+// by "<redacted>". Secrets are the arguments of AUTHENTICATE, the private key
+// and client auth cookies of ADD_ONION, and the private key of
+// ONION_CLIENT_AUTH_ADD. Other commands are returned as-is.
+func RedactCommand(line string) string {
+	fields := strings.Split(line, " ")
+	switch strings.ToUpper(strings.TrimPrefix(fields[0], "+")) {
+	case "AUTHENTICATE":
+		if len(fields) > 1 {
+			return fields[0] + " " + redacted
+		}
+	case "ADD_ONION":
+		for i, field := range fields {
+			if i == 1 && !strings.HasPrefix(field, "NEW:") {
+				fields[i] = redactAfter(field, ':')
+			} else if strings.HasPrefix(field, "ClientAuth=") {
+				fields[i] = redactAfter(field, ':')
+			}
+		}
+	case "ONION_CLIENT_AUTH_ADD":
+		redactX25519Fields(fields)
+	}
+	return strings.Join(fields, " ")
+}
+
+// RedactReplyLine returns a reply line, including its status code and
+// separator, with secrets replaced by "<redacted>". Secrets are the private
+// key and client auth cookies in ADD_ONION replies and the private keys in
+// ONION_CLIENT_AUTH_VIEW replies. Other lines are returned as-is.
+func RedactReplyLine(line string) string {
+	if len(line) < 4 {
+		return line
+	}
+	switch data := line[4:]; {
+	case strings.HasPrefix(data, "PrivateKey="), strings.HasPrefix(data, "ClientAuth="):
+		return line[:4] + redactAfter(data, ':')
+	case strings.HasPrefix(data, "CLIENT "):
+		fields := strings.Split(line, " ")
+		redactX25519Fields(fields)
+		return strings.Join(fields, " ")
+	}
+	return line
+}
+
+func redactX25519Fields(fields []string) {
+	for i, field := range fields {
+		if strings.HasPrefix(strings.ToLower(field), "x25519:") {
+			fields[i] = redactAfter(field, ':')
+		}
+	}
+}
+
+// redactAfter replaces everything after the first sep, if any.
+func redactAfter(str string, sep byte) string {
+	if i := strings.IndexByte(str, sep); i >= 0 {
+		return str[:i+1] + redacted
+	}
+	return str
+}
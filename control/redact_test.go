@@ -0,0 +1,36 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactCommand(t *testing.T) {
+	for line, expected := range map[string]string{
+		"AUTHENTICATE":                                       "AUTHENTICATE",
+		`AUTHENTICATE "secret"`:                              "AUTHENTICATE <redacted>",
+		"authenticate 0123 4567":                             "authenticate <redacted>",
+		"ADD_ONION NEW:ED25519-V3 Port=80":                   "ADD_ONION NEW:ED25519-V3 Port=80",
+		"ADD_ONION ED25519-V3:c2VjcmV0 Flags=Detach Port=80": "ADD_ONION ED25519-V3:<redacted> Flags=Detach Port=80",
+		"ADD_ONION NEW:BEST Port=80 ClientAuth=alice:c2VjcmV0 ClientAuth=bob": "ADD_ONION NEW:BEST Port=80 " +
+			"ClientAuth=alice:<redacted> ClientAuth=bob",
+		"ONION_CLIENT_AUTH_ADD foo x25519:c2VjcmV0 ClientName=alice": "ONION_CLIENT_AUTH_ADD foo x25519:<redacted> " +
+			"ClientName=alice",
+		"GETINFO version": "GETINFO version",
+	} {
+		require.Equal(t, expected, RedactCommand(line))
+	}
+}
+
+func TestRedactReplyLine(t *testing.T) {
+	for line, expected := range map[string]string{
+		"250-ServiceID=foo":                              "250-ServiceID=foo",
+		"250-PrivateKey=ED25519-V3:c2VjcmV0":             "250-PrivateKey=ED25519-V3:<redacted>",
+		"250-ClientAuth=alice:c2VjcmV0":                  "250-ClientAuth=alice:<redacted>",
+		"250-CLIENT foo x25519:c2VjcmV0 Flags=Permanent": "250-CLIENT foo x25519:<redacted> Flags=Permanent",
+		"250 OK": "250 OK",
+	} {
+		require.Equal(t, expected, RedactReplyLine(line))
+	}
+}
@@ -29,7 +29,7 @@ type Response struct {
 // asynchronous event.
 func (r *Response) IsOk() bool {
 	switch r.Err.Code {
-	case StatusOk, StatusOkUnnecessary, StatusAsyncEvent:
+	case StatusOk, StatusOkUnnecessary, StatusOkDecrypted, StatusAsyncEvent:
 		return true
 	default:
 		return false
@@ -50,7 +50,9 @@ func (r *Response) IsAsync() bool {
 	return r.Err.Code == StatusAsyncEvent
 }
 
-// ReadResponse returns the next response object.
+// ReadResponse returns the next response object. This is called by the
+// connection's background reader and should not be called by anything else
+// while that reader is running.
 func (c *Conn) ReadResponse() (*Response, error) {
 	var resp *Response
 	var statusCode int
@@ -10,6 +10,7 @@ import (
 const (
 	StatusOk            = 250
 	StatusOkUnnecessary = 251
+	StatusOkDecrypted   = 252
 
 	StatusErrResourceExhausted      = 451
 	StatusErrSyntaxError            = 500
@@ -32,6 +33,7 @@ const (
 var statusCodeStringMap = map[int]string{
 	StatusOk:            "OK",
 	StatusOkUnnecessary: "Operation was unnecessary",
+	StatusOkDecrypted:   "Registered client and decrypted descriptor",
 
 	StatusErrResourceExhausted:      "Resource exhausted",
 	StatusErrSyntaxError:            "Syntax error: protocol",
@@ -0,0 +1,279 @@
+package control
+
+import (
+	"context"
+	"sync"
+)
+
+// EventHandler is a callback for one or more event codes. It is created with
+// OnEvent or one of the typed On* functions and given to Subscribe.
+type EventHandler struct {
+	codes []EventCode
+	fn    func(Event)
+}
+
+// Subscription is a set of event handlers registered with Subscribe. It must
+// be closed with Close unless the context given to Subscribe completes.
+type Subscription struct {
+	conn      *Conn
+	ch        chan Event
+	codes     []EventCode
+	handlers  map[EventCode][]func(Event)
+	stats     *EventListenerStats
+	closing   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	// Closed when no more handlers will be invoked
+	dispatchDone chan struct{}
+}
+
+// Subscribe registers the handlers and starts invoking them in a single
+// goroutine, one event at a time in the order received. The context is used
+// for the initial SETEVENTS and also scopes the subscription: when it
+// completes, the subscription is closed. The conf is the delivery
+// configuration for the subscription's internal buffered channel. If nil,
+// EventDeliveryDropOldest is used so handlers can safely make requests on the
+// connection.
+//
+// Note, with EventDeliveryBlock a handler must not make requests on the
+// connection. Once the internal buffer is full, the reader blocks waiting on
+// the handler while the handler waits on the reader for its reply, and the
+// connection deadlocks.
+func (c *Conn) Subscribe(ctx context.Context, conf *EventListenerConf, handlers ...EventHandler) (*Subscription, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if conf == nil {
+		conf = &EventListenerConf{Policy: EventDeliveryDropOldest}
+	}
+	s := &Subscription{
+		conn:         c,
+		ch:           make(chan Event, DefaultEventListenerBufferSize),
+		handlers:     map[EventCode][]func(Event){},
+		closing:      make(chan struct{}),
+		dispatchDone: make(chan struct{}),
+	}
+	for _, handler := range handlers {
+		for _, code := range handler.codes {
+			if _, ok := s.handlers[code]; !ok {
+				s.codes = append(s.codes, code)
+			}
+			s.handlers[code] = append(s.handlers[code], handler.fn)
+		}
+	}
+	var err error
+	if s.stats, err = c.AddEventListenerWithConf(ctx, s.ch, conf, s.codes...); err != nil {
+		return nil, err
+	}
+	go s.dispatch(ctx)
+	return s, nil
+}
+
+func (s *Subscription) dispatch(ctx context.Context) {
+	defer close(s.dispatchDone)
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ctx.Done():
+			s.Close()
+			return
+		case event := <-s.ch:
+			fns := s.handlers[event.Code()]
+			if _, ok := recognizedEventCodesByCode[event.Code()]; !ok {
+				fns = append(fns[:len(fns):len(fns)], s.handlers[EventCodeUnrecognized]...)
+			}
+			for _, fn := range fns {
+				// Don't invoke anything once closed
+				select {
+				case <-s.closing:
+					return
+				default:
+					fn(event)
+				}
+			}
+		}
+	}
+}
+
+// Stats returns the delivery stats for the subscription's channel.
+func (s *Subscription) Stats() *EventListenerStats { return s.stats }
+
+// Done returns a channel that is closed when the subscription is closed.
+func (s *Subscription) Done() <-chan struct{} { return s.closing }
+
+// Close stops invoking handlers and removes the subscription's events from Tor
+// if no other listener needs them. This may be called multiple times, even from
+// within a handler, and only the first call does anything. Note, this does not
+// wait for an already running handler to return.
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		// The reader may be blocked sending to us, so keep draining until
+		// the listener is removed. Removal waits for a send in progress and
+		// the reader skips the listener from then on.
+		drainDone := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-s.ch:
+				case <-drainDone:
+					return
+				}
+			}
+		}()
+		s.closeErr = s.conn.RemoveEventListener(s.ch, s.codes...)
+		close(drainDone)
+	})
+	return s.closeErr
+}
+
+// OnEvent creates an EventHandler that is invoked for every event with one of
+// the given codes. EventCodeUnrecognized can be used for UnrecognizedEvent.
+func OnEvent(fn func(Event), codes ...EventCode) EventHandler {
+	return EventHandler{codes: codes, fn: fn}
+}
+
+// OnAddrMap creates an EventHandler for ADDRMAP.
+func OnAddrMap(fn func(*AddrMapEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*AddrMapEvent)) }, EventCodeAddrMap)
+}
+
+// OnBandwidth creates an EventHandler for BW.
+func OnBandwidth(fn func(*BandwidthEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*BandwidthEvent)) }, EventCodeBandwidth)
+}
+
+// OnBuildTimeoutSet creates an EventHandler for BUILDTIMEOUT_SET.
+func OnBuildTimeoutSet(fn func(*BuildTimeoutSetEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*BuildTimeoutSetEvent)) }, EventCodeBuildTimeoutSet)
+}
+
+// OnCellStats creates an EventHandler for CELL_STATS.
+func OnCellStats(fn func(*CellStatsEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*CellStatsEvent)) }, EventCodeCellStats)
+}
+
+// OnCircuit creates an EventHandler for CIRC.
+func OnCircuit(fn func(*CircuitEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*CircuitEvent)) }, EventCodeCircuit)
+}
+
+// OnCircuitBandwidth creates an EventHandler for CIRC_BW.
+func OnCircuitBandwidth(fn func(*CircuitBandwidthEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*CircuitBandwidthEvent)) }, EventCodeCircuitBandwidth)
+}
+
+// OnCircuitMinor creates an EventHandler for CIRC_MINOR.
+func OnCircuitMinor(fn func(*CircuitMinorEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*CircuitMinorEvent)) }, EventCodeCircuitMinor)
+}
+
+// OnClientsSeen creates an EventHandler for CLIENTS_SEEN.
+func OnClientsSeen(fn func(*ClientsSeenEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*ClientsSeenEvent)) }, EventCodeClientsSeen)
+}
+
+// OnConfChanged creates an EventHandler for CONF_CHANGED.
+func OnConfChanged(fn func(*ConfChangedEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*ConfChangedEvent)) }, EventCodeConfChanged)
+}
+
+// OnConnBandwidth creates an EventHandler for CONN_BW.
+func OnConnBandwidth(fn func(*ConnBandwidthEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*ConnBandwidthEvent)) }, EventCodeConnBandwidth)
+}
+
+// OnDescChanged creates an EventHandler for DESCCHANGED.
+func OnDescChanged(fn func(*DescChangedEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*DescChangedEvent)) }, EventCodeDescChanged)
+}
+
+// OnGuard creates an EventHandler for GUARD.
+func OnGuard(fn func(*GuardEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*GuardEvent)) }, EventCodeGuard)
+}
+
+// OnHSDesc creates an EventHandler for HS_DESC.
+func OnHSDesc(fn func(*HSDescEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*HSDescEvent)) }, EventCodeHSDesc)
+}
+
+// OnHSDescContent creates an EventHandler for HS_DESC_CONTENT.
+func OnHSDescContent(fn func(*HSDescContentEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*HSDescContentEvent)) }, EventCodeHSDescContent)
+}
+
+// OnLog creates an EventHandler for the given log severities. If no severities
+// are given, NOTICE, WARN, and ERR are used.
+func OnLog(fn func(*LogEvent), severities ...EventCode) EventHandler {
+	if len(severities) == 0 {
+		severities = []EventCode{EventCodeLogNotice, EventCodeLogWarn, EventCodeLogErr}
+	}
+	return OnEvent(func(e Event) { fn(e.(*LogEvent)) }, severities...)
+}
+
+// OnNetworkLiveness creates an EventHandler for NETWORK_LIVENESS.
+func OnNetworkLiveness(fn func(*NetworkLivenessEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*NetworkLivenessEvent)) }, EventCodeNetworkLiveness)
+}
+
+// OnNetworkStatus creates an EventHandler for NS.
+func OnNetworkStatus(fn func(*NetworkStatusEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*NetworkStatusEvent)) }, EventCodeNetworkStatus)
+}
+
+// OnNewConsensus creates an EventHandler for NEWCONSENSUS.
+func OnNewConsensus(fn func(*NewConsensusEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*NewConsensusEvent)) }, EventCodeNewConsensus)
+}
+
+// OnNewDesc creates an EventHandler for NEWDESC.
+func OnNewDesc(fn func(*NewDescEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*NewDescEvent)) }, EventCodeNewDesc)
+}
+
+// OnORConn creates an EventHandler for ORCONN.
+func OnORConn(fn func(*ORConnEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*ORConnEvent)) }, EventCodeORConn)
+}
+
+// OnSignal creates an EventHandler for SIGNAL.
+func OnSignal(fn func(*SignalEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*SignalEvent)) }, EventCodeSignal)
+}
+
+// OnStatus creates an EventHandler for the given status types. If no types are
+// given, STATUS_CLIENT, STATUS_GENERAL, and STATUS_SERVER are used.
+func OnStatus(fn func(*StatusEvent), types ...EventCode) EventHandler {
+	if len(types) == 0 {
+		types = []EventCode{EventCodeStatusClient, EventCodeStatusGeneral, EventCodeStatusServer}
+	}
+	return OnEvent(func(e Event) { fn(e.(*StatusEvent)) }, types...)
+}
+
+// OnStream creates an EventHandler for STREAM.
+func OnStream(fn func(*StreamEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*StreamEvent)) }, EventCodeStream)
+}
+
+// OnStreamBandwidth creates an EventHandler for STREAM_BW.
+func OnStreamBandwidth(fn func(*StreamBandwidthEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*StreamBandwidthEvent)) }, EventCodeStreamBandwidth)
+}
+
+// OnTokenBucketEmpty creates an EventHandler for TB_EMPTY.
+func OnTokenBucketEmpty(fn func(*TokenBucketEmptyEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*TokenBucketEmptyEvent)) }, EventCodeTokenBucketEmpty)
+}
+
+// OnTransportLaunched creates an EventHandler for TRANSPORT_LAUNCHED.
+func OnTransportLaunched(fn func(*TransportLaunchedEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*TransportLaunchedEvent)) }, EventCodeTransportLaunched)
+}
+
+// OnUnrecognized creates an EventHandler for events this library does not
+// recognize.
+func OnUnrecognized(fn func(*UnrecognizedEvent)) EventHandler {
+	return OnEvent(func(e Event) { fn(e.(*UnrecognizedEvent)) }, EventCodeUnrecognized)
+}
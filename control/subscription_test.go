@@ -0,0 +1,181 @@
+package control
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control/controltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	circuits := make(chan *CircuitEvent, 1)
+	logs := make(chan *LogEvent, 1)
+	sub, err := conn.Subscribe(ctx, nil,
+		OnCircuit(func(e *CircuitEvent) {
+			// Requests can be made from handlers
+			_, err := conn.GetInfo("version")
+			require.NoError(t, err)
+			circuits <- e
+		}),
+		OnLog(func(e *LogEvent) { logs <- e }, EventCodeLogWarn),
+		OnUnrecognized(func(*UnrecognizedEvent) {}),
+	)
+	require.NoError(t, err)
+	// The unrecognized pseudo code is never sent to Tor
+	require.Equal(t, "SETEVENTS CIRC WARN", sortedSetEvents(lastRequest(server, "SETEVENTS")))
+	server.Emit("CIRC", "5 BUILT")
+	require.Equal(t, "5", (<-circuits).CircuitID)
+	server.Emit("WARN", "something")
+	require.Equal(t, "something", (<-logs).Raw)
+	// Canceling the context closes the subscription and clears the events
+	cancel()
+	<-sub.Done()
+	require.Eventually(t, func() bool { return lastRequest(server, "SETEVENTS") == "SETEVENTS" },
+		time.Second, 10*time.Millisecond)
+	require.NoError(t, sub.Close())
+}
+
+func sortedSetEvents(req string) string {
+	pieces := strings.Fields(req)
+	sort.Strings(pieces[1:])
+	return strings.Join(pieces, " ")
+}
+
+func TestSubscribeDispatch(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	calls := make(chan string, 10)
+	// Tor only sends unrecognized events that were explicitly enabled
+	sub, err := conn.Subscribe(context.Background(), nil,
+		OnCircuit(func(e *CircuitEvent) { calls <- "circ1 " + e.CircuitID }),
+		OnEvent(func(e Event) { calls <- "any " + string(e.Code()) }, EventCodeCircuit, EventCodeStream, "FOO"),
+		OnCircuit(func(e *CircuitEvent) { calls <- "circ2 " + e.CircuitID }),
+		OnUnrecognized(func(e *UnrecognizedEvent) { calls <- "unrecognized " + string(e.EventCode) }),
+	)
+	require.NoError(t, err)
+	defer sub.Close()
+	server.Emit("CIRC", "5 BUILT")
+	server.Emit("STREAM", "7 NEW 0 example.com:80")
+	server.Emit("FOO", "bar")
+	// Handlers are called in registration order, one event at a time
+	for _, expected := range []string{
+		"circ1 5", "any CIRC", "circ2 5", "any STREAM", "any FOO", "unrecognized FOO",
+	} {
+		require.Equal(t, expected, <-calls)
+	}
+}
+
+func TestSubscribeCloseDuringDelivery(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	started, release, returned := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	var calls int32
+	sub, err := conn.Subscribe(context.Background(), nil,
+		OnCircuit(func(*CircuitEvent) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+				<-release
+				close(returned)
+			}
+		}),
+		OnCircuit(func(*CircuitEvent) { atomic.AddInt32(&calls, 1) }),
+	)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		server.Emit("CIRC", strconv.Itoa(i)+" BUILT")
+	}
+	// Close does not wait on the running handler but no others are called
+	<-started
+	require.NoError(t, sub.Close())
+	<-sub.Done()
+	require.Equal(t, "SETEVENTS", lastRequest(server, "SETEVENTS"))
+	close(release)
+	<-returned
+	// Not even the next handler for the same event
+	<-sub.dispatchDone
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.False(t, sub.Stats().Disconnected())
+}
+
+func TestSubscribeCloseFromHandler(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	subCh := make(chan *Subscription, 1)
+	closeErr := make(chan error, 1)
+	sub, err := conn.Subscribe(context.Background(), nil, OnCircuit(func(*CircuitEvent) {
+		closeErr <- (<-subCh).Close()
+	}))
+	require.NoError(t, err)
+	subCh <- sub
+	server.Emit("CIRC", "1 BUILT")
+	require.NoError(t, <-closeErr)
+	<-sub.Done()
+	require.Equal(t, "SETEVENTS", lastRequest(server, "SETEVENTS"))
+}
+
+func TestSubscribeContextCancel(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	// An already done context fails the subscription
+	doneCtx, doneCancel := context.WithCancel(context.Background())
+	doneCancel()
+	_, err := conn.Subscribe(doneCtx, nil, OnCircuit(func(*CircuitEvent) {}))
+	require.Equal(t, context.Canceled, err)
+	// Canceling while a handler runs closes the subscription after it returns
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started, release := make(chan struct{}), make(chan struct{})
+	sub, err := conn.Subscribe(ctx, nil, OnCircuit(func(*CircuitEvent) {
+		close(started)
+		<-release
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "SETEVENTS CIRC", lastRequest(server, "SETEVENTS"))
+	server.Emit("CIRC", "1 BUILT")
+	<-started
+	cancel()
+	close(release)
+	<-sub.Done()
+	require.Eventually(t, func() bool { return lastRequest(server, "SETEVENTS") == "SETEVENTS" },
+		time.Second, 10*time.Millisecond)
+}
+
+func TestSubscribeDefaultPolicyAllowsRequests(t *testing.T) {
+	server := controltest.NewServer()
+	conn := newTestConn(t, server)
+	// More events than the internal buffer holds, each handler making a
+	// request. This would deadlock with EventDeliveryBlock.
+	const count = 3 * DefaultEventListenerBufferSize
+	last := make(chan struct{})
+	sub, err := conn.Subscribe(context.Background(), nil, OnCircuit(func(e *CircuitEvent) {
+		_, err := conn.GetInfo("version")
+		require.NoError(t, err)
+		if e.CircuitID == strconv.Itoa(count-1) {
+			close(last)
+		}
+	}))
+	require.NoError(t, err)
+	defer sub.Close()
+	go func() {
+		for i := 0; i < count; i++ {
+			server.Emit("CIRC", strconv.Itoa(i)+" BUILT")
+		}
+	}()
+	select {
+	case <-last:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Timed out waiting for the last event")
+	}
+	require.Eventually(t, func() bool { return sub.Stats().Delivered()+sub.Stats().Dropped() == count },
+		time.Second, 10*time.Millisecond)
+}
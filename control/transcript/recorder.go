@@ -0,0 +1,133 @@
+package transcript
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+// Recorder writes transcript entries to a writer. It is safe for concurrent
+// use. Writing stops at the first error which is then available via Err.
+type Recorder struct {
+	// IncludeSecrets, if true, records secrets as-is. By default they are
+	// replaced with "<redacted>" so they are not written to the transcript.
+	// Secrets are the arguments of AUTHENTICATE, onion service private keys
+	// and client auth cookies sent with ADD_ONION or received in its reply,
+	// and client auth private keys sent with ONION_CLIENT_AUTH_ADD or received
+	// from ONION_CLIENT_AUTH_VIEW. Note, sessions that read a redacted key
+	// from Tor, e.g. ADD_ONION with a new key, can't be replayed. This should
+	// be set before use.
+	IncludeSecrets bool
+
+	lock  sync.Mutex
+	enc   *json.Encoder
+	start time.Time
+	err   error
+}
+
+// NewRecorder creates a Recorder that writes to the given writer. Entry times
+// are relative to when this is called.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w), start: time.Now()}
+}
+
+// Record writes a single line, without the CRLF, in the given direction.
+func (r *Recorder) Record(dir Direction, line string) error {
+	entry := &Entry{Dir: dir, Line: line}
+	if !r.IncludeSecrets {
+		entry.Line = redact(entry)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil {
+		entry.Time = time.Since(r.start)
+		r.err = r.enc.Encode(entry)
+	}
+	return r.err
+}
+
+// redact returns the entry's line with secrets replaced.
+func redact(entry *Entry) string {
+	if entry.Dir == DirectionSend {
+		return control.RedactCommand(entry.Line)
+	}
+	return control.RedactReplyLine(entry.Line)
+}
+
+// Err returns the first error that occurred writing an entry, if any.
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// Conn wraps the given control connection so every line read from it and
+// written to it is recorded. Recording errors do not affect the connection.
+func (r *Recorder) Conn(conn net.Conn) net.Conn {
+	return &recordingConn{
+		Conn: conn,
+		send: &lineSplitter{dir: DirectionSend, recorder: r},
+		recv: &lineSplitter{dir: DirectionRecv, recorder: r},
+	}
+}
+
+type recordingConn struct {
+	net.Conn
+	send *lineSplitter
+	recv *lineSplitter
+}
+
+func (r *recordingConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.recv.write(b[:n])
+	return n, err
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) {
+	// Record before writing, otherwise the reply could be recorded first
+	r.send.write(b)
+	return r.Conn.Write(b)
+}
+
+func (r *recordingConn) Close() error {
+	r.send.flush()
+	r.recv.flush()
+	return r.Conn.Close()
+}
+
+// lineSplitter buffers partial lines since reads and writes aren't aligned to
+// lines.
+type lineSplitter struct {
+	dir      Direction
+	recorder *Recorder
+	lock     sync.Mutex
+	buf      []byte
+}
+
+func (l *lineSplitter) write(b []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return
+		}
+		l.recorder.Record(l.dir, string(bytes.TrimSuffix(l.buf[:i], []byte{'\r'})))
+		l.buf = l.buf[i+1:]
+	}
+}
+
+func (l *lineSplitter) flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.buf) > 0 {
+		l.recorder.Record(l.dir, string(l.buf))
+		l.buf = nil
+	}
+}
@@ -0,0 +1,143 @@
+package transcript
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replayer plays a transcript back to a controller as if it were Tor. Received
+// lines are written in order and, each time a sent line is reached, the
+// replayer waits for the controller to send a matching line. When the
+// transcript ends, the connection is closed. A replayer serves a single
+// session; the first mismatch or connection failure ends it and is available
+// via Err.
+//
+// Note, SAFECOOKIE and COOKIE authentication can only be replayed if the
+// controller can verify the recorded server hash, i.e. it has the same cookie
+// file that was used when recording. NULL and password authentication replay
+// without issue.
+type Replayer struct {
+	// RealTime, if true, delays received lines by the same amount of time they
+	// were delayed in the recording. By default, lines are sent as soon as
+	// possible. This should be set before serving.
+	RealTime bool
+
+	// Match, if set, is used to check whether a line sent by the controller
+	// matches the recorded one. By default, lines must be equal, or equal once
+	// redacted like Recorder does, except for AUTHENTICATE and AUTHCHALLENGE
+	// which only need the same keyword since their arguments are redacted or
+	// random. This should be set before serving.
+	Match func(expected *Entry, actual string) bool
+
+	entries   []*Entry
+	doneCh    chan struct{}
+	serveOnce sync.Once
+	err       error
+}
+
+// NewReplayer creates a Replayer for the given entries.
+func NewReplayer(entries []*Entry) *Replayer {
+	return &Replayer{entries: entries, doneCh: make(chan struct{})}
+}
+
+// Pipe returns the client side of an in-memory connection that is served in
+// the background. It can be used in place of an embedded control connection.
+func (r *Replayer) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go r.Serve(server)
+	return client
+}
+
+// Listen listens on the given network and address and serves the first
+// accepted connection in the background. The listener is closed once that
+// connection is accepted.
+func (r *Replayer) Listen(network, address string) (net.Listener, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			r.serveOnce.Do(func() {
+				r.err = fmt.Errorf("Unable to accept: %v", err)
+				close(r.doneCh)
+			})
+			return
+		}
+		r.Serve(conn)
+	}()
+	return l, nil
+}
+
+// Serve replays the transcript on the given connection, closing it when done.
+// This blocks until the session ends. Only the first call serves, subsequent
+// calls just close the connection.
+func (r *Replayer) Serve(conn net.Conn) {
+	defer conn.Close()
+	r.serveOnce.Do(func() {
+		r.err = r.serve(conn)
+		close(r.doneCh)
+	})
+}
+
+func (r *Replayer) serve(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	// The real time that corresponds to the start of the recording
+	base := time.Now()
+	for i, entry := range r.entries {
+		switch entry.Dir {
+		case DirectionRecv:
+			if r.RealTime {
+				time.Sleep(time.Until(base.Add(entry.Time)))
+			}
+			if _, err := conn.Write([]byte(entry.Line + "\r\n")); err != nil {
+				return fmt.Errorf("Unable to write entry %v: %v", i+1, err)
+			}
+		case DirectionSend:
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("Unable to read line for entry %v (%q): %v", i+1, entry.Line, err)
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if !r.match(entry, line) {
+				return fmt.Errorf("Entry %v mismatch, expected %q, got %q", i+1, entry.Line, line)
+			}
+			base = time.Now().Add(-entry.Time)
+		default:
+			return fmt.Errorf("Invalid direction for entry %v: %v", i+1, entry.Dir)
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) match(expected *Entry, actual string) bool {
+	if r.Match != nil {
+		return r.Match(expected, actual)
+	}
+	switch keyword := expected.Keyword(); keyword {
+	case "AUTHENTICATE", "AUTHCHALLENGE":
+		return (&Entry{Line: actual}).Keyword() == keyword
+	default:
+		return expected.Line == actual || expected.Line == redact(&Entry{Dir: DirectionSend, Line: actual})
+	}
+}
+
+// Done returns a channel that is closed when the session has ended.
+func (r *Replayer) Done() <-chan struct{} { return r.doneCh }
+
+// Err returns the reason the session ended early, or nil if the session has not
+// ended or the whole transcript was replayed.
+func (r *Replayer) Err() error {
+	select {
+	case <-r.doneCh:
+		return r.err
+	default:
+		return nil
+	}
+}
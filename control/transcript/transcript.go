@@ -0,0 +1,75 @@
+// Package transcript records control port sessions to a file and replays them
+// as a fake Tor peer.
+//
+// A transcript is a sequence of JSON objects, one per line, each being an Entry
+// for a single line of the control protocol in either direction. A Recorder
+// wraps any net.Conn, so it works for TCP, Unix socket, and embedded control
+// connections alike (see tor.StartConf.ControlRecorder). A Replayer serves a
+// transcript back to a controller over an in-memory or network connection,
+// checking that the controller sends what was recorded, to reproduce a session
+// exactly without Tor.
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Direction is the direction of a transcript line.
+type Direction string
+
+const (
+	// DirectionSend is a line sent by the controller to Tor.
+	DirectionSend Direction = "send"
+	// DirectionRecv is a line received by the controller from Tor.
+	DirectionRecv Direction = "recv"
+)
+
+// Entry is a single line in a transcript.
+type Entry struct {
+	// Time is the time since recording started. It is serialized as
+	// nanoseconds.
+	Time time.Duration `json:"t"`
+	// Dir is the direction of the line.
+	Dir Direction `json:"dir"`
+	// Line is the line without the trailing CRLF.
+	Line string `json:"line"`
+}
+
+// Keyword returns the uppercased first space-delimited word of the line, e.g.
+// the command for sent lines.
+func (e *Entry) Keyword() string {
+	keyword := e.Line
+	if i := strings.IndexByte(keyword, ' '); i >= 0 {
+		keyword = keyword[:i]
+	}
+	return strings.ToUpper(keyword)
+}
+
+// ReadEntries reads all entries from a transcript.
+func ReadEntries(r io.Reader) ([]*Entry, error) {
+	ret := []*Entry{}
+	scanner := bufio.NewScanner(r)
+	// Lines can be as large as a descriptor
+	scanner.Buffer(nil, 16*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		entry := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("Invalid entry on line %v: %v", lineNum, err)
+		} else if entry.Dir != DirectionSend && entry.Dir != DirectionRecv {
+			return nil, fmt.Errorf("Invalid direction on line %v: %v", lineNum, entry.Dir)
+		}
+		ret = append(ret, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
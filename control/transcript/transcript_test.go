@@ -0,0 +1,151 @@
+package transcript
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/control/controltest"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/stretchr/testify/require"
+)
+
+// runSession is the same controller code run both while recording and while
+// replaying.
+func runSession(t *testing.T, conn *control.Conn, password string, emit func()) {
+	require.NoError(t, conn.Authenticate(password))
+	vals, err := conn.GetInfo("version")
+	require.NoError(t, err)
+	require.Equal(t, "0.4.7.13", vals[0].Val)
+	ch := make(chan control.Event, 1)
+	require.NoError(t, conn.AddEventListener(ch, control.EventCodeCircuit))
+	emit()
+	require.Equal(t, "5", (<-ch).(*control.CircuitEvent).CircuitID)
+	require.NoError(t, conn.RemoveEventListener(ch, control.EventCodeCircuit))
+	require.NoError(t, conn.Close())
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	server := controltest.NewServer()
+	server.AuthMethods = []string{"HASHEDPASSWORD"}
+	server.Password = "secret"
+	defer server.Close()
+	// Record
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+	conn := control.NewConn(textproto.NewConn(recorder.Conn(server.Pipe())))
+	runSession(t, conn, "secret", func() { server.Emit("CIRC", "5 BUILT") })
+	require.NoError(t, recorder.Err())
+	// Passwords are redacted
+	require.NotContains(t, buf.String(), "secret")
+	require.NotContains(t, buf.String(), hex.EncodeToString([]byte("secret")))
+	entries, err := ReadEntries(strings.NewReader(buf.String()))
+	require.NoError(t, err)
+	require.Equal(t, &Entry{Time: entries[0].Time, Dir: DirectionSend, Line: "PROTOCOLINFO"}, entries[0])
+	require.Equal(t, "QUIT", entries[len(entries)-2].Line)
+	// Replay
+	replayer := NewReplayer(entries)
+	conn = control.NewConn(textproto.NewConn(replayer.Pipe()))
+	runSession(t, conn, "other", func() {})
+	<-replayer.Done()
+	require.NoError(t, replayer.Err())
+}
+
+func TestRecordRedactsOnionKeys(t *testing.T) {
+	server := controltest.NewServer()
+	defer server.Close()
+	server.Handle("ONION_CLIENT_AUTH_ADD", func(*controltest.Request) []string { return controltest.Reply() })
+	key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	clientKey := bytes.Repeat([]byte{1}, 32)
+	// The same session is replayed with the given keys
+	runOnionSession := func(conn *control.Conn) {
+		require.NoError(t, conn.Authenticate(""))
+		_, err := conn.AddOnion(&control.AddOnionRequest{
+			Key:   &control.ED25519Key{KeyPair: key},
+			Ports: []*control.KeyVal{control.NewKeyVal("80", "")},
+		})
+		require.NoError(t, err)
+		_, err = conn.AddOnionClientAuth(&control.OnionClientAuth{
+			Address: "5gwydd4mbovxisdpekwugdy7lcjpkzpxsyoh6fwzrmt7p7rp33qwsjid", PrivateKey: clientKey,
+		})
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+	conn := control.NewConn(textproto.NewConn(recorder.Conn(server.Pipe())))
+	runOnionSession(conn)
+	require.NoError(t, recorder.Err())
+	require.NotContains(t, buf.String(), base64.StdEncoding.EncodeToString(key.PrivateKey()))
+	require.NotContains(t, buf.String(), base64.StdEncoding.EncodeToString(clientKey))
+	entries, err := ReadEntries(strings.NewReader(buf.String()))
+	require.NoError(t, err)
+	lines := []string{}
+	for _, entry := range entries {
+		lines = append(lines, entry.Line)
+	}
+	require.Contains(t, lines, "ADD_ONION ED25519-V3:<redacted> Port=80")
+	require.Contains(t, lines,
+		"ONION_CLIENT_AUTH_ADD 5gwydd4mbovxisdpekwugdy7lcjpkzpxsyoh6fwzrmt7p7rp33qwsjid x25519:<redacted>")
+	// Redacted lines still match on replay
+	replayer := NewReplayer(entries)
+	runOnionSession(control.NewConn(textproto.NewConn(replayer.Pipe())))
+	<-replayer.Done()
+	require.NoError(t, replayer.Err())
+
+	// Keys Tor generates are redacted from the reply unless secrets are included
+	for _, includeSecrets := range []bool{false, true} {
+		buf.Reset()
+		recorder = NewRecorder(&buf)
+		recorder.IncludeSecrets = includeSecrets
+		conn = control.NewConn(textproto.NewConn(recorder.Conn(server.Pipe())))
+		require.NoError(t, conn.Authenticate(""))
+		resp, err := conn.AddOnion(&control.AddOnionRequest{
+			Key:   control.GenKey(control.KeyAlgoED25519V3),
+			Ports: []*control.KeyVal{control.NewKeyVal("80", "")},
+		})
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+		entries, err = ReadEntries(strings.NewReader(buf.String()))
+		require.NoError(t, err)
+		lines = []string{}
+		for _, entry := range entries {
+			lines = append(lines, entry.Line)
+		}
+		if includeSecrets {
+			require.Contains(t, lines, "250-PrivateKey=ED25519-V3:"+resp.Key.Blob())
+		} else {
+			require.Contains(t, lines, "250-PrivateKey=ED25519-V3:<redacted>")
+			require.NotContains(t, buf.String(), resp.Key.Blob())
+		}
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	entries, err := ReadEntries(strings.NewReader(`
+{"t":0,"dir":"send","line":"GETINFO version"}
+{"t":10,"dir":"recv","line":"250-version=0.4.7.13"}
+{"t":20,"dir":"recv","line":"250 OK"}
+`))
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	l, err := NewReplayer(entries).Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	replayer := NewReplayer(entries)
+	l, err = replayer.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	textConn, err := textproto.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	conn := control.NewConn(textConn)
+	defer conn.Close()
+	_, err = conn.GetInfo("config-text")
+	require.Error(t, err)
+	<-replayer.Done()
+	require.EqualError(t, replayer.Err(),
+		`Entry 1 mismatch, expected "GETINFO version", got "GETINFO config-text"`)
+}
@@ -0,0 +1,150 @@
+package dir
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// Ed25519CertType is the purpose of an Ed25519Cert.
+type Ed25519CertType byte
+
+// Cert types from cert-spec.txt.
+const (
+	CertTypeIdentitySigning Ed25519CertType = 0x04
+	CertTypeSigningLink     Ed25519CertType = 0x05
+	CertTypeSigningAuth     Ed25519CertType = 0x06
+	CertTypeHSIdentitySign  Ed25519CertType = 0x08
+	CertTypeHSSigningIntro  Ed25519CertType = 0x09
+	CertTypeOnionKeyCross   Ed25519CertType = 0x0A
+	CertTypeHSIntroEncKey   Ed25519CertType = 0x0B
+)
+
+const certExtSignedWithEd25519 byte = 0x04
+
+// Ed25519Cert is a Tor ed25519 certificate as defined in cert-spec.txt. It is
+// used for relay identities in server descriptors and for onion service
+// descriptor signing keys.
+type Ed25519Cert struct {
+	Type Ed25519CertType
+	// Expires is only precise to the hour
+	Expires time.Time
+	// KeyType is 1 for ed25519 keys and others for hashes of keys
+	KeyType      byte
+	CertifiedKey []byte
+	// SigningKey is from the signed-with-ed25519-key extension, nil if absent
+	SigningKey ed25519.PublicKey
+	// Extensions has all extensions, including the signing key one
+	Extensions []*Ed25519CertExtension
+	Signature  []byte
+	// raw has the bytes, used for verification
+	raw []byte
+}
+
+// Ed25519CertExtension is an extension in an Ed25519Cert.
+type Ed25519CertExtension struct {
+	Type byte
+	// Flags has 1 set if the extension affects validation
+	Flags byte
+	Data  []byte
+}
+
+// ParseEd25519Cert parses the bytes of a certificate, e.g. the object of an
+// identity-ed25519 item.
+func ParseEd25519Cert(byts []byte) (*Ed25519Cert, error) {
+	if len(byts) < 40+ed25519.SignatureSize {
+		return nil, fmt.Errorf("Cert too short")
+	} else if byts[0] != 1 {
+		return nil, fmt.Errorf("Unknown cert version %v", byts[0])
+	}
+	ret := &Ed25519Cert{
+		Type:         Ed25519CertType(byts[1]),
+		Expires:      time.Unix(int64(binary.BigEndian.Uint32(byts[2:]))*3600, 0).UTC(),
+		KeyType:      byts[6],
+		CertifiedKey: byts[7:39],
+		raw:          byts,
+	}
+	rest := byts[40:]
+	for i := 0; i < int(byts[39]); i++ {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("Cert extension truncated")
+		}
+		ext := &Ed25519CertExtension{Type: rest[2], Flags: rest[3]}
+		dataLen := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 4+dataLen {
+			return nil, fmt.Errorf("Cert extension truncated")
+		}
+		ext.Data, rest = rest[4:4+dataLen], rest[4+dataLen:]
+		if ext.Type == certExtSignedWithEd25519 {
+			if len(ext.Data) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("Invalid cert signing key length")
+			}
+			ret.SigningKey = ed25519.PublicKey(ext.Data)
+		} else if ext.Flags&1 == 1 {
+			return nil, fmt.Errorf("Unknown cert extension %v affects validation", ext.Type)
+		}
+		ret.Extensions = append(ret.Extensions, ext)
+	}
+	if len(rest) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("Invalid cert signature length")
+	}
+	ret.Signature = rest
+	return ret, nil
+}
+
+// Bytes returns the encoded certificate.
+func (c *Ed25519Cert) Bytes() []byte {
+	if c.raw != nil {
+		return c.raw
+	}
+	ret := []byte{1, byte(c.Type), 0, 0, 0, 0, c.KeyType}
+	binary.BigEndian.PutUint32(ret[2:], uint32(c.Expires.Unix()/3600))
+	ret = append(ret, c.CertifiedKey...)
+	ret = append(ret, byte(len(c.Extensions)))
+	for _, ext := range c.Extensions {
+		ret = append(ret, byte(len(ext.Data)>>8), byte(len(ext.Data)), ext.Type, ext.Flags)
+		ret = append(ret, ext.Data...)
+	}
+	return append(ret, c.Signature...)
+}
+
+// Verify checks the signature with the given key or, if nil, the key in the
+// signed-with-ed25519-key extension. It also checks the cert has not expired
+// at the given time unless it is zero.
+func (c *Ed25519Cert) Verify(key ed25519.PublicKey, at time.Time) error {
+	if key == nil {
+		if key = c.SigningKey; key == nil {
+			return fmt.Errorf("No signing key")
+		}
+	}
+	byts := c.Bytes()
+	if !ed25519.Verify(key, byts[:len(byts)-ed25519.SignatureSize], c.Signature) {
+		return fmt.Errorf("Invalid cert signature")
+	} else if !at.IsZero() && at.After(c.Expires) {
+		return fmt.Errorf("Cert expired at %v", c.Expires)
+	}
+	return nil
+}
+
+// NewEd25519Cert creates a signed certificate for the given key. The signing
+// key is included as an extension.
+func NewEd25519Cert(
+	typ Ed25519CertType, expires time.Time, certifiedKey []byte, signer ed25519.KeyPair,
+) *Ed25519Cert {
+	ret := &Ed25519Cert{
+		Type:         typ,
+		Expires:      time.Unix(expires.Unix()/3600*3600, 0).UTC(),
+		KeyType:      1,
+		CertifiedKey: certifiedKey,
+		SigningKey:   signer.PublicKey(),
+		Extensions: []*Ed25519CertExtension{
+			{Type: certExtSignedWithEd25519, Data: signer.PublicKey()},
+		},
+	}
+	byts := ret.Bytes()
+	ret.Signature = ed25519.Sign(signer, byts)
+	ret.raw = append(byts, ret.Signature...)
+	return ret
+}
@@ -0,0 +1,9 @@
+// Package dir parses Tor directory documents such as network status
+// consensuses and relay descriptors. RelayLookup joins consensus entries with
+// microdescriptors to get details about relays, e.g. circuit hops.
+// HSDescriptor can decrypt v3 onion service descriptors.
+//
+// Documents can come from the control port (e.g. GETINFO ns/all) or from the
+// cached files in Tor's data directory (e.g. cached-consensus). See
+// dir-spec.txt in the Tor specs for the formats.
+package dir
@@ -0,0 +1,150 @@
+package dir
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Item is a single keyword line of a directory document along with the object
+// that follows it, if any.
+type Item struct {
+	Keyword string
+	Args    []string
+	// Object is nil if there is none
+	Object *Object
+}
+
+// Object is a PEM-like block that follows an item, e.g. a signature or key.
+type Object struct {
+	Type  string
+	Bytes []byte
+}
+
+// ParseItems parses all items of a document. Blank lines are ignored and the
+// obsolete "opt" prefix is removed.
+func ParseItems(raw string) ([]*Item, error) {
+	items := []*Item{}
+	lines := strings.Split(raw, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "-----BEGIN ") {
+			fields := strings.Fields(line)
+			if fields[0] == "opt" && len(fields) > 1 {
+				fields = fields[1:]
+			}
+			items = append(items, &Item{Keyword: fields[0], Args: fields[1:]})
+			continue
+		}
+		// Object, so take until the end
+		if len(items) == 0 || items[len(items)-1].Object != nil {
+			return nil, fmt.Errorf("Unexpected object on line %v", i+1)
+		}
+		obj := &Object{Type: strings.TrimSuffix(strings.TrimPrefix(line, "-----BEGIN "), "-----")}
+		endLine := "-----END " + obj.Type + "-----"
+		start := i
+		var b64 strings.Builder
+		for i++; i < len(lines) && strings.TrimRight(lines[i], "\r") != endLine; i++ {
+			b64.WriteString(strings.TrimSpace(lines[i]))
+		}
+		if i == len(lines) {
+			return nil, fmt.Errorf("Missing object end for line %v", start+1)
+		}
+		var err error
+		if obj.Bytes, err = decodeBase64(b64.String()); err != nil {
+			return nil, fmt.Errorf("Invalid object on line %v: %v", start+1, err)
+		}
+		items[len(items)-1].Object = obj
+	}
+	return items, nil
+}
+
+// Arg returns the argument at the given index or an empty string if there
+// isn't one.
+func (i *Item) Arg(index int) string {
+	if index < len(i.Args) {
+		return i.Args[index]
+	}
+	return ""
+}
+
+// String returns the item and its object as they appear in a document,
+// including the trailing newline.
+func (i *Item) String() string {
+	var b strings.Builder
+	b.WriteString(i.Keyword)
+	for _, arg := range i.Args {
+		b.WriteByte(' ')
+		b.WriteString(arg)
+	}
+	b.WriteByte('\n')
+	if i.Object != nil {
+		b.Write(pem.EncodeToMemory(&pem.Block{Type: i.Object.Type, Bytes: i.Object.Bytes}))
+	}
+	return b.String()
+}
+
+// decodeBase64 decodes standard base64 with or without padding.
+func decodeBase64(str string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(str, "="))
+}
+
+const timeFormat = "2006-01-02 15:04:05"
+
+// parseItemTime parses the date and time args starting at index.
+func parseItemTime(item *Item, index int) (time.Time, error) {
+	if len(item.Args) < index+2 {
+		return time.Time{}, fmt.Errorf("Missing time on %v", item.Keyword)
+	}
+	t, err := time.Parse(timeFormat, item.Args[index]+" "+item.Args[index+1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time on %v: %v", item.Keyword, err)
+	}
+	return t, nil
+}
+
+// parseIntArgs parses "key=int" args into a map.
+func parseIntArgs(item *Item, args []string) (map[string]int64, error) {
+	ret := make(map[string]int64, len(args))
+	for _, arg := range args {
+		eq := strings.IndexByte(arg, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("Invalid %v arg: %v", item.Keyword, arg)
+		}
+		val, err := strconv.ParseInt(arg[eq+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v arg: %v", item.Keyword, arg)
+		}
+		ret[arg[:eq]] = val
+	}
+	return ret, nil
+}
+
+// parseStringArgs parses "key=val" args into a map.
+func parseStringArgs(args []string) map[string]string {
+	ret := make(map[string]string, len(args))
+	for _, arg := range args {
+		if eq := strings.IndexByte(arg, '='); eq >= 0 {
+			ret[arg[:eq]] = arg[eq+1:]
+		} else {
+			ret[arg] = ""
+		}
+	}
+	return ret
+}
+
+// fingerprintFromBase64 converts a base64 identity digest as used in network
+// status documents into an uppercase hex fingerprint.
+func fingerprintFromBase64(str string) (string, error) {
+	byts, err := decodeBase64(str)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(fmt.Sprintf("%x", byts)), nil
+}
@@ -0,0 +1,191 @@
+package dir
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExtraInfo is a relay extra-info descriptor. It can be parsed from GETINFO
+// extra-info/digest/<digest> or the cached-extrainfo file.
+type ExtraInfo struct {
+	Nickname    string
+	Fingerprint string
+	// IdentityCert is the identity-ed25519 cert, nil if not present
+	IdentityCert       *Ed25519Cert
+	Published          time.Time
+	WriteHistory       *BandwidthHistory
+	ReadHistory        *BandwidthHistory
+	IPv6WriteHistory   *BandwidthHistory
+	IPv6ReadHistory    *BandwidthHistory
+	DirReqWriteHistory *BandwidthHistory
+	DirReqReadHistory  *BandwidthHistory
+	GeoIPDBDigest      string
+	GeoIP6DBDigest     string
+	// Other has the items not recognized by this parser in order, which
+	// includes most of the statistics.
+	Other            []*Item
+	RouterSigEd25519 []byte
+	RouterSignature  []byte
+}
+
+// BandwidthHistory is a *-history line of an extra-info descriptor.
+type BandwidthHistory struct {
+	End      time.Time
+	Interval time.Duration
+	// Values are bytes per interval, oldest first
+	Values []int64
+}
+
+// ParseExtraInfo parses a single extra-info descriptor.
+func ParseExtraInfo(raw string) (*ExtraInfo, error) {
+	infos, err := ParseExtraInfos(raw)
+	if err != nil {
+		return nil, err
+	} else if len(infos) != 1 {
+		return nil, fmt.Errorf("Expected 1 extra-info, got %v", len(infos))
+	}
+	return infos[0], nil
+}
+
+// ParseExtraInfos parses a set of extra-info descriptors. Annotations are
+// ignored.
+func ParseExtraInfos(raw string) ([]*ExtraInfo, error) {
+	items, err := ParseItems(raw)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*ExtraInfo{}
+	var info *ExtraInfo
+	for _, item := range items {
+		if strings.HasPrefix(item.Keyword, "@") {
+			continue
+		} else if item.Keyword == "extra-info" {
+			if len(item.Args) != 2 {
+				return nil, fmt.Errorf("Invalid extra-info line: %v", strings.Join(item.Args, " "))
+			}
+			info = &ExtraInfo{Nickname: item.Args[0], Fingerprint: strings.ToUpper(item.Args[1])}
+			ret = append(ret, info)
+		} else if info == nil {
+			return nil, fmt.Errorf("Expected extra-info line, got %v", item.Keyword)
+		} else if err = info.applyItem(item); err != nil {
+			return nil, fmt.Errorf("Invalid extra-info for %v: %v", info.Nickname, err)
+		}
+	}
+	return ret, nil
+}
+
+func (e *ExtraInfo) applyItem(item *Item) (err error) {
+	switch item.Keyword {
+	case "identity-ed25519":
+		if item.Object == nil {
+			return fmt.Errorf("Missing identity-ed25519 cert")
+		}
+		e.IdentityCert, err = ParseEd25519Cert(item.Object.Bytes)
+	case "published":
+		e.Published, err = parseItemTime(item, 0)
+	case "write-history":
+		e.WriteHistory, err = parseBandwidthHistory(item)
+	case "read-history":
+		e.ReadHistory, err = parseBandwidthHistory(item)
+	case "ipv6-write-history":
+		e.IPv6WriteHistory, err = parseBandwidthHistory(item)
+	case "ipv6-read-history":
+		e.IPv6ReadHistory, err = parseBandwidthHistory(item)
+	case "dirreq-write-history":
+		e.DirReqWriteHistory, err = parseBandwidthHistory(item)
+	case "dirreq-read-history":
+		e.DirReqReadHistory, err = parseBandwidthHistory(item)
+	case "geoip-db-digest":
+		e.GeoIPDBDigest = item.Arg(0)
+	case "geoip6-db-digest":
+		e.GeoIP6DBDigest = item.Arg(0)
+	case "router-sig-ed25519":
+		e.RouterSigEd25519, err = decodeBase64(item.Arg(0))
+	case "router-signature":
+		if item.Object == nil {
+			return fmt.Errorf("Missing router-signature object")
+		}
+		e.RouterSignature = item.Object.Bytes
+	default:
+		e.Other = append(e.Other, item)
+	}
+	return
+}
+
+func parseBandwidthHistory(item *Item) (*BandwidthHistory, error) {
+	// Format is: YYYY-MM-DD HH:MM:SS (NSEC s) NUM,NUM,...
+	end, err := parseItemTime(item, 0)
+	if err != nil {
+		return nil, err
+	} else if len(item.Args) < 4 || item.Args[3] != "s)" || !strings.HasPrefix(item.Args[2], "(") {
+		return nil, fmt.Errorf("Invalid %v: %v", item.Keyword, strings.Join(item.Args, " "))
+	}
+	ret := &BandwidthHistory{End: end}
+	secs, err := strconv.Atoi(item.Args[2][1:])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v interval: %v", item.Keyword, item.Args[2])
+	}
+	ret.Interval = time.Duration(secs) * time.Second
+	if len(item.Args) > 4 && item.Args[4] != "" {
+		for _, valStr := range strings.Split(item.Args[4], ",") {
+			val, err := strconv.ParseInt(valStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %v value: %v", item.Keyword, valStr)
+			}
+			ret.Values = append(ret.Values, val)
+		}
+	}
+	return ret, nil
+}
+
+func (b *BandwidthHistory) args() []string {
+	vals := make([]string, len(b.Values))
+	for i, val := range b.Values {
+		vals[i] = strconv.FormatInt(val, 10)
+	}
+	return []string{b.End.UTC().Format(timeFormat),
+		"(" + strconv.FormatInt(int64(b.Interval/time.Second), 10), "s)", strings.Join(vals, ",")}
+}
+
+// String returns the extra-info descriptor in the order Tor writes it. Unless
+// the fields are unchanged from a parsed Tor descriptor, the signatures will
+// not be valid.
+func (e *ExtraInfo) String() string {
+	var b descBuilder
+	b.line("extra-info", e.Nickname, e.Fingerprint)
+	if e.IdentityCert != nil {
+		b.object("identity-ed25519", "ED25519 CERT", e.IdentityCert.Bytes())
+	}
+	b.line("published", e.Published.UTC().Format(timeFormat))
+	histories := []struct {
+		keyword string
+		history *BandwidthHistory
+	}{
+		{"write-history", e.WriteHistory},
+		{"read-history", e.ReadHistory},
+		{"ipv6-write-history", e.IPv6WriteHistory},
+		{"ipv6-read-history", e.IPv6ReadHistory},
+		{"dirreq-write-history", e.DirReqWriteHistory},
+		{"dirreq-read-history", e.DirReqReadHistory},
+	}
+	for _, h := range histories {
+		if h.history != nil {
+			b.line(h.keyword, h.history.args()...)
+		}
+	}
+	b.lineIf(e.GeoIPDBDigest != "", "geoip-db-digest", e.GeoIPDBDigest)
+	b.lineIf(e.GeoIP6DBDigest != "", "geoip6-db-digest", e.GeoIP6DBDigest)
+	for _, item := range e.Other {
+		b.WriteString(item.String())
+	}
+	if e.RouterSigEd25519 != nil {
+		b.line("router-sig-ed25519", base64.RawStdEncoding.EncodeToString(e.RouterSigEd25519))
+	}
+	if e.RouterSignature != nil {
+		b.object("router-signature", "SIGNATURE", e.RouterSignature)
+	}
+	return b.String()
+}
@@ -0,0 +1,461 @@
+package dir
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// HSDescriptor is the outer, plaintext document of a v3 onion service
+// descriptor as defined in rend-spec-v3.txt. It can be parsed from the
+// HS_DESC_CONTENT event or from the files in Tor's hidden service cache.
+type HSDescriptor struct {
+	Version  int
+	Lifetime time.Duration
+	// SigningKeyCert certifies the descriptor signing key and is signed by the
+	// blinded key
+	SigningKeyCert  *Ed25519Cert
+	RevisionCounter uint64
+	// Superencrypted is the encrypted first layer
+	Superencrypted []byte
+	Signature      []byte
+}
+
+// HSDescriptorFirstLayer is the decrypted "superencrypted" layer of an onion
+// service descriptor. It has client authorization info and the encrypted
+// second layer.
+type HSDescriptorFirstLayer struct {
+	AuthType     string
+	EphemeralKey []byte
+	AuthClients  []*HSAuthClient
+	// Encrypted is the encrypted second layer
+	Encrypted []byte
+}
+
+// HSAuthClient is an auth-client entry of the first layer. When client
+// authorization is not used, these are random.
+type HSAuthClient struct {
+	ClientID        []byte
+	IV              []byte
+	EncryptedCookie []byte
+}
+
+// HSDescriptorSecondLayer is the decrypted "encrypted" layer of an onion
+// service descriptor.
+type HSDescriptorSecondLayer struct {
+	Create2Formats     []int
+	IntroAuthRequired  []string
+	SingleOnionService bool
+	IntroPoints        []*HSIntroPoint
+	// Other has the items not recognized by this parser in order
+	Other []*Item
+}
+
+// HSIntroPoint is an introduction point of an onion service.
+type HSIntroPoint struct {
+	LinkSpecifiers []*LinkSpecifier
+	// OnionKey is the ntor key of the introduction point relay
+	OnionKey    []byte
+	AuthKeyCert *Ed25519Cert
+	// EncKey is the ntor encryption key of the service for this point
+	EncKey     []byte
+	EncKeyCert *Ed25519Cert
+	// LegacyKey is only set for legacy introduction points
+	LegacyKey     *rsa.PublicKey
+	LegacyKeyCert []byte
+}
+
+// LinkSpecifier is a way to reach a relay.
+type LinkSpecifier struct {
+	Type LinkSpecifierType
+	Data []byte
+}
+
+// LinkSpecifierType is the type of a LinkSpecifier.
+type LinkSpecifierType byte
+
+// Link specifier types from tor-spec.txt.
+const (
+	LinkSpecifierIPv4     LinkSpecifierType = 0
+	LinkSpecifierIPv6     LinkSpecifierType = 1
+	LinkSpecifierLegacyID LinkSpecifierType = 2
+	LinkSpecifierEd25519  LinkSpecifierType = 3
+)
+
+// Addr returns the address of IPv4 or IPv6 link specifiers as *net.TCPAddr
+// or nil for other types.
+func (l *LinkSpecifier) Addr() net.Addr {
+	if l.Type == LinkSpecifierIPv4 && len(l.Data) == 6 {
+		return &net.TCPAddr{IP: net.IP(l.Data[:4]), Port: int(binary.BigEndian.Uint16(l.Data[4:]))}
+	} else if l.Type == LinkSpecifierIPv6 && len(l.Data) == 18 {
+		return &net.TCPAddr{IP: net.IP(l.Data[:16]), Port: int(binary.BigEndian.Uint16(l.Data[16:]))}
+	}
+	return nil
+}
+
+// String returns a description of the link specifier, e.g. the address or
+// hex fingerprint.
+func (l *LinkSpecifier) String() string {
+	switch l.Type {
+	case LinkSpecifierIPv4, LinkSpecifierIPv6:
+		if addr := l.Addr(); addr != nil {
+			return addr.String()
+		}
+	case LinkSpecifierLegacyID:
+		return "$" + strings.ToUpper(hex.EncodeToString(l.Data))
+	case LinkSpecifierEd25519:
+		return "ed25519:" + base64.RawStdEncoding.EncodeToString(l.Data)
+	}
+	return fmt.Sprintf("unknown(%v):%x", l.Type, l.Data)
+}
+
+const hsDescSigPrefix = "Tor onion service descriptor sig v3"
+
+// ParseHSDescriptor parses the outer document of a v3 onion service
+// descriptor. This verifies that the signing key cert is signed by the blinded
+// key it contains and that the descriptor is signed by the certified key. It
+// does not check expiration or which onion service the blinded key belongs
+// to, use VerifyBlindedKey for that.
+func ParseHSDescriptor(raw string) (*HSDescriptor, error) {
+	raw = strings.Replace(raw, "\r\n", "\n", -1)
+	items, err := ParseItems(raw)
+	if err != nil {
+		return nil, err
+	} else if len(items) == 0 || items[0].Keyword != "hs-descriptor" {
+		return nil, fmt.Errorf("Missing hs-descriptor")
+	}
+	ret := &HSDescriptor{}
+	for _, item := range items {
+		switch item.Keyword {
+		case "hs-descriptor":
+			ret.Version, err = strconv.Atoi(item.Arg(0))
+			if err == nil && ret.Version != 3 {
+				err = fmt.Errorf("Unsupported hs-descriptor version %v", ret.Version)
+			}
+		case "descriptor-lifetime":
+			var mins int
+			mins, err = strconv.Atoi(item.Arg(0))
+			ret.Lifetime = time.Duration(mins) * time.Minute
+		case "descriptor-signing-key-cert":
+			if item.Object == nil {
+				err = fmt.Errorf("Missing descriptor-signing-key-cert object")
+			} else {
+				ret.SigningKeyCert, err = ParseEd25519Cert(item.Object.Bytes)
+			}
+		case "revision-counter":
+			ret.RevisionCounter, err = strconv.ParseUint(item.Arg(0), 10, 64)
+		case "superencrypted":
+			if item.Object == nil {
+				err = fmt.Errorf("Missing superencrypted object")
+			} else {
+				ret.Superencrypted = item.Object.Bytes
+			}
+		case "signature":
+			ret.Signature, err = decodeBase64(item.Arg(0))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v: %v", item.Keyword, err)
+		}
+	}
+	if ret.SigningKeyCert == nil || ret.Superencrypted == nil || ret.Signature == nil {
+		return nil, fmt.Errorf("Missing required descriptor fields")
+	} else if ret.SigningKeyCert.Type != CertTypeHSIdentitySign {
+		return nil, fmt.Errorf("Invalid signing key cert type %v", ret.SigningKeyCert.Type)
+	} else if err = ret.SigningKeyCert.Verify(nil, time.Time{}); err != nil {
+		return nil, err
+	}
+	// Signature is over everything before the signature line
+	sigIndex := strings.Index(raw, "\nsignature ")
+	if sigIndex == -1 {
+		return nil, fmt.Errorf("Missing signature")
+	}
+	signed := append([]byte(hsDescSigPrefix), raw[:sigIndex+1]...)
+	if !ed25519.Verify(ret.SigningKeyCert.CertifiedKey, signed, ret.Signature) {
+		return nil, fmt.Errorf("Invalid descriptor signature")
+	}
+	return ret, nil
+}
+
+// BlindedKey returns the blinded public key that signed the signing key cert.
+func (h *HSDescriptor) BlindedKey() ed25519.PublicKey { return h.SigningKeyCert.SigningKey }
+
+// VerifyBlindedKey checks that the blinded key is the identity key blinded for
+// the time period number and length in minutes, i.e. that the descriptor was
+// signed by the onion service with the identity. NetworkStatus.HSTimePeriod
+// returns the time period of a consensus. Services also upload descriptors
+// for the next time period, so a descriptor may be for the one after.
+func (h *HSDescriptor) VerifyBlindedKey(identity ed25519.PublicKey, periodNum uint64, periodLength uint64) error {
+	blinded, err := ed25519.BlindPublicKey(identity, periodNum, periodLength)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(blinded, h.BlindedKey()) {
+		return fmt.Errorf("Blinded key does not match identity for time period %v", periodNum)
+	}
+	return nil
+}
+
+// Decrypt decrypts both layers for the given onion address, with or without
+// the ".onion" suffix. The client auth key is the x25519 private key for
+// services with client authorization or nil otherwise. Note, anyone can
+// create a descriptor that decrypts for an address since its identity key is
+// public, so VerifyBlindedKey should be used to check the descriptor is
+// actually from the service.
+func (h *HSDescriptor) Decrypt(address string, clientAuthKey []byte) (*HSDescriptorSecondLayer, error) {
+	identity, err := torutil.PublicKeyFromV3OnionServiceID(strings.TrimSuffix(address, ".onion"))
+	if err != nil {
+		return nil, err
+	}
+	first, err := h.DecryptFirstLayer(identity)
+	if err != nil {
+		return nil, err
+	}
+	return h.DecryptSecondLayer(identity, first, clientAuthKey)
+}
+
+// DecryptFirstLayer decrypts the superencrypted layer with the identity key
+// of the service.
+func (h *HSDescriptor) DecryptFirstLayer(identity ed25519.PublicKey) (*HSDescriptorFirstLayer, error) {
+	plain, err := h.decryptLayer(h.Superencrypted, h.BlindedKey(), identity, "hsdir-superencrypted-data")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt first layer: %v", err)
+	}
+	items, err := ParseItems(plain)
+	if err != nil {
+		return nil, err
+	}
+	ret := &HSDescriptorFirstLayer{}
+	for _, item := range items {
+		switch item.Keyword {
+		case "desc-auth-type":
+			ret.AuthType = item.Arg(0)
+		case "desc-auth-ephemeral-key":
+			ret.EphemeralKey, err = decodeBase64(item.Arg(0))
+		case "auth-client":
+			client := &HSAuthClient{}
+			if client.ClientID, err = decodeBase64(item.Arg(0)); err == nil {
+				if client.IV, err = decodeBase64(item.Arg(1)); err == nil {
+					client.EncryptedCookie, err = decodeBase64(item.Arg(2))
+				}
+			}
+			ret.AuthClients = append(ret.AuthClients, client)
+		case "encrypted":
+			if item.Object == nil {
+				err = fmt.Errorf("Missing object")
+			} else {
+				ret.Encrypted = item.Object.Bytes
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v: %v", item.Keyword, err)
+		}
+	}
+	if ret.Encrypted == nil {
+		return nil, fmt.Errorf("Missing encrypted second layer")
+	}
+	return ret, nil
+}
+
+// DecryptSecondLayer decrypts the encrypted layer with the identity key of
+// the service. The client auth key is the x25519 private key for services
+// with client authorization or nil otherwise.
+func (h *HSDescriptor) DecryptSecondLayer(
+	identity ed25519.PublicKey, first *HSDescriptorFirstLayer, clientAuthKey []byte,
+) (*HSDescriptorSecondLayer, error) {
+	secret := append([]byte{}, h.BlindedKey()...)
+	if clientAuthKey != nil {
+		cookie, err := h.descriptorCookie(identity, first, clientAuthKey)
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, cookie...)
+	}
+	plain, err := h.decryptLayer(first.Encrypted, secret, identity, "hsdir-encrypted-data")
+	if err != nil {
+		if clientAuthKey == nil {
+			return nil, fmt.Errorf("Unable to decrypt second layer, client auth may be required: %v", err)
+		}
+		return nil, fmt.Errorf("Unable to decrypt second layer: %v", err)
+	}
+	items, err := ParseItems(plain)
+	if err != nil {
+		return nil, err
+	}
+	ret := &HSDescriptorSecondLayer{}
+	var intro *HSIntroPoint
+	for _, item := range items {
+		if item.Keyword == "introduction-point" {
+			intro = &HSIntroPoint{}
+			ret.IntroPoints = append(ret.IntroPoints, intro)
+			err = intro.parseLinkSpecifiers(item.Arg(0))
+		} else if intro != nil {
+			err = intro.applyItem(item)
+		} else {
+			switch item.Keyword {
+			case "create2-formats":
+				for _, arg := range item.Args {
+					var format int
+					if format, err = strconv.Atoi(arg); err != nil {
+						break
+					}
+					ret.Create2Formats = append(ret.Create2Formats, format)
+				}
+			case "intro-auth-required":
+				ret.IntroAuthRequired = item.Args
+			case "single-onion-service":
+				ret.SingleOnionService = true
+			default:
+				ret.Other = append(ret.Other, item)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v: %v", item.Keyword, err)
+		}
+	}
+	return ret, nil
+}
+
+func (h *HSIntroPoint) parseLinkSpecifiers(str string) error {
+	byts, err := decodeBase64(str)
+	if err != nil {
+		return err
+	} else if len(byts) == 0 {
+		return fmt.Errorf("Missing link specifiers")
+	}
+	count, byts := int(byts[0]), byts[1:]
+	for i := 0; i < count; i++ {
+		if len(byts) < 2 || len(byts) < 2+int(byts[1]) {
+			return fmt.Errorf("Link specifier truncated")
+		}
+		h.LinkSpecifiers = append(h.LinkSpecifiers,
+			&LinkSpecifier{Type: LinkSpecifierType(byts[0]), Data: byts[2 : 2+int(byts[1])]})
+		byts = byts[2+int(byts[1]):]
+	}
+	return nil
+}
+
+func (h *HSIntroPoint) applyItem(item *Item) (err error) {
+	switch item.Keyword {
+	case "onion-key":
+		if item.Arg(0) == "ntor" {
+			h.OnionKey, err = decodeBase64(item.Arg(1))
+		}
+	case "auth-key":
+		if item.Object == nil {
+			return fmt.Errorf("Missing object")
+		}
+		h.AuthKeyCert, err = ParseEd25519Cert(item.Object.Bytes)
+	case "enc-key":
+		if item.Arg(0) == "ntor" {
+			h.EncKey, err = decodeBase64(item.Arg(1))
+		}
+	case "enc-key-cert":
+		if item.Object == nil {
+			return fmt.Errorf("Missing object")
+		}
+		h.EncKeyCert, err = ParseEd25519Cert(item.Object.Bytes)
+	case "legacy-key":
+		h.LegacyKey, err = parseRSAKeyObject(item)
+	case "legacy-key-cert":
+		if item.Object == nil {
+			return fmt.Errorf("Missing object")
+		}
+		h.LegacyKeyCert = item.Object.Bytes
+	}
+	return
+}
+
+// descriptorCookie finds and decrypts the descriptor cookie for the client.
+func (h *HSDescriptor) descriptorCookie(
+	identity ed25519.PublicKey, first *HSDescriptorFirstLayer, clientAuthKey []byte,
+) ([]byte, error) {
+	if first.AuthType != "x25519" {
+		return nil, fmt.Errorf("Unsupported auth type %v", first.AuthType)
+	}
+	seed, err := curve25519.X25519(clientAuthKey, first.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]byte, 40)
+	shake := sha3.NewShake256()
+	shake.Write(torutil.HSSubcredential(identity, h.BlindedKey()))
+	shake.Write(seed)
+	shake.Read(keys)
+	clientID, cookieKey := keys[:8], keys[8:]
+	for _, client := range first.AuthClients {
+		if subtle.ConstantTimeCompare(client.ClientID, clientID) == 1 {
+			block, err := aes.NewCipher(cookieKey)
+			if err != nil {
+				return nil, err
+			} else if len(client.IV) != aes.BlockSize {
+				return nil, fmt.Errorf("Invalid auth-client IV")
+			}
+			cookie := make([]byte, len(client.EncryptedCookie))
+			cipher.NewCTR(block, client.IV).XORKeyStream(cookie, client.EncryptedCookie)
+			return cookie, nil
+		}
+	}
+	return nil, fmt.Errorf("Client not authorized")
+}
+
+// decryptLayer decrypts and verifies a layer as described in section 2.5.3 of
+// rend-spec-v3.txt. Trailing padding is removed.
+func (h *HSDescriptor) decryptLayer(
+	encrypted []byte, secret []byte, identity ed25519.PublicKey, constant string,
+) (string, error) {
+	const saltLen, macLen = 16, 32
+	if len(encrypted) < saltLen+macLen {
+		return "", fmt.Errorf("Encrypted data too short")
+	}
+	salt, ciphertext := encrypted[:saltLen], encrypted[saltLen:len(encrypted)-macLen]
+	secretKey, iv, macKey := hsDescLayerKeys(secret, torutil.HSSubcredential(identity, h.BlindedKey()),
+		h.RevisionCounter, salt, constant)
+	if subtle.ConstantTimeCompare(hsDescLayerMAC(macKey, salt, ciphertext), encrypted[len(encrypted)-macLen:]) != 1 {
+		return "", fmt.Errorf("Invalid MAC")
+	}
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return "", err
+	}
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plain, ciphertext)
+	return string(bytes.TrimRight(plain, "\x00")), nil
+}
+
+func hsDescLayerKeys(
+	secret []byte, subcredential []byte, revision uint64, salt []byte, constant string,
+) (secretKey, iv, macKey []byte) {
+	keys := make([]byte, 32+16+32)
+	shake := sha3.NewShake256()
+	shake.Write(secret)
+	shake.Write(subcredential)
+	binary.Write(shake, binary.BigEndian, revision)
+	shake.Write(salt)
+	shake.Write([]byte(constant))
+	shake.Read(keys)
+	return keys[:32], keys[32:48], keys[48:]
+}
+
+func hsDescLayerMAC(macKey []byte, salt []byte, ciphertext []byte) []byte {
+	h := sha3.New256()
+	binary.Write(h, binary.BigEndian, uint64(len(macKey)))
+	h.Write(macKey)
+	binary.Write(h, binary.BigEndian, uint64(len(salt)))
+	h.Write(salt)
+	h.Write(ciphertext)
+	return h.Sum(nil)
+}
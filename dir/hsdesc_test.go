@@ -0,0 +1,192 @@
+package dir
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestHSDescriptor(t *testing.T) {
+	identityKey, err := hex.DecodeString(testHSIdentity)
+	require.NoError(t, err)
+	identity := ed25519.PrivateKey(identityKey).KeyPair()
+	address := torutil.OnionServiceIDFromV3PublicKey(identity.PublicKey())
+	// Without client auth
+	raw := buildTestHSDescriptor(t, identity, nil)
+	desc, err := ParseHSDescriptor(raw)
+	require.NoError(t, err)
+	require.Equal(t, 3, desc.Version)
+	require.Equal(t, 3*time.Hour, desc.Lifetime)
+	require.Equal(t, uint64(42), desc.RevisionCounter)
+	require.Equal(t, testHSBlindedKey, strings.ToUpper(hex.EncodeToString(desc.BlindedKey())))
+	require.NoError(t, desc.VerifyBlindedKey(identity.PublicKey(), testHSTimePeriod, torutil.HSTimePeriodLengthDefault))
+	require.EqualError(t, desc.VerifyBlindedKey(identity.PublicKey(), testHSTimePeriod+1,
+		torutil.HSTimePeriodLengthDefault), "Blinded key does not match identity for time period 1235")
+	second, err := desc.Decrypt(address+".onion", nil)
+	require.NoError(t, err)
+	requireTestSecondLayer(t, second)
+	// Wrong address
+	other, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = desc.Decrypt(torutil.OnionServiceIDFromV3PublicKey(other.PublicKey()), nil)
+	require.EqualError(t, err, "Unable to decrypt first layer: Invalid MAC")
+	require.Error(t, desc.VerifyBlindedKey(other.PublicKey(), testHSTimePeriod, torutil.HSTimePeriodLengthDefault))
+	// Tampered signature
+	_, err = ParseHSDescriptor(strings.Replace(raw, "revision-counter 42", "revision-counter 43", 1))
+	require.EqualError(t, err, "Invalid descriptor signature")
+	// With client auth
+	var clientKey [32]byte
+	_, err = rand.Read(clientKey[:])
+	require.NoError(t, err)
+	desc, err = ParseHSDescriptor(buildTestHSDescriptor(t, identity, clientKey[:]))
+	require.NoError(t, err)
+	_, err = desc.Decrypt(address, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "client auth may be required")
+	var wrongKey [32]byte
+	_, err = desc.Decrypt(address, wrongKey[:])
+	require.EqualError(t, err, "Client not authorized")
+	second, err = desc.Decrypt(address, clientKey[:])
+	require.NoError(t, err)
+	requireTestSecondLayer(t, second)
+}
+
+func requireTestSecondLayer(t *testing.T, second *HSDescriptorSecondLayer) {
+	require.Equal(t, []int{2}, second.Create2Formats)
+	require.Len(t, second.IntroPoints, 2)
+	intro := second.IntroPoints[0]
+	require.Len(t, intro.LinkSpecifiers, 3)
+	require.Equal(t, &net.TCPAddr{IP: net.IP{198, 51, 100, 1}, Port: 9001}, intro.LinkSpecifiers[0].Addr())
+	require.Equal(t, "198.51.100.1:9001", intro.LinkSpecifiers[0].String())
+	require.Equal(t, "$0EB7C8AAD759B26D37B857E7080FD2B138B75A1C", intro.LinkSpecifiers[1].String())
+	require.Equal(t, LinkSpecifierEd25519, intro.LinkSpecifiers[2].Type)
+	require.Nil(t, intro.LinkSpecifiers[2].Addr())
+	require.Len(t, intro.OnionKey, 32)
+	require.Len(t, intro.EncKey, 32)
+	require.Equal(t, CertTypeHSSigningIntro, intro.AuthKeyCert.Type)
+	require.Equal(t, CertTypeHSIntroEncKey, intro.EncKeyCert.Type)
+	require.Equal(t, "[2001:db8::1]:443", second.IntroPoints[1].LinkSpecifiers[0].String())
+}
+
+// Keys from test_blinding_basics in Tor's src/test/test_hs_common.c. Tor
+// blinds the identity for time period 1234 of length 1440 to the blinded key.
+const (
+	testHSTimePeriod = 1234
+	testHSIdentity   = "D8C7FF0E31295B66540D789AF3E3DF992038A9592EEA01D8B7CBA06D6E66D159" +
+		"4D6167696320576F7264733A20737065697373636F62616C742062697669756D"
+	testHSBlindedKey = "3A50BF210E8F9EE955AE0014F7A6917FB65EBF098A86305ABB508D1A7291B6D5"
+)
+
+// buildTestHSDescriptor builds a descriptor signed by the identity key blinded
+// for testHSTimePeriod.
+func buildTestHSDescriptor(t *testing.T, identity ed25519.KeyPair, clientAuthKey []byte) string {
+	blinded := ed25519.BlindKeyPair(identity, testHSTimePeriod, torutil.HSTimePeriodLengthDefault)
+	signing, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	expires := time.Now().Add(3 * time.Hour)
+	b64 := base64.StdEncoding.EncodeToString
+	randBytes := func(n int) []byte {
+		ret := make([]byte, n)
+		_, err := rand.Read(ret)
+		require.NoError(t, err)
+		return ret
+	}
+	objectStr := func(typ string, byts []byte) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: byts}))
+	}
+	// Second layer
+	certStr := func(typ Ed25519CertType) string {
+		return objectStr("ED25519 CERT", NewEd25519Cert(typ, expires, randBytes(32), signing).Bytes())
+	}
+	intro1Specs := append([]byte{3, 0, 6, 198, 51, 100, 1, 0x23, 0x29, 2, 20},
+		[]byte("\x0e\xb7\xc8\xaa\xd7\x59\xb2\x6d\x37\xb8\x57\xe7\x08\x0f\xd2\xb1\x38\xb7\x5a\x1c")...)
+	intro1Specs = append(append(intro1Specs, 3, 32), randBytes(32)...)
+	intro2Specs := append(append([]byte{1, 1, 18}, net.ParseIP("2001:db8::1")...), 1, 0xbb)
+	second := "create2-formats 2\n"
+	for _, specs := range [][]byte{intro1Specs, intro2Specs} {
+		second += "introduction-point " + b64(specs) + "\n" +
+			"onion-key ntor " + b64(randBytes(32)) + "\n" +
+			"auth-key\n" + certStr(CertTypeHSSigningIntro) +
+			"enc-key ntor " + b64(randBytes(32)) + "\n" +
+			"enc-key-cert\n" + certStr(CertTypeHSIntroEncKey)
+	}
+	subcredential := torutil.HSSubcredential(identity.PublicKey(), blinded.PublicKey())
+	const revision = 42
+	secret := append([]byte{}, blinded.PublicKey()...)
+	first := "desc-auth-type x25519\n"
+	if clientAuthKey == nil {
+		first += "desc-auth-ephemeral-key " + b64(randBytes(32)) + "\n" +
+			"auth-client " + b64(randBytes(8)) + " " + b64(randBytes(16)) + " " + b64(randBytes(16)) + "\n"
+	} else {
+		ephemeralPriv := randBytes(32)
+		ephemeralPub, err := curve25519.X25519(ephemeralPriv, curve25519.Basepoint)
+		require.NoError(t, err)
+		clientPub, err := curve25519.X25519(clientAuthKey, curve25519.Basepoint)
+		require.NoError(t, err)
+		seed, err := curve25519.X25519(ephemeralPriv, clientPub)
+		require.NoError(t, err)
+		keys := make([]byte, 40)
+		shake := sha3.NewShake256()
+		shake.Write(subcredential)
+		shake.Write(seed)
+		shake.Read(keys)
+		cookie, iv := randBytes(32), randBytes(16)
+		block, err := aes.NewCipher(keys[8:])
+		require.NoError(t, err)
+		encCookie := make([]byte, 32)
+		cipher.NewCTR(block, iv).XORKeyStream(encCookie, cookie)
+		first += "desc-auth-ephemeral-key " + b64(ephemeralPub) + "\n" +
+			"auth-client " + b64(randBytes(8)) + " " + b64(randBytes(16)) + " " + b64(randBytes(32)) + "\n" +
+			"auth-client " + b64(keys[:8]) + " " + b64(iv) + " " + b64(encCookie) + "\n"
+		secret = append(secret, cookie...)
+	}
+	// Encrypt as rend-spec-v3 [HS-DESC-ENCRYPTION-KEYS] describes, not with
+	// the package's own helpers
+	encrypt := func(secret []byte, plain string, constant string) []byte {
+		salt := randBytes(16)
+		keys := make([]byte, 32+16+32)
+		shake := sha3.NewShake256()
+		shake.Write(secret)
+		shake.Write(subcredential)
+		shake.Write([]byte{0, 0, 0, 0, 0, 0, 0, revision})
+		shake.Write(salt)
+		shake.Write([]byte(constant))
+		shake.Read(keys)
+		block, err := aes.NewCipher(keys[:32])
+		require.NoError(t, err)
+		// Pad like Tor does
+		padded := make([]byte, (len(plain)/10000+1)*10000)
+		cipher.NewCTR(block, keys[32:48]).XORKeyStream(padded, append([]byte(plain), make([]byte, len(padded)-len(plain))...))
+		mac := sha3.New256()
+		mac.Write([]byte{0, 0, 0, 0, 0, 0, 0, 32})
+		mac.Write(keys[48:])
+		mac.Write([]byte{0, 0, 0, 0, 0, 0, 0, 16})
+		mac.Write(salt)
+		mac.Write(padded)
+		return mac.Sum(append(salt, padded...))
+	}
+	first += "encrypted\n" + objectStr("MESSAGE", encrypt(secret, second, "hsdir-encrypted-data"))
+	// Outer
+	outer := "hs-descriptor 3\n" +
+		"descriptor-lifetime 180\n" +
+		"descriptor-signing-key-cert\n" +
+		objectStr("ED25519 CERT", NewEd25519Cert(CertTypeHSIdentitySign, expires, signing.PublicKey(), blinded).Bytes()) +
+		"revision-counter 42\n" +
+		"superencrypted\n" +
+		objectStr("MESSAGE", encrypt(blinded.PublicKey(), first, "hsdir-superencrypted-data"))
+	sig := ed25519.Sign(signing, append([]byte("Tor onion service descriptor sig v3"), outer...))
+	return outer + "signature " + base64.RawStdEncoding.EncodeToString(sig) + "\n"
+}
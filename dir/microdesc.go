@@ -0,0 +1,178 @@
+package dir
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// Microdescriptor is a relay microdescriptor. It can be parsed from GETINFO
+// md/id/<fp>, md/all, or the cached-microdescs file.
+type Microdescriptor struct {
+	// Digest is the unpadded base64 SHA-256 of the microdescriptor as
+	// referenced in microdesc consensuses.
+	Digest string
+	// OnionKey is the obsolete TAP key, nil if not present
+	OnionKey     *rsa.PublicKey
+	NtorOnionKey []byte
+	// ORAddresses are the additional addresses, usually IPv6, as host:port
+	ORAddresses []string
+	Family      []string
+	ExitPolicy  *PolicySummary
+	IPv6Policy  *PolicySummary
+	// RSAIdentity is the uppercase hex fingerprint if present
+	RSAIdentity     string
+	Ed25519Identity ed25519.PublicKey
+	// Other has the items not recognized by this parser in order
+	Other []*Item
+}
+
+// ParseMicrodescriptors parses a set of microdescriptors. Annotations are
+// ignored and not included in the digest.
+func ParseMicrodescriptors(raw string) ([]*Microdescriptor, error) {
+	ret := []*Microdescriptor{}
+	for _, chunk := range splitMicrodescriptors(raw) {
+		items, err := ParseItems(chunk)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(chunk))
+		md := &Microdescriptor{Digest: base64.RawStdEncoding.EncodeToString(sum[:])}
+		for _, item := range items {
+			if err = md.applyItem(item); err != nil {
+				return nil, fmt.Errorf("Invalid microdescriptor %v: %v", md.Digest, err)
+			}
+		}
+		ret = append(ret, md)
+	}
+	return ret, nil
+}
+
+// splitMicrodescriptors splits on each "onion-key" line or, for those without
+// TAP keys, on a "ntor-onion-key" line when the current one already has one.
+func splitMicrodescriptors(raw string) []string {
+	raw = strings.Replace(raw, "\r\n", "\n", -1)
+	var ret []string
+	var curr strings.Builder
+	hasNtor := false
+	for _, line := range strings.SplitAfter(raw, "\n") {
+		keyword := line
+		if space := strings.IndexAny(line, " \n"); space >= 0 {
+			keyword = line[:space]
+		}
+		if strings.HasPrefix(keyword, "@") {
+			continue
+		}
+		if keyword == "onion-key" || (keyword == "ntor-onion-key" && hasNtor) {
+			if curr.Len() > 0 {
+				ret = append(ret, curr.String())
+				curr.Reset()
+			}
+			hasNtor = false
+		}
+		hasNtor = hasNtor || keyword == "ntor-onion-key"
+		curr.WriteString(line)
+	}
+	if strings.TrimSpace(curr.String()) != "" {
+		ret = append(ret, curr.String())
+	}
+	return ret
+}
+
+func (m *Microdescriptor) applyItem(item *Item) (err error) {
+	switch item.Keyword {
+	case "onion-key":
+		// Newer Tor versions have the keyword without the key
+		if item.Object != nil {
+			m.OnionKey, err = parseRSAKeyObject(item)
+		}
+	case "ntor-onion-key":
+		m.NtorOnionKey, err = decodeBase64(item.Arg(0))
+	case "a":
+		m.ORAddresses = append(m.ORAddresses, item.Arg(0))
+	case "family":
+		m.Family = item.Args
+	case "p":
+		m.ExitPolicy, err = ParsePolicySummary(item.Args)
+	case "p6":
+		m.IPv6Policy, err = ParsePolicySummary(item.Args)
+	case "id":
+		switch item.Arg(0) {
+		case "rsa1024":
+			m.RSAIdentity, err = fingerprintFromBase64(item.Arg(1))
+		case "ed25519":
+			var key []byte
+			if key, err = decodeBase64(item.Arg(1)); err == nil && len(key) != ed25519.PublicKeySize {
+				err = fmt.Errorf("Invalid ed25519 id length")
+			}
+			m.Ed25519Identity = key
+		default:
+			m.Other = append(m.Other, item)
+		}
+	default:
+		m.Other = append(m.Other, item)
+	}
+	return
+}
+
+// Relay is a router status joined with its microdescriptor.
+type Relay struct {
+	*RouterStatus
+	// Microdescriptor is nil if not known
+	Microdescriptor *Microdescriptor
+}
+
+// RelayLookup finds relays by fingerprint. Create with NewRelayLookup.
+type RelayLookup struct {
+	relays map[string]*Relay
+}
+
+// NewRelayLookup joins the routers of a consensus with the given
+// microdescriptors. For microdesc consensuses they are joined by digest,
+// otherwise they are joined by the RSA identity in the microdescriptor.
+func NewRelayLookup(consensus *NetworkStatus, microdescs []*Microdescriptor) *RelayLookup {
+	byDigest := make(map[string]*Microdescriptor, len(microdescs))
+	byIdentity := make(map[string]*Microdescriptor, len(microdescs))
+	for _, md := range microdescs {
+		byDigest[md.Digest] = md
+		if md.RSAIdentity != "" {
+			byIdentity[md.RSAIdentity] = md
+		}
+	}
+	ret := &RelayLookup{relays: make(map[string]*Relay, len(consensus.Routers))}
+	for _, router := range consensus.Routers {
+		relay := &Relay{RouterStatus: router}
+		if router.MicrodescDigest != "" {
+			relay.Microdescriptor = byDigest[strings.TrimRight(router.MicrodescDigest, "=")]
+		} else {
+			relay.Microdescriptor = byIdentity[router.Fingerprint]
+		}
+		ret.relays[router.Fingerprint] = relay
+	}
+	return ret
+}
+
+// Relay returns the relay for the given ID or nil if not found. The ID is a
+// hex fingerprint optionally prefixed with "$" and optionally suffixed with
+// "~nickname" or "=nickname" as in CircuitEvent.Path.
+func (r *RelayLookup) Relay(id string) *Relay {
+	id = strings.TrimPrefix(id, "$")
+	if end := strings.IndexAny(id, "~="); end >= 0 {
+		id = id[:end]
+	}
+	return r.relays[strings.ToUpper(id)]
+}
+
+// Path returns the relays for each hop of a path such as CircuitEvent.Path.
+// Hops that are not found are nil.
+func (r *RelayLookup) Path(path []string) []*Relay {
+	ret := make([]*Relay, len(path))
+	for i, id := range path {
+		ret[i] = r.Relay(id)
+	}
+	return ret
+}
@@ -0,0 +1,64 @@
+package dir
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMicrodescriptors(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/microdescs")
+	require.NoError(t, err)
+	mds, err := ParseMicrodescriptors(string(raw))
+	require.NoError(t, err)
+	require.Len(t, mds, 2)
+	require.Equal(t, "x//DhGGAoKKyfnISRVvsdGQrPfxwdSU8WrHAhwAOGrs", mds[0].Digest)
+	require.Nil(t, mds[0].OnionKey)
+	require.Len(t, mds[0].NtorOnionKey, 32)
+	require.Equal(t, []string{"[2001:db8::1]:9001"}, mds[0].ORAddresses)
+	require.Equal(t, "0EB7C8AAD759B26D37B857E7080FD2B138B75A1C", mds[0].RSAIdentity)
+	require.Len(t, mds[0].Ed25519Identity, 32)
+	require.Nil(t, mds[0].ExitPolicy)
+	require.True(t, mds[1].ExitPolicy.Allows(1500))
+	require.False(t, mds[1].IPv6Policy.Allows(1500))
+	// Without onion-key lines, they are split on ntor-onion-key
+	mds, err = ParseMicrodescriptors("ntor-onion-key AAAA\nfamily a\nntor-onion-key BBBB\nfamily b\n")
+	require.NoError(t, err)
+	require.Len(t, mds, 2)
+	require.Equal(t, []string{"b"}, mds[1].Family)
+}
+
+func TestRelayLookup(t *testing.T) {
+	consensusRaw, err := ioutil.ReadFile("testdata/consensus-microdesc-relays")
+	require.NoError(t, err)
+	consensus, err := ParseNetworkStatus(string(consensusRaw))
+	require.NoError(t, err)
+	mdsRaw, err := ioutil.ReadFile("testdata/microdescs")
+	require.NoError(t, err)
+	mds, err := ParseMicrodescriptors(string(mdsRaw))
+	require.NoError(t, err)
+	// Joined by digest in microdesc consensuses
+	lookup := NewRelayLookup(consensus, mds)
+	path := lookup.Path([]string{
+		"$0EB7C8AAD759B26D37B857E7080FD2B138B75A1C~relay1",
+		"$BE5088E43972BF9EC05194F4BB685D7502C77DC7=slowpoke",
+		"$c1032c7046ef1d28e5d6d3ee402c21b0036ec52f",
+		"$FFFF",
+	})
+	require.Len(t, path, 4)
+	require.Equal(t, "relay1", path[0].Nickname)
+	require.Equal(t, mds[0], path[0].Microdescriptor)
+	require.Equal(t, "slowpoke", path[1].Nickname)
+	require.Nil(t, path[1].Microdescriptor)
+	require.Equal(t, mds[1], path[2].Microdescriptor)
+	require.True(t, path[2].Microdescriptor.IPv6Policy.Allows(443))
+	require.Nil(t, path[3])
+	// Joined by identity otherwise
+	consensusRaw, err = ioutil.ReadFile("testdata/consensus")
+	require.NoError(t, err)
+	consensus, err = ParseNetworkStatus(string(consensusRaw))
+	require.NoError(t, err)
+	lookup = NewRelayLookup(consensus, mds)
+	require.Equal(t, mds[1], lookup.Relay("C1032C7046EF1D28E5D6D3EE402C21B0036EC52F").Microdescriptor)
+}
@@ -0,0 +1,426 @@
+package dir
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+)
+
+// NetworkStatus is a v3 network status document, either a full ("ns") or
+// microdescriptor ("microdesc") flavored consensus.
+type NetworkStatus struct {
+	Version int
+	// Flavor is "ns" if not present in the document
+	Flavor string
+	// VoteStatus is "consensus" or "vote"
+	VoteStatus      string
+	ConsensusMethod int
+	ValidAfter      time.Time
+	FreshUntil      time.Time
+	ValidUntil      time.Time
+	VoteDelay       time.Duration
+	DistDelay       time.Duration
+	ClientVersions  []string
+	ServerVersions  []string
+	KnownFlags      []string
+
+	RecommendedClientProtocols map[string]string
+	RecommendedRelayProtocols  map[string]string
+	RequiredClientProtocols    map[string]string
+	RequiredRelayProtocols     map[string]string
+
+	Params              map[string]int64
+	SharedRandPrevious  *SharedRandValue
+	SharedRandCurrent   *SharedRandValue
+	Authorities         []*DirAuthority
+	Routers             []*RouterStatus
+	BandwidthWeights    map[string]int64
+	DirectorySignatures []*DirectorySignature
+}
+
+// SharedRandValue is a shared random value in the network status header.
+type SharedRandValue struct {
+	NumReveals int
+	Value      []byte
+}
+
+// DirAuthority is a "dir-source" section of the network status header.
+type DirAuthority struct {
+	Nickname string
+	// Identity is the uppercase hex fingerprint of the authority's identity
+	Identity   string
+	Address    string
+	IP         net.IP
+	DirPort    int
+	ORPort     int
+	Contact    string
+	VoteDigest string
+}
+
+// DirectorySignature is a "directory-signature" in the network status footer.
+type DirectorySignature struct {
+	// Algorithm is "sha1" if not present in the document
+	Algorithm        string
+	Identity         string
+	SigningKeyDigest string
+	Signature        []byte
+}
+
+// RouterStatus is a single router entry in a network status document. It is
+// also the result of GETINFO ns/id/<fp> and similar.
+type RouterStatus struct {
+	Nickname string
+	// Fingerprint is the uppercase hex of the relay identity digest
+	Fingerprint string
+	// Digest is the uppercase hex of the server descriptor digest. This is
+	// empty in microdesc consensuses.
+	Digest    string
+	Published time.Time
+	Address   net.IP
+	ORPort    int
+	DirPort   int
+	// ORAddresses are the additional "a" addresses, usually IPv6, as host:port
+	ORAddresses []string
+	Flags       []string
+	// Version is the full "v" line value, e.g. "Tor 0.4.8.9"
+	Version   string
+	Protocols map[string]string
+	// Bandwidth is in kilobytes per second
+	Bandwidth int64
+	// Measured is the measured bandwidth or -1 if not present
+	Measured   int64
+	Unmeasured bool
+	ExitPolicy *PolicySummary
+	// MicrodescDigest is the base64 of the microdescriptor digest, only set in
+	// microdesc consensuses.
+	MicrodescDigest string
+}
+
+// Flags known by Tor in network status documents.
+const (
+	FlagAuthority     = "Authority"
+	FlagBadExit       = "BadExit"
+	FlagExit          = "Exit"
+	FlagFast          = "Fast"
+	FlagGuard         = "Guard"
+	FlagHSDir         = "HSDir"
+	FlagMiddleOnly    = "MiddleOnly"
+	FlagNoEdConsensus = "NoEdConsensus"
+	FlagRunning       = "Running"
+	FlagStable        = "Stable"
+	FlagStaleDesc     = "StaleDesc"
+	FlagSybil         = "Sybil"
+	FlagV2Dir         = "V2Dir"
+	FlagValid         = "Valid"
+)
+
+// HasFlags returns true if the router has all of the given flags.
+func (r *RouterStatus) HasFlags(flags ...string) bool {
+	for _, flag := range flags {
+		found := false
+		for _, have := range r.Flags {
+			if have == flag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// RoutersWithFlags returns routers that have all of the given flags.
+func (n *NetworkStatus) RoutersWithFlags(flags ...string) []*RouterStatus {
+	ret := []*RouterStatus{}
+	for _, router := range n.Routers {
+		if router.HasFlags(flags...) {
+			ret = append(ret, router)
+		}
+	}
+	return ret
+}
+
+// Router returns the router for the given hex fingerprint, with or without
+// the "$" prefix, or nil if not present.
+func (n *NetworkStatus) Router(fingerprint string) *RouterStatus {
+	fingerprint = strings.ToUpper(strings.TrimPrefix(fingerprint, "$"))
+	for _, router := range n.Routers {
+		if router.Fingerprint == fingerprint {
+			return router
+		}
+	}
+	return nil
+}
+
+// HSTimePeriod returns the onion service time period number and length in
+// minutes for this consensus, based on its valid-after time, voting interval,
+// and "hsdir-interval" parameter.
+func (n *NetworkStatus) HSTimePeriod() (num uint64, length uint64) {
+	length = torutil.HSTimePeriodLength(n.Params["hsdir-interval"])
+	num = torutil.HSTimePeriodNum(n.ValidAfter, n.FreshUntil.Sub(n.ValidAfter), length)
+	return
+}
+
+// ParseNetworkStatus parses a full network status document such as the
+// contents of cached-consensus or cached-microdesc-consensus.
+func ParseNetworkStatus(raw string) (*NetworkStatus, error) {
+	items, err := ParseItems(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 || items[0].Keyword != "network-status-version" {
+		return nil, fmt.Errorf("Missing network-status-version")
+	}
+	ret := &NetworkStatus{Flavor: "ns"}
+	var router *RouterStatus
+	footer := false
+	for _, item := range items {
+		switch {
+		case item.Keyword == "r":
+			if footer {
+				return nil, fmt.Errorf("Unexpected router in footer")
+			}
+			if router, err = parseRouterStatusLine(item); err != nil {
+				return nil, err
+			}
+			ret.Routers = append(ret.Routers, router)
+		case item.Keyword == "directory-footer":
+			footer, router = true, nil
+		case router != nil && !footer && isRouterStatusKeyword(item.Keyword):
+			err = router.applyItem(item)
+		case item.Keyword == "bandwidth-weights" || item.Keyword == "directory-signature":
+			// Older documents have no directory-footer
+			footer, router = true, nil
+			err = ret.applyFooterItem(item)
+		case footer:
+			err = ret.applyFooterItem(item)
+		case router == nil:
+			err = ret.applyHeaderItem(item)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// ParseRouterStatuses parses router status entries without a document header
+// or footer, such as the results of GETINFO ns/all or ns/id/<fp>.
+func ParseRouterStatuses(raw string) ([]*RouterStatus, error) {
+	items, err := ParseItems(raw)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*RouterStatus{}
+	var router *RouterStatus
+	for _, item := range items {
+		if item.Keyword == "r" {
+			if router, err = parseRouterStatusLine(item); err != nil {
+				return nil, err
+			}
+			ret = append(ret, router)
+		} else if router == nil {
+			return nil, fmt.Errorf("Expected r line, got %v", item.Keyword)
+		} else if err = router.applyItem(item); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (n *NetworkStatus) applyHeaderItem(item *Item) (err error) {
+	switch item.Keyword {
+	case "network-status-version":
+		if n.Version, err = strconv.Atoi(item.Arg(0)); err != nil {
+			return fmt.Errorf("Invalid network-status-version: %v", item.Arg(0))
+		}
+		if len(item.Args) > 1 {
+			n.Flavor = item.Args[1]
+		}
+	case "vote-status":
+		n.VoteStatus = item.Arg(0)
+	case "consensus-method":
+		if n.ConsensusMethod, err = strconv.Atoi(item.Arg(0)); err != nil {
+			return fmt.Errorf("Invalid consensus-method: %v", item.Arg(0))
+		}
+	case "valid-after":
+		n.ValidAfter, err = parseItemTime(item, 0)
+	case "fresh-until":
+		n.FreshUntil, err = parseItemTime(item, 0)
+	case "valid-until":
+		n.ValidUntil, err = parseItemTime(item, 0)
+	case "voting-delay":
+		vote, voteErr := strconv.Atoi(item.Arg(0))
+		dist, distErr := strconv.Atoi(item.Arg(1))
+		if voteErr != nil || distErr != nil {
+			return fmt.Errorf("Invalid voting-delay: %v", strings.Join(item.Args, " "))
+		}
+		n.VoteDelay, n.DistDelay = time.Duration(vote)*time.Second, time.Duration(dist)*time.Second
+	case "client-versions":
+		n.ClientVersions = splitCommaList(item.Arg(0))
+	case "server-versions":
+		n.ServerVersions = splitCommaList(item.Arg(0))
+	case "known-flags":
+		n.KnownFlags = item.Args
+	case "recommended-client-protocols":
+		n.RecommendedClientProtocols = parseStringArgs(item.Args)
+	case "recommended-relay-protocols":
+		n.RecommendedRelayProtocols = parseStringArgs(item.Args)
+	case "required-client-protocols":
+		n.RequiredClientProtocols = parseStringArgs(item.Args)
+	case "required-relay-protocols":
+		n.RequiredRelayProtocols = parseStringArgs(item.Args)
+	case "params":
+		n.Params, err = parseIntArgs(item, item.Args)
+	case "shared-rand-previous-value":
+		n.SharedRandPrevious, err = parseSharedRandValue(item)
+	case "shared-rand-current-value":
+		n.SharedRandCurrent, err = parseSharedRandValue(item)
+	case "dir-source":
+		if len(item.Args) < 6 {
+			return fmt.Errorf("Invalid dir-source: %v", strings.Join(item.Args, " "))
+		}
+		auth := &DirAuthority{
+			Nickname: item.Args[0],
+			Identity: strings.ToUpper(item.Args[1]),
+			Address:  item.Args[2],
+			IP:       net.ParseIP(item.Args[3]),
+		}
+		var dirErr, orErr error
+		auth.DirPort, dirErr = strconv.Atoi(item.Args[4])
+		auth.ORPort, orErr = strconv.Atoi(item.Args[5])
+		if auth.IP == nil || dirErr != nil || orErr != nil {
+			return fmt.Errorf("Invalid dir-source: %v", strings.Join(item.Args, " "))
+		}
+		n.Authorities = append(n.Authorities, auth)
+	case "contact", "vote-digest":
+		if len(n.Authorities) == 0 {
+			return fmt.Errorf("Unexpected %v before dir-source", item.Keyword)
+		}
+		auth := n.Authorities[len(n.Authorities)-1]
+		if item.Keyword == "contact" {
+			auth.Contact = strings.Join(item.Args, " ")
+		} else {
+			auth.VoteDigest = strings.ToUpper(item.Arg(0))
+		}
+	}
+	return
+}
+
+func (n *NetworkStatus) applyFooterItem(item *Item) (err error) {
+	switch item.Keyword {
+	case "bandwidth-weights":
+		n.BandwidthWeights, err = parseIntArgs(item, item.Args)
+	case "directory-signature":
+		sig := &DirectorySignature{Algorithm: "sha1"}
+		args := item.Args
+		if len(args) == 3 {
+			sig.Algorithm, args = args[0], args[1:]
+		}
+		if len(args) != 2 || item.Object == nil {
+			return fmt.Errorf("Invalid directory-signature: %v", strings.Join(item.Args, " "))
+		}
+		sig.Identity, sig.SigningKeyDigest = strings.ToUpper(args[0]), strings.ToUpper(args[1])
+		sig.Signature = item.Object.Bytes
+		n.DirectorySignatures = append(n.DirectorySignatures, sig)
+	}
+	return
+}
+
+func parseSharedRandValue(item *Item) (*SharedRandValue, error) {
+	ret := &SharedRandValue{}
+	var err error
+	if ret.NumReveals, err = strconv.Atoi(item.Arg(0)); err == nil {
+		ret.Value, err = decodeBase64(item.Arg(1))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v: %v", item.Keyword, strings.Join(item.Args, " "))
+	}
+	return ret, nil
+}
+
+func isRouterStatusKeyword(keyword string) bool {
+	switch keyword {
+	case "a", "s", "v", "pr", "w", "p", "m", "id", "stats":
+		return true
+	}
+	return false
+}
+
+func parseRouterStatusLine(item *Item) (*RouterStatus, error) {
+	// The full flavor has a descriptor digest, microdesc does not
+	args := item.Args
+	if len(args) != 7 && len(args) != 8 {
+		return nil, fmt.Errorf("Invalid r line: %v", strings.Join(args, " "))
+	}
+	ret := &RouterStatus{Nickname: args[0], Measured: -1}
+	var err error
+	if ret.Fingerprint, err = fingerprintFromBase64(args[1]); err != nil {
+		return nil, fmt.Errorf("Invalid identity for %v: %v", ret.Nickname, err)
+	}
+	timeIndex := 2
+	if len(args) == 8 {
+		if ret.Digest, err = fingerprintFromBase64(args[2]); err != nil {
+			return nil, fmt.Errorf("Invalid digest for %v: %v", ret.Nickname, err)
+		}
+		timeIndex = 3
+	}
+	if ret.Published, err = parseItemTime(item, timeIndex); err != nil {
+		return nil, err
+	}
+	rest := args[timeIndex+2:]
+	if ret.Address = net.ParseIP(rest[0]); ret.Address == nil {
+		return nil, fmt.Errorf("Invalid address for %v: %v", ret.Nickname, rest[0])
+	}
+	var orErr, dirErr error
+	ret.ORPort, orErr = strconv.Atoi(rest[1])
+	ret.DirPort, dirErr = strconv.Atoi(rest[2])
+	if orErr != nil || dirErr != nil {
+		return nil, fmt.Errorf("Invalid ports for %v: %v %v", ret.Nickname, rest[1], rest[2])
+	}
+	return ret, nil
+}
+
+func (r *RouterStatus) applyItem(item *Item) (err error) {
+	switch item.Keyword {
+	case "a":
+		r.ORAddresses = append(r.ORAddresses, item.Arg(0))
+	case "s":
+		r.Flags = item.Args
+	case "v":
+		r.Version = strings.Join(item.Args, " ")
+	case "pr":
+		r.Protocols = parseStringArgs(item.Args)
+	case "w":
+		var vals map[string]int64
+		if vals, err = parseIntArgs(item, item.Args); err != nil {
+			return
+		}
+		r.Bandwidth = vals["Bandwidth"]
+		if measured, ok := vals["Measured"]; ok {
+			r.Measured = measured
+		}
+		r.Unmeasured = vals["Unmeasured"] == 1
+	case "p":
+		r.ExitPolicy, err = ParsePolicySummary(item.Args)
+	case "m":
+		// Votes have methods before the digest, consensuses only have digest
+		if len(item.Args) == 1 {
+			r.MicrodescDigest = item.Args[0]
+		}
+	}
+	return
+}
+
+func splitCommaList(str string) []string {
+	if str == "" {
+		return nil
+	}
+	return strings.Split(str, ",")
+}
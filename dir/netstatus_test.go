@@ -0,0 +1,126 @@
+package dir
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNetworkStatus(t *testing.T) {
+	for _, flavor := range []string{"ns", "microdesc"} {
+		t.Run(flavor, func(t *testing.T) {
+			file := "testdata/consensus"
+			if flavor == "microdesc" {
+				file += "-microdesc"
+			}
+			raw, err := ioutil.ReadFile(file)
+			require.NoError(t, err)
+			ns, err := ParseNetworkStatus(string(raw))
+			require.NoError(t, err)
+			// Header
+			require.Equal(t, 3, ns.Version)
+			require.Equal(t, flavor, ns.Flavor)
+			require.Equal(t, "consensus", ns.VoteStatus)
+			require.Equal(t, 33, ns.ConsensusMethod)
+			require.Equal(t, time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC), ns.ValidAfter)
+			require.Equal(t, time.Date(2023, 6, 1, 15, 0, 0, 0, time.UTC), ns.ValidUntil)
+			require.Equal(t, 5*time.Minute, ns.VoteDelay)
+			require.Equal(t, []string{"0.4.7.13", "0.4.8.1-alpha"}, ns.ClientVersions)
+			require.Contains(t, ns.KnownFlags, FlagHSDir)
+			require.Equal(t, "2", ns.RequiredClientProtocols["Cons"])
+			require.Equal(t, int64(10000), ns.Params["bwweightscale"])
+			require.Equal(t, 9, ns.SharedRandCurrent.NumReveals)
+			require.Len(t, ns.SharedRandCurrent.Value, 32)
+			// Valid after is exactly the start of a time period
+			periodNum, periodLength := ns.HSTimePeriod()
+			require.Equal(t, uint64(19509), periodNum)
+			require.Equal(t, uint64(1440), periodLength)
+			require.Len(t, ns.Authorities, 2)
+			require.Equal(t, &DirAuthority{
+				Nickname:   "tor26",
+				Identity:   "78D230179101CDD677736E5EE1593B7B12E91C12",
+				Address:    "86.59.21.38",
+				IP:         net.ParseIP("86.59.21.38"),
+				DirPort:    80,
+				ORPort:     443,
+				Contact:    "Peter Palfrader",
+				VoteDigest: "A1047EAB1035D58682A53557E0B2A75EDBFD15FD",
+			}, ns.Authorities[1])
+			// Routers
+			require.Len(t, ns.Routers, 3)
+			relay := ns.Router("$0eb7c8aad759b26d37b857e7080fd2b138b75a1c")
+			require.NotNil(t, relay)
+			require.Equal(t, "relay1", relay.Nickname)
+			require.Equal(t, net.ParseIP("198.51.100.1"), relay.Address)
+			require.Equal(t, 9001, relay.ORPort)
+			require.Equal(t, []string{"[2001:db8::1]:9001"}, relay.ORAddresses)
+			require.Equal(t, "Tor 0.4.8.9", relay.Version)
+			require.Equal(t, "1-5", relay.Protocols["Link"])
+			require.Equal(t, int64(5000), relay.Bandwidth)
+			require.Equal(t, int64(4800), relay.Measured)
+			exit := ns.Routers[1]
+			require.Equal(t, int64(-1), exit.Measured)
+			require.True(t, ns.Routers[2].Unmeasured)
+			if flavor == "ns" {
+				require.Len(t, relay.Digest, 40)
+				require.Empty(t, relay.MicrodescDigest)
+				require.False(t, relay.ExitPolicy.Allows(80))
+				require.True(t, exit.ExitPolicy.Allows(443))
+				require.True(t, exit.ExitPolicy.Allows(1500))
+				require.False(t, exit.ExitPolicy.Allows(22))
+				require.Equal(t, "accept 80,443,1000-2000", exit.ExitPolicy.String())
+			} else {
+				require.Empty(t, relay.Digest)
+				require.Equal(t, "S11bDkxNJeyI+wKj0NV8hOoWVZi5UHb/pn00pd4T89A", relay.MicrodescDigest)
+				require.Nil(t, relay.ExitPolicy)
+			}
+			// Selection
+			require.Equal(t, []*RouterStatus{relay}, ns.RoutersWithFlags(FlagGuard, FlagStable))
+			require.Len(t, ns.RoutersWithFlags(FlagRunning), 3)
+			require.Empty(t, ns.RoutersWithFlags(FlagBadExit))
+			// Footer
+			require.Equal(t, int64(5797), ns.BandwidthWeights["Wgg"])
+			require.Len(t, ns.DirectorySignatures, 2)
+			require.Equal(t, "sha256", ns.DirectorySignatures[0].Algorithm)
+			require.Equal(t, "sha1", ns.DirectorySignatures[1].Algorithm)
+			require.Len(t, ns.DirectorySignatures[1].Signature, 128)
+		})
+	}
+}
+
+func TestParseRouterStatuses(t *testing.T) {
+	// As returned by GETINFO ns/id/<fp>
+	routers, err := ParseRouterStatuses(
+		"r exit1 wQMscEbvHSjl1tPuQCwhsANuxS8 Dg4aEx1Bpv4LtE/4GvA1N12Q+/I 2023-06-01 11:33:21 203.0.113.5 443 80\n" +
+			"s Exit Fast Running Stable Valid\n" +
+			"w Bandwidth=12000\n" +
+			"p accept 80,443\n")
+	require.NoError(t, err)
+	require.Len(t, routers, 1)
+	require.Equal(t, "C1032C7046EF1D28E5D6D3EE402C21B0036EC52F", routers[0].Fingerprint)
+	require.True(t, routers[0].HasFlags(FlagExit, FlagFast))
+	require.False(t, routers[0].HasFlags(FlagExit, FlagGuard))
+	// Errors
+	_, err = ParseRouterStatuses("s Exit\n")
+	require.Error(t, err)
+	_, err = ParseRouterStatuses("r exit1 wQMscEbvHSjl1tPuQCwhsANuxS8 2023-06-01 11:33:21 nope 443 80\n")
+	require.EqualError(t, err, "Invalid address for exit1: nope")
+}
+
+func TestParseItems(t *testing.T) {
+	raw := "opt foo a b\r\n\nbar\n-----BEGIN THING-----\nAQID\n-----END THING-----\n"
+	items, err := ParseItems(raw)
+	require.NoError(t, err)
+	require.Equal(t, []*Item{
+		{Keyword: "foo", Args: []string{"a", "b"}},
+		{Keyword: "bar", Args: []string{}, Object: &Object{Type: "THING", Bytes: []byte{1, 2, 3}}},
+	}, items)
+	require.Equal(t, "bar\n-----BEGIN THING-----\nAQID\n-----END THING-----\n", items[1].String())
+	_, err = ParseItems("-----BEGIN THING-----\nAQID\n-----END THING-----\n")
+	require.Error(t, err)
+	_, err = ParseItems("foo\n-----BEGIN THING-----\nAQID\n")
+	require.Error(t, err)
+}
@@ -0,0 +1,212 @@
+package dir
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/torutil"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses a single port or a "min-max" range.
+func ParsePortRange(str string) (PortRange, error) {
+	minStr, maxStr := str, str
+	if dash := strings.IndexByte(str, '-'); dash >= 0 {
+		minStr, maxStr = str[:dash], str[dash+1:]
+	}
+	min, minErr := strconv.Atoi(minStr)
+	max, maxErr := strconv.Atoi(maxStr)
+	if minErr != nil || maxErr != nil || min < 0 || max > 65535 || min > max {
+		return PortRange{}, fmt.Errorf("Invalid port range: %v", str)
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+// Contains returns true if the port is in the range.
+func (p PortRange) Contains(port int) bool { return port >= p.Min && port <= p.Max }
+
+// String returns the port or "min-max" range.
+func (p PortRange) String() string {
+	if p.Min == p.Max {
+		return strconv.Itoa(p.Min)
+	}
+	return strconv.Itoa(p.Min) + "-" + strconv.Itoa(p.Max)
+}
+
+// PolicySummary is an exit policy summary as used in "p" and "p6" lines of
+// network status documents and microdescriptors. It is a list of ports that
+// are either all accepted or all rejected.
+type PolicySummary struct {
+	Accept bool
+	Ports  []PortRange
+}
+
+// ParsePolicySummary parses a policy summary from its two args, e.g. "accept"
+// and "80,443,1000-2000".
+func ParsePolicySummary(args []string) (*PolicySummary, error) {
+	if len(args) != 2 || (args[0] != "accept" && args[0] != "reject") {
+		return nil, fmt.Errorf("Invalid policy summary: %v", strings.Join(args, " "))
+	}
+	ret := &PolicySummary{Accept: args[0] == "accept"}
+	for _, portStr := range strings.Split(args[1], ",") {
+		port, err := ParsePortRange(portStr)
+		if err != nil {
+			return nil, err
+		}
+		ret.Ports = append(ret.Ports, port)
+	}
+	return ret, nil
+}
+
+// Allows returns true if the summary allows exiting to the given port.
+func (p *PolicySummary) Allows(port int) bool {
+	for _, portRange := range p.Ports {
+		if portRange.Contains(port) {
+			return p.Accept
+		}
+	}
+	return !p.Accept
+}
+
+// String returns the summary as it appears after the keyword.
+func (p *PolicySummary) String() string {
+	ports := make([]string, len(p.Ports))
+	for i, port := range p.Ports {
+		ports[i] = port.String()
+	}
+	if p.Accept {
+		return "accept " + strings.Join(ports, ",")
+	}
+	return "reject " + strings.Join(ports, ",")
+}
+
+// ExitPolicyRule is a single accept or reject line of a full exit policy as
+// used in server descriptors.
+type ExitPolicyRule struct {
+	Accept bool
+	// Address is "*", "*4", "*6", or an IP with an optional mask. IPv6
+	// addresses are in brackets.
+	Address string
+	Ports   PortRange
+}
+
+// ParseExitPolicyRule parses a rule like "accept 1.2.3.0/24:80-443" or
+// "reject *:*". The "accept6" and "reject6" forms are not supported.
+func ParseExitPolicyRule(str string) (*ExitPolicyRule, error) {
+	fields := strings.Fields(str)
+	if len(fields) != 2 || (fields[0] != "accept" && fields[0] != "reject") {
+		return nil, fmt.Errorf("Invalid exit policy rule: %v", str)
+	}
+	ret := &ExitPolicyRule{Accept: fields[0] == "accept"}
+	colon := strings.LastIndexByte(fields[1], ':')
+	if colon == -1 {
+		return nil, fmt.Errorf("Invalid exit policy rule: %v", str)
+	}
+	ret.Address = fields[1][:colon]
+	if _, _, err := ret.network(); err != nil {
+		return nil, err
+	}
+	if portStr := fields[1][colon+1:]; portStr == "*" {
+		ret.Ports = PortRange{Min: 1, Max: 65535}
+	} else {
+		var err error
+		if ret.Ports, err = ParsePortRange(portStr); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// network returns the IP network of the address or nil for any. If the
+// network is nil, the int is 4 or 6 if only that family matches, 0 otherwise.
+func (e *ExitPolicyRule) network() (*net.IPNet, int, error) {
+	switch e.Address {
+	case "*":
+		return nil, 0, nil
+	case "*4":
+		return nil, 4, nil
+	case "*6":
+		return nil, 6, nil
+	}
+	ipStr, maskStr, hasMask := torutil.PartitionString(e.Address, '/')
+	bits := 32
+	if strings.HasPrefix(ipStr, "[") && strings.HasSuffix(ipStr, "]") {
+		ipStr, bits = ipStr[1:len(ipStr)-1], 128
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil || (bits == 32) != (ip.To4() != nil) {
+		return nil, 0, fmt.Errorf("Invalid exit policy address: %v", e.Address)
+	}
+	ret := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	if bits == 32 {
+		ret.IP = ip.To4()
+	}
+	if hasMask {
+		if maskIP := net.ParseIP(maskStr); maskIP != nil && maskIP.To4() != nil && bits == 32 {
+			ret.Mask = net.IPMask(maskIP.To4())
+		} else if maskBits, err := strconv.Atoi(maskStr); err == nil && maskBits >= 0 && maskBits <= bits {
+			ret.Mask = net.CIDRMask(maskBits, bits)
+		} else {
+			return nil, 0, fmt.Errorf("Invalid exit policy address: %v", e.Address)
+		}
+	}
+	return ret, 0, nil
+}
+
+// Matches returns true if the rule applies to the given IP and port. A nil IP
+// matches only rules for any address.
+func (e *ExitPolicyRule) Matches(ip net.IP, port int) bool {
+	if !e.Ports.Contains(port) {
+		return false
+	}
+	network, family, err := e.network()
+	if err != nil {
+		return false
+	} else if network != nil {
+		return ip != nil && network.Contains(ip)
+	}
+	switch family {
+	case 4:
+		return ip == nil || ip.To4() != nil
+	case 6:
+		return ip == nil || ip.To4() == nil
+	}
+	return true
+}
+
+// String returns the rule as it appears in a descriptor.
+func (e *ExitPolicyRule) String() string {
+	ports := e.Ports.String()
+	if e.Ports.Min == 1 && e.Ports.Max == 65535 {
+		ports = "*"
+	}
+	if e.Accept {
+		return "accept " + e.Address + ":" + ports
+	}
+	return "reject " + e.Address + ":" + ports
+}
+
+// ExitPolicy is a full exit policy as a list of rules. The first matching
+// rule applies.
+type ExitPolicy []*ExitPolicyRule
+
+// Allows returns true if the policy allows exiting to the IP and port. If the
+// IP is nil, this returns true if any address might be allowed for the port.
+// Policies without a matching rule accept.
+func (e ExitPolicy) Allows(ip net.IP, port int) bool {
+	for _, rule := range e {
+		if ip == nil && rule.Accept && rule.Ports.Contains(port) {
+			return true
+		} else if rule.Matches(ip, port) {
+			return rule.Accept
+		}
+	}
+	return true
+}
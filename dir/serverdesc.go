@@ -0,0 +1,333 @@
+package dir
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// ServerDescriptor is a relay server descriptor. It can be parsed from
+// GETINFO desc/id/<fp>, desc/all-recent, or the cached-descriptors file.
+type ServerDescriptor struct {
+	Nickname  string
+	Address   net.IP
+	ORPort    int
+	SOCKSPort int
+	DirPort   int
+	// IdentityCert is the identity-ed25519 cert, nil if not present
+	IdentityCert *Ed25519Cert
+	MasterKey    ed25519.PublicKey
+	// ORAddresses are the additional addresses, usually IPv6, as host:port
+	ORAddresses []string
+	Platform    string
+	Protocols   map[string]string
+	Published   time.Time
+	// Fingerprint is the uppercase hex fingerprint without spaces
+	Fingerprint string
+	Hibernating bool
+	// Uptime is -1 if not present
+	Uptime time.Duration
+	// Bandwidths are in bytes per second
+	BandwidthAvg      int64
+	BandwidthBurst    int64
+	BandwidthObserved int64
+	// ExtraInfoDigest is the uppercase hex SHA-1 of the extra-info descriptor
+	ExtraInfoDigest string
+	// ExtraInfoDigestSHA256 is the unpadded base64 SHA-256 of the extra-info
+	// descriptor
+	ExtraInfoDigestSHA256 string
+	CachesExtraInfo       bool
+	// OnionKey is the obsolete TAP key, nil if not present
+	OnionKey          *rsa.PublicKey
+	SigningKey        *rsa.PublicKey
+	OnionKeyCrosscert []byte
+	NtorOnionKey      []byte
+	// NtorOnionKeyCrosscertSign is the sign bit of the ntor-onion-key-crosscert
+	NtorOnionKeyCrosscertSign int
+	NtorOnionKeyCrosscert     *Ed25519Cert
+	HiddenServiceDir          bool
+	// Family has the fingerprints (with "$" prefix) or nicknames of the family
+	Family              []string
+	Contact             string
+	ExitPolicy          ExitPolicy
+	IPv6Policy          *PolicySummary
+	TunnelledDirServer  bool
+	AllowSingleHopExits bool
+	// Other has the items not recognized by this parser in order
+	Other            []*Item
+	RouterSigEd25519 []byte
+	RouterSignature  []byte
+}
+
+// ParseServerDescriptor parses a single server descriptor.
+func ParseServerDescriptor(raw string) (*ServerDescriptor, error) {
+	descs, err := ParseServerDescriptors(raw)
+	if err != nil {
+		return nil, err
+	} else if len(descs) != 1 {
+		return nil, fmt.Errorf("Expected 1 descriptor, got %v", len(descs))
+	}
+	return descs[0], nil
+}
+
+// ParseServerDescriptors parses a set of server descriptors. Annotations, i.e.
+// the lines starting with "@" in cached-descriptors, are ignored.
+func ParseServerDescriptors(raw string) ([]*ServerDescriptor, error) {
+	items, err := ParseItems(raw)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*ServerDescriptor{}
+	var desc *ServerDescriptor
+	for _, item := range items {
+		if strings.HasPrefix(item.Keyword, "@") {
+			continue
+		} else if item.Keyword == "router" {
+			if desc, err = parseRouterLine(item); err != nil {
+				return nil, err
+			}
+			ret = append(ret, desc)
+		} else if desc == nil {
+			return nil, fmt.Errorf("Expected router line, got %v", item.Keyword)
+		} else if err = desc.applyItem(item); err != nil {
+			return nil, fmt.Errorf("Invalid descriptor for %v: %v", desc.Nickname, err)
+		}
+	}
+	return ret, nil
+}
+
+func parseRouterLine(item *Item) (*ServerDescriptor, error) {
+	if len(item.Args) != 5 {
+		return nil, fmt.Errorf("Invalid router line: %v", strings.Join(item.Args, " "))
+	}
+	ret := &ServerDescriptor{Nickname: item.Args[0], Address: net.ParseIP(item.Args[1]), Uptime: -1}
+	var orErr, socksErr, dirErr error
+	ret.ORPort, orErr = strconv.Atoi(item.Args[2])
+	ret.SOCKSPort, socksErr = strconv.Atoi(item.Args[3])
+	ret.DirPort, dirErr = strconv.Atoi(item.Args[4])
+	if ret.Address == nil || orErr != nil || socksErr != nil || dirErr != nil {
+		return nil, fmt.Errorf("Invalid router line: %v", strings.Join(item.Args, " "))
+	}
+	return ret, nil
+}
+
+func (s *ServerDescriptor) applyItem(item *Item) (err error) {
+	switch item.Keyword {
+	case "identity-ed25519":
+		if item.Object == nil {
+			return fmt.Errorf("Missing identity-ed25519 cert")
+		}
+		s.IdentityCert, err = ParseEd25519Cert(item.Object.Bytes)
+	case "master-key-ed25519":
+		var key []byte
+		if key, err = decodeBase64(item.Arg(0)); err == nil && len(key) != ed25519.PublicKeySize {
+			err = fmt.Errorf("Invalid master-key-ed25519 length")
+		}
+		s.MasterKey = key
+	case "or-address":
+		s.ORAddresses = append(s.ORAddresses, item.Arg(0))
+	case "platform":
+		s.Platform = strings.Join(item.Args, " ")
+	case "proto":
+		s.Protocols = parseStringArgs(item.Args)
+	case "published":
+		s.Published, err = parseItemTime(item, 0)
+	case "fingerprint":
+		s.Fingerprint = strings.Join(item.Args, "")
+	case "hibernating":
+		s.Hibernating = item.Arg(0) == "1"
+	case "uptime":
+		var secs int64
+		if secs, err = strconv.ParseInt(item.Arg(0), 10, 64); err != nil {
+			return fmt.Errorf("Invalid uptime: %v", item.Arg(0))
+		}
+		s.Uptime = time.Duration(secs) * time.Second
+	case "bandwidth":
+		vals := make([]int64, 3)
+		for i := range vals {
+			if vals[i], err = strconv.ParseInt(item.Arg(i), 10, 64); err != nil {
+				return fmt.Errorf("Invalid bandwidth: %v", strings.Join(item.Args, " "))
+			}
+		}
+		s.BandwidthAvg, s.BandwidthBurst, s.BandwidthObserved = vals[0], vals[1], vals[2]
+	case "extra-info-digest":
+		s.ExtraInfoDigest, s.ExtraInfoDigestSHA256 = item.Arg(0), item.Arg(1)
+	case "caches-extra-info":
+		s.CachesExtraInfo = true
+	case "onion-key":
+		s.OnionKey, err = parseRSAKeyObject(item)
+	case "signing-key":
+		s.SigningKey, err = parseRSAKeyObject(item)
+	case "onion-key-crosscert":
+		if item.Object == nil {
+			return fmt.Errorf("Missing onion-key-crosscert object")
+		}
+		s.OnionKeyCrosscert = item.Object.Bytes
+	case "ntor-onion-key":
+		s.NtorOnionKey, err = decodeBase64(item.Arg(0))
+	case "ntor-onion-key-crosscert":
+		if item.Object == nil {
+			return fmt.Errorf("Missing ntor-onion-key-crosscert object")
+		} else if s.NtorOnionKeyCrosscertSign, err = strconv.Atoi(item.Arg(0)); err != nil {
+			return fmt.Errorf("Invalid ntor-onion-key-crosscert sign: %v", item.Arg(0))
+		}
+		s.NtorOnionKeyCrosscert, err = ParseEd25519Cert(item.Object.Bytes)
+	case "hidden-service-dir":
+		s.HiddenServiceDir = true
+	case "family":
+		s.Family = item.Args
+	case "contact":
+		s.Contact = strings.Join(item.Args, " ")
+	case "accept", "reject":
+		var rule *ExitPolicyRule
+		if rule, err = ParseExitPolicyRule(item.Keyword + " " + strings.Join(item.Args, " ")); err == nil {
+			s.ExitPolicy = append(s.ExitPolicy, rule)
+		}
+	case "ipv6-policy":
+		s.IPv6Policy, err = ParsePolicySummary(item.Args)
+	case "tunnelled-dir-server":
+		s.TunnelledDirServer = true
+	case "allow-single-hop-exits":
+		s.AllowSingleHopExits = true
+	case "router-sig-ed25519":
+		s.RouterSigEd25519, err = decodeBase64(item.Arg(0))
+	case "router-signature":
+		if item.Object == nil {
+			return fmt.Errorf("Missing router-signature object")
+		}
+		s.RouterSignature = item.Object.Bytes
+	default:
+		s.Other = append(s.Other, item)
+	}
+	return
+}
+
+func parseRSAKeyObject(item *Item) (*rsa.PublicKey, error) {
+	if item.Object == nil || item.Object.Type != "RSA PUBLIC KEY" {
+		return nil, fmt.Errorf("Missing %v RSA key", item.Keyword)
+	}
+	return x509.ParsePKCS1PublicKey(item.Object.Bytes)
+}
+
+// String returns the descriptor in the order Tor writes it. Unless the fields
+// are unchanged from a parsed Tor descriptor, the signatures will not be
+// valid.
+func (s *ServerDescriptor) String() string {
+	var b descBuilder
+	b.line("router", s.Nickname, s.Address.String(),
+		strconv.Itoa(s.ORPort), strconv.Itoa(s.SOCKSPort), strconv.Itoa(s.DirPort))
+	if s.IdentityCert != nil {
+		b.object("identity-ed25519", "ED25519 CERT", s.IdentityCert.Bytes())
+	}
+	if s.MasterKey != nil {
+		b.line("master-key-ed25519", base64.RawStdEncoding.EncodeToString(s.MasterKey))
+	}
+	for _, addr := range s.ORAddresses {
+		b.line("or-address", addr)
+	}
+	b.lineIf(s.Platform != "", "platform", s.Platform)
+	if s.Protocols != nil {
+		b.line("proto", formatStringArgs(s.Protocols)...)
+	}
+	b.line("published", s.Published.UTC().Format(timeFormat))
+	if s.Fingerprint != "" {
+		var groups []string
+		for i := 0; i < len(s.Fingerprint); i += 4 {
+			end := i + 4
+			if end > len(s.Fingerprint) {
+				end = len(s.Fingerprint)
+			}
+			groups = append(groups, s.Fingerprint[i:end])
+		}
+		b.line("fingerprint", groups...)
+	}
+	b.lineIf(s.Hibernating, "hibernating", "1")
+	b.lineIf(s.Uptime >= 0, "uptime", strconv.FormatInt(int64(s.Uptime/time.Second), 10))
+	b.line("bandwidth", strconv.FormatInt(s.BandwidthAvg, 10),
+		strconv.FormatInt(s.BandwidthBurst, 10), strconv.FormatInt(s.BandwidthObserved, 10))
+	if s.ExtraInfoDigestSHA256 != "" {
+		b.line("extra-info-digest", s.ExtraInfoDigest, s.ExtraInfoDigestSHA256)
+	} else {
+		b.lineIf(s.ExtraInfoDigest != "", "extra-info-digest", s.ExtraInfoDigest)
+	}
+	b.lineIf(s.CachesExtraInfo, "caches-extra-info")
+	if s.OnionKey != nil {
+		b.object("onion-key", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(s.OnionKey))
+	}
+	if s.SigningKey != nil {
+		b.object("signing-key", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(s.SigningKey))
+	}
+	if s.OnionKeyCrosscert != nil {
+		b.object("onion-key-crosscert", "CROSSCERT", s.OnionKeyCrosscert)
+	}
+	if s.NtorOnionKeyCrosscert != nil {
+		b.object("ntor-onion-key-crosscert "+strconv.Itoa(s.NtorOnionKeyCrosscertSign),
+			"ED25519 CERT", s.NtorOnionKeyCrosscert.Bytes())
+	}
+	b.lineIf(s.HiddenServiceDir, "hidden-service-dir")
+	b.lineIf(len(s.Family) > 0, "family", s.Family...)
+	b.lineIf(s.Contact != "", "contact", s.Contact)
+	if s.NtorOnionKey != nil {
+		b.line("ntor-onion-key", base64.StdEncoding.EncodeToString(s.NtorOnionKey))
+	}
+	for _, rule := range s.ExitPolicy {
+		b.WriteString(rule.String() + "\n")
+	}
+	if s.IPv6Policy != nil {
+		b.line("ipv6-policy", s.IPv6Policy.String())
+	}
+	b.lineIf(s.TunnelledDirServer, "tunnelled-dir-server")
+	b.lineIf(s.AllowSingleHopExits, "allow-single-hop-exits")
+	for _, item := range s.Other {
+		b.WriteString(item.String())
+	}
+	if s.RouterSigEd25519 != nil {
+		b.line("router-sig-ed25519", base64.RawStdEncoding.EncodeToString(s.RouterSigEd25519))
+	}
+	if s.RouterSignature != nil {
+		b.object("router-signature", "SIGNATURE", s.RouterSignature)
+	}
+	return b.String()
+}
+
+// descBuilder writes document items.
+type descBuilder struct{ strings.Builder }
+
+func (d *descBuilder) line(keyword string, args ...string) {
+	d.WriteString(keyword)
+	for _, arg := range args {
+		d.WriteByte(' ')
+		d.WriteString(arg)
+	}
+	d.WriteByte('\n')
+}
+
+func (d *descBuilder) lineIf(cond bool, keyword string, args ...string) {
+	if cond {
+		d.line(keyword, args...)
+	}
+}
+
+func (d *descBuilder) object(keyword string, typ string, byts []byte) {
+	d.line(keyword)
+	d.Write(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: byts}))
+}
+
+// formatStringArgs returns "key=val" args sorted by key.
+func formatStringArgs(args map[string]string) []string {
+	ret := make([]string, 0, len(args))
+	for k, v := range args {
+		ret = append(ret, k+"="+v)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,120 @@
+package dir
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServerDescriptor(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/server-descriptor")
+	require.NoError(t, err)
+	desc, err := ParseServerDescriptor(string(raw))
+	require.NoError(t, err)
+	require.Equal(t, "exit1", desc.Nickname)
+	require.Equal(t, net.ParseIP("203.0.113.5"), desc.Address)
+	require.Equal(t, []int{443, 0, 80}, []int{desc.ORPort, desc.SOCKSPort, desc.DirPort})
+	require.Equal(t, []string{"[2001:db8::5]:443"}, desc.ORAddresses)
+	require.Equal(t, "Tor 0.4.8.9 on Linux", desc.Platform)
+	require.Equal(t, "1-5", desc.Protocols["Link"])
+	require.Equal(t, time.Date(2023, 6, 1, 11, 33, 21, 0, time.UTC), desc.Published)
+	require.Equal(t, 123456*time.Second, desc.Uptime)
+	require.Equal(t, int64(12345678), desc.BandwidthObserved)
+	require.Equal(t, "6A8C1D2F9D0C6E4A1E3A0E7A4E48F3C1B2D9A7E0", desc.ExtraInfoDigest)
+	require.Len(t, desc.Family, 2)
+	require.Equal(t, "admin <admin AT example dot com>", desc.Contact)
+	require.Len(t, desc.NtorOnionKey, 32)
+	require.True(t, desc.HiddenServiceDir)
+	require.True(t, desc.TunnelledDirServer)
+	require.False(t, desc.Hibernating)
+	require.Len(t, desc.Other, 1)
+	require.Equal(t, "overload-general", desc.Other[0].Keyword)
+	require.Len(t, desc.RouterSigEd25519, 64)
+	// Keys and certs
+	fingerprint := sha1.Sum(x509.MarshalPKCS1PublicKey(desc.SigningKey))
+	require.Equal(t, desc.Fingerprint, strings.ToUpper(fmt.Sprintf("%x", fingerprint)))
+	require.NotNil(t, desc.OnionKey)
+	require.Equal(t, CertTypeIdentitySigning, desc.IdentityCert.Type)
+	require.Equal(t, desc.MasterKey, desc.IdentityCert.SigningKey)
+	require.NoError(t, desc.IdentityCert.Verify(nil, desc.Published))
+	require.EqualError(t, desc.IdentityCert.Verify(nil, desc.IdentityCert.Expires.Add(time.Hour)),
+		"Cert expired at 2023-07-01 00:00:00 +0000 UTC")
+	require.EqualError(t, desc.IdentityCert.Verify(desc.IdentityCert.CertifiedKey, time.Time{}),
+		"Invalid cert signature")
+	require.Equal(t, CertTypeOnionKeyCross, desc.NtorOnionKeyCrosscert.Type)
+	require.NoError(t, desc.NtorOnionKeyCrosscert.Verify(desc.IdentityCert.CertifiedKey, time.Time{}))
+	// Exit policy
+	require.Len(t, desc.ExitPolicy, 5)
+	require.True(t, desc.ExitPolicy.Allows(net.ParseIP("198.51.100.7"), 443))
+	require.True(t, desc.ExitPolicy.Allows(net.ParseIP("10.1.2.3"), 80))
+	require.False(t, desc.ExitPolicy.Allows(net.ParseIP("10.1.2.3"), 22))
+	require.True(t, desc.ExitPolicy.Allows(net.ParseIP("2001:db8::7"), 22))
+	require.False(t, desc.ExitPolicy.Allows(net.ParseIP("198.51.100.7"), 22))
+	require.True(t, desc.ExitPolicy.Allows(nil, 22))
+	require.False(t, desc.ExitPolicy.Allows(nil, 25))
+	require.True(t, desc.IPv6Policy.Allows(22))
+	// Serializes the same without annotations
+	require.Equal(t, string(raw)[strings.Index(string(raw), "router "):], desc.String())
+	// Multiple descriptors
+	descs, err := ParseServerDescriptors(string(raw) + string(raw))
+	require.NoError(t, err)
+	require.Len(t, descs, 2)
+	_, err = ParseServerDescriptor(string(raw) + string(raw))
+	require.EqualError(t, err, "Expected 1 descriptor, got 2")
+}
+
+func TestParseExtraInfo(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/extra-info")
+	require.NoError(t, err)
+	info, err := ParseExtraInfo(string(raw))
+	require.NoError(t, err)
+	require.Equal(t, "exit1", info.Nickname)
+	require.Equal(t, "F2B0ACA224174A62A65EB590FA6676A254249BAE", info.Fingerprint)
+	require.NoError(t, info.IdentityCert.Verify(nil, time.Time{}))
+	require.Equal(t, &BandwidthHistory{
+		End:      time.Date(2023, 6, 1, 10, 49, 33, 0, time.UTC),
+		Interval: 24 * time.Hour,
+		Values:   []int64{101, 2001, 30001},
+	}, info.ReadHistory)
+	require.Nil(t, info.IPv6ReadHistory)
+	require.Equal(t, []int64{1, 2}, info.DirReqWriteHistory.Values)
+	require.Equal(t, "2B7A9C3E1D5F7A9B0C2E4F6A8B0D2F4A6C8E0A1B", info.GeoIPDBDigest)
+	require.Len(t, info.Other, 2)
+	require.Equal(t, []string{"us=16,de=8"}, info.Other[1].Args)
+	require.Equal(t, string(raw), info.String())
+}
+
+func TestExitPolicyRule(t *testing.T) {
+	for _, valid := range []string{
+		"accept *:*", "reject *4:25", "accept *6:1-1024", "reject 1.2.3.4:80",
+		"accept 1.2.0.0/16:443", "reject [::1]:*", "accept [2001:db8::]/32:22",
+	} {
+		rule, err := ParseExitPolicyRule(valid)
+		require.NoError(t, err)
+		require.Equal(t, valid, rule.String())
+	}
+	for _, invalid := range []string{
+		"accept *", "allow *:*", "accept 1.2.3:80", "accept [1.2.3.4]:80", "accept 1.2.3.4/33:80",
+		"accept *:0-70000", "accept ::1:80",
+	} {
+		_, err := ParseExitPolicyRule(invalid)
+		require.Error(t, err, invalid)
+	}
+	// Old style masks
+	rule, err := ParseExitPolicyRule("reject 10.0.0.0/255.0.0.0:*")
+	require.NoError(t, err)
+	require.True(t, rule.Matches(net.ParseIP("10.9.8.7"), 80))
+	require.False(t, rule.Matches(net.ParseIP("11.9.8.7"), 80))
+	// Family wildcards
+	rule, err = ParseExitPolicyRule("reject *6:*")
+	require.NoError(t, err)
+	require.True(t, rule.Matches(net.ParseIP("::1"), 80))
+	require.False(t, rule.Matches(net.ParseIP("127.0.0.1"), 80))
+}
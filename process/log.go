@@ -0,0 +1,195 @@
+package process
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLine is a single line of output from a Tor process.
+type LogLine struct {
+	// Raw is the line as output, without the trailing newline.
+	Raw string
+	// Stderr is true if the line was on stderr instead of stdout.
+	Stderr bool
+	// Time is the time of the log entry. It is zero if the line is not in
+	// Tor's log format. Tor doesn't log the year, so the current one is used.
+	Time time.Time
+	// Severity is the log level, e.g. "notice", "warn", or "err". It is empty
+	// if the line is not in Tor's log format.
+	Severity string
+	// Domain is the log domain if Tor has LogMessageDomains set, e.g.
+	// "GENERAL" or "CONFIG,CONTROL". It is empty otherwise.
+	Domain string
+	// Message is the log message. It is the same as Raw if the line is not in
+	// Tor's log format.
+	Message string
+}
+
+// IsError returns true if the severity is "warn" or "err", or if this is a
+// line on stderr not in Tor's log format.
+func (l *LogLine) IsError() bool {
+	switch l.Severity {
+	case "warn", "err":
+		return true
+	case "":
+		return l.Stderr
+	default:
+		return false
+	}
+}
+
+var logTimeLayouts = []string{"Jan 02 15:04:05.000", "Jan 02 15:04:05"}
+
+// ParseLogLine parses a line in Tor's log format, e.g.
+// "Oct 17 12:34:56.789 [notice] {GENERAL} Some message". If the line is not
+// in the format, only Raw and Message are set.
+func ParseLogLine(raw string) *LogLine {
+	ret := &LogLine{Raw: raw, Message: raw}
+	sevStart := strings.Index(raw, " [")
+	if sevStart < 0 {
+		return ret
+	}
+	timeStr, rest := raw[:sevStart], raw[sevStart+2:]
+	sevEnd := strings.IndexByte(rest, ']')
+	if sevEnd < 0 {
+		return ret
+	}
+	severity, message := rest[:sevEnd], strings.TrimPrefix(rest[sevEnd+1:], " ")
+	if severity == "" || strings.ContainsAny(severity, " []") {
+		return ret
+	}
+	var t time.Time
+	var err error
+	for _, layout := range logTimeLayouts {
+		if t, err = time.ParseInLocation(layout, timeStr, time.Local); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return ret
+	}
+	ret.Time = t.AddDate(time.Now().Year(), 0, 0)
+	ret.Severity = severity
+	ret.Message = message
+	if strings.HasPrefix(message, "{") {
+		if domainEnd := strings.Index(message, "} "); domainEnd > 0 && !strings.ContainsRune(message[:domainEnd], ' ') {
+			ret.Domain, ret.Message = message[1:domainEnd], message[domainEnd+2:]
+		}
+	}
+	return ret
+}
+
+// DefaultRecentLogLines is the CreatorConf.RecentLogLines used when not set.
+const DefaultRecentLogLines = 20
+
+// LogTailer is implemented by processes that keep their most recent output
+// lines. The tor package uses this to include Tor's own errors when start
+// fails.
+type LogTailer interface {
+	// RecentLogLines returns the most recent lines, oldest first.
+	RecentLogLines() []*LogLine
+}
+
+// logCapture splits output into lines, keeps the most recent, and calls the
+// handler. It is shared by stdout and stderr.
+type logCapture struct {
+	conf    *CreatorConf
+	max     int
+	writers []*logWriter
+
+	lock   sync.Mutex
+	recent []*LogLine
+	// Held while calling the handler so calls are serialized
+	handlerLock sync.Mutex
+}
+
+func newLogCapture(conf *CreatorConf) *logCapture {
+	l := &logCapture{conf: conf, max: conf.RecentLogLines}
+	if l.max == 0 {
+		l.max = DefaultRecentLogLines
+	}
+	return l
+}
+
+func (l *logCapture) writer(stderr bool) io.Writer {
+	raw := l.conf.Stdout
+	if stderr {
+		raw = l.conf.Stderr
+	}
+	w := &logWriter{capture: l, stderr: stderr, raw: raw}
+	l.writers = append(l.writers, w)
+	return w
+}
+
+// flush handles the partial last line of each writer. It must only be called
+// once nothing else writes.
+func (l *logCapture) flush() {
+	for _, w := range l.writers {
+		w.flush()
+	}
+}
+
+func (l *logCapture) add(line *LogLine) {
+	l.lock.Lock()
+	if l.max > 0 {
+		if len(l.recent) >= l.max {
+			l.recent[0] = nil
+			l.recent = l.recent[1:]
+		}
+		l.recent = append(l.recent, line)
+	}
+	l.lock.Unlock()
+	if l.conf.LogHandler != nil {
+		l.handlerLock.Lock()
+		defer l.handlerLock.Unlock()
+		l.conf.LogHandler(line)
+	}
+}
+
+func (l *logCapture) RecentLogLines() []*LogLine {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]*LogLine(nil), l.recent...)
+}
+
+type logWriter struct {
+	capture *logCapture
+	stderr  bool
+	raw     io.Writer
+	buf     []byte
+}
+
+// Write is only called from a single goroutine by os/exec. A partial line at
+// process exit is handled by flush.
+func (l *logWriter) Write(b []byte) (int, error) {
+	if l.raw != nil {
+		// Raw output errors shouldn't break the process
+		l.raw.Write(b)
+	}
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.handle(l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (l *logWriter) flush() {
+	if len(l.buf) > 0 {
+		l.handle(l.buf)
+		l.buf = nil
+	}
+}
+
+func (l *logWriter) handle(raw []byte) {
+	line := ParseLogLine(string(bytes.TrimSuffix(raw, []byte{'\r'})))
+	line.Stderr = l.stderr
+	l.capture.add(line)
+}
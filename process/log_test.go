@@ -0,0 +1,81 @@
+package process
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLine(t *testing.T) {
+	assert := func(raw, severity, domain, message string, hasTime bool) {
+		line := ParseLogLine(raw)
+		require.Equal(t, raw, line.Raw)
+		require.Equal(t, severity, line.Severity)
+		require.Equal(t, domain, line.Domain)
+		require.Equal(t, message, line.Message)
+		require.Equal(t, hasTime, !line.Time.IsZero())
+	}
+	assert("Oct 17 12:34:56.789 [notice] Bootstrapped 5%: Connecting", "notice", "", "Bootstrapped 5%: Connecting", true)
+	assert("Oct 17 12:34:56 [warn] {CONFIG} Unknown option 'Foo'", "warn", "CONFIG", "Unknown option 'Foo'", true)
+	assert("Oct 17 12:34:56.789 [err] {GENERAL,CONFIG} Failing", "err", "GENERAL,CONFIG", "Failing", true)
+	assert("Oct 17 12:34:56.789 [notice] {not a domain", "notice", "", "{not a domain", true)
+	assert("Tor 0.4.7.13 running on Linux", "", "", "Tor 0.4.7.13 running on Linux", false)
+	assert("not a time [warn] something", "", "", "not a time [warn] something", false)
+	line := ParseLogLine("Feb 03 04:05:06.007 [notice] x")
+	require.Equal(t, time.Now().Year(), line.Time.Year())
+	require.Equal(t, time.February, line.Time.Month())
+	require.Equal(t, 7*time.Millisecond, time.Duration(line.Time.Nanosecond()))
+}
+
+func TestLogCapture(t *testing.T) {
+	var handled []*LogLine
+	logs := newLogCapture(&CreatorConf{RecentLogLines: 2, LogHandler: func(l *LogLine) { handled = append(handled, l) }})
+	stdout, stderr := logs.writer(false), logs.writer(true)
+	stdout.Write([]byte("Oct 17 12:34:56.789 [notice] one\r\nOct 17 12:34:56.789 [warn] tw"))
+	stdout.Write([]byte("o\n"))
+	stderr.Write([]byte("three\n"))
+	require.Len(t, handled, 3)
+	require.Equal(t, "two", handled[1].Message)
+	require.False(t, handled[0].IsError())
+	require.True(t, handled[1].IsError())
+	require.True(t, handled[2].Stderr)
+	require.True(t, handled[2].IsError())
+	require.Equal(t, handled[1:], logs.RecentLogLines())
+}
+
+func TestLogCaptureSerializesHandler(t *testing.T) {
+	// The handler isn't synchronized, the race detector catches concurrent calls
+	count := 0
+	logs := newLogCapture(&CreatorConf{LogHandler: func(*LogLine) { count++ }})
+	var wg sync.WaitGroup
+	for _, w := range []io.Writer{logs.writer(false), logs.writer(true)} {
+		wg.Add(1)
+		go func(w io.Writer) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				w.Write([]byte("line\n"))
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.Equal(t, 200, count)
+}
+
+func TestProcessFlushesLastLine(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("No sh available")
+	}
+	var handled []string
+	creator := NewCreatorWithConf(sh, &CreatorConf{LogHandler: func(l *LogLine) { handled = append(handled, l.Raw) }})
+	p, err := creator.New(context.Background(), "-c", `printf 'one\ntwo'`)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	require.NoError(t, p.Wait())
+	require.Equal(t, []string{"one", "two"}, handled)
+}
@@ -10,6 +10,7 @@ package process
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
@@ -43,7 +44,8 @@ type Creator interface {
 type CmdCreatorFunc func(ctx context.Context, args ...string) (*exec.Cmd, error)
 
 // NewCreator creates a Creator for external Tor process execution based on the
-// given exe path.
+// given exe path. Tor's stdout and stderr are os.Stdout and os.Stderr. Use
+// NewCreatorWithConf to capture the output instead.
 func NewCreator(exePath string) Creator {
 	return CmdCreatorFunc(func(ctx context.Context, args ...string) (*exec.Cmd, error) {
 		cmd := exec.CommandContext(ctx, exePath, args...)
@@ -53,13 +55,73 @@ func NewCreator(exePath string) Creator {
 	})
 }
 
+// CreatorConf is the configuration for NewCreatorWithConf.
+type CreatorConf struct {
+	// LogHandler, if set, is called with every line Tor outputs. Calls are
+	// never concurrent, even across stdout and stderr, and are made from the
+	// goroutines copying the output, so it should not block. A final line
+	// without a trailing newline is handled once the process exits.
+	LogHandler func(*LogLine)
+
+	// Stdout, if set, is written Tor's raw stdout.
+	Stdout io.Writer
+
+	// Stderr, if set, is written Tor's raw stderr.
+	Stderr io.Writer
+
+	// RecentLogLines is how many of the most recent lines the process keeps
+	// for LogTailer. If 0, DefaultRecentLogLines is used. If negative, none
+	// are kept.
+	RecentLogLines int
+}
+
+// NewCreatorWithConf creates a Creator for external Tor process execution based
+// on the given exe path that captures Tor's output. Processes implement
+// LogTailer. If conf is nil, output is discarded except for the recent lines.
+func NewCreatorWithConf(exePath string, conf *CreatorConf) Creator {
+	if conf == nil {
+		conf = &CreatorConf{}
+	}
+	return &exeCreator{exePath: exePath, conf: conf}
+}
+
+type exeCreator struct {
+	exePath string
+	conf    *CreatorConf
+}
+
+func (e *exeCreator) New(ctx context.Context, args ...string) (Process, error) {
+	cmd := exec.CommandContext(ctx, e.exePath, args...)
+	logs := newLogCapture(e.conf)
+	cmd.Stdout = logs.writer(false)
+	cmd.Stderr = logs.writer(true)
+	return &exeProcess{Cmd: cmd, logs: logs}, nil
+}
+
 type exeProcess struct {
 	*exec.Cmd
+	logs *logCapture
 }
 
 func (c CmdCreatorFunc) New(ctx context.Context, args ...string) (Process, error) {
 	cmd, err := c(ctx, args...)
-	return &exeProcess{cmd}, err
+	return &exeProcess{Cmd: cmd}, err
+}
+
+func (e *exeProcess) Wait() error {
+	err := e.Cmd.Wait()
+	// The output is fully copied once Wait returns
+	if e.logs != nil {
+		e.logs.flush()
+	}
+	return err
+}
+
+func (e *exeProcess) RecentLogLines() []*LogLine {
+	if e.logs == nil {
+		return nil
+	}
+	return e.logs.RecentLogLines()
 }
 
 // ErrControlConnUnsupported is returned by Process.EmbeddedControlConn when
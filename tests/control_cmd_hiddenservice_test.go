@@ -36,3 +36,13 @@ func TestHSFetch(t *testing.T) {
 		ctx.Require.Equal(hsFetchOnion, hsEvent.Address)
 	}
 }
+
+func TestHSFetchSync(t *testing.T) {
+	ctx := GlobalEnabledNetworkContext(t)
+	fetchCtx, fetchCancel := context.WithTimeout(ctx, 45*time.Second)
+	defer fetchCancel()
+	event, err := ctx.Control.GetHiddenServiceDescriptorContext(fetchCtx, hsFetchOnion)
+	ctx.Require.NoError(err)
+	ctx.Require.Equal(hsFetchOnion, event.Address)
+	ctx.Require.Contains(event.Descriptor, "hs-descriptor 3")
+}
@@ -0,0 +1,409 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control/controltest"
+	"github.com/cretz/bine/control/transcript"
+	"github.com/cretz/bine/process"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/stretchr/testify/require"
+)
+
+// This runs without -tor since it uses the fake control port server
+
+func TestFakeTorStartListenClose(t *testing.T) {
+	for _, embedded := range []bool{false, true} {
+		server := controltest.NewServer()
+		var transcriptBuf bytes.Buffer
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		tr, err := tor.Start(ctx, &tor.StartConf{
+			ProcessCreator:         server.Creator(),
+			UseEmbeddedControlConn: embedded,
+			TempDataDirBase:        os.TempDir(),
+			ControlRecorder:        transcript.NewRecorder(&transcriptBuf),
+		})
+		require.NoError(t, err)
+		// Listen enables the network and waits on the descriptor upload
+		onion, err := tr.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}})
+		require.NoError(t, err)
+		require.Len(t, server.Onions(), 1)
+		require.Equal(t, server.Onions()[0], onion.ID)
+		require.NoError(t, onion.Close())
+		require.Empty(t, server.Onions())
+		// The dialer discovers the SOCKS listener
+		_, err = tr.Dialer(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, tr.Close())
+		select {
+		case <-server.Done():
+		case <-ctx.Done():
+			t.Fatal("Server not closed")
+		}
+		// The session was recorded, including the descriptor upload
+		entries, err := transcript.ReadEntries(&transcriptBuf)
+		require.NoError(t, err)
+		require.Equal(t, "PROTOCOLINFO", entries[0].Line)
+		var sawUpload bool
+		for _, entry := range entries {
+			sawUpload = sawUpload || strings.HasPrefix(entry.Line, "650 HS_DESC UPLOADED "+onion.ID)
+		}
+		require.True(t, sawUpload)
+	}
+}
+
+func TestFakeTorConnect(t *testing.T) {
+	server := controltest.NewServer()
+	defer server.Close()
+	server.AuthMethods = []string{"HASHEDPASSWORD"}
+	server.Password = "secret"
+	server.SetConf("DataDirectory", "/var/lib/tor")
+	server.SetInfo("net/listeners/socks", `"unix:/run/tor/socks" "127.0.0.1:9050"`)
+	server.Handle("ONION_CLIENT_AUTH_ADD", func(*controltest.Request) []string { return controltest.Reply() })
+	tcpListener, err := server.Listen()
+	require.NoError(t, err)
+	unixSocket := filepath.Join(t.TempDir(), "control")
+	_, err = server.ListenOn("unix", unixSocket)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, addr := range []string{tcpListener.Addr().String(), "unix:" + unixSocket} {
+		tr, err := tor.Connect(ctx, &tor.ConnectConf{ControlAddress: addr, Password: "secret"})
+		require.NoError(t, err)
+		require.Nil(t, tr.Process)
+		require.Equal(t, "/var/lib/tor", tr.DataDir)
+		// The first of multiple SOCKS listeners is used
+		dialer, err := tr.Dialer(ctx, &tor.DialConf{SkipEnableNetwork: true})
+		require.NoError(t, err)
+		require.NotNil(t, dialer)
+		// Client auth keys are registered when the dialer is created
+		_, err = tr.Dialer(ctx, &tor.DialConf{
+			SkipEnableNetwork: true,
+			ClientAuths:       map[string][]byte{"someonion.onion": make([]byte, 32)},
+		})
+		require.NoError(t, err)
+		require.Equal(t, "someonion x25519:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+			lastRequestArgs(server, "ONION_CLIENT_AUTH_ADD"))
+		onion, err := tr.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}})
+		require.NoError(t, err)
+		require.NoError(t, onion.Close())
+		// Close doesn't stop Tor or delete its data
+		require.NoError(t, tr.Close())
+		require.Empty(t, lastRequestArgs(server, "SIGNAL"))
+		select {
+		case <-server.Done():
+			t.Fatal("Server closed")
+		default:
+		}
+	}
+	// Bad password fails
+	_, err = tor.Connect(ctx, &tor.ConnectConf{ControlAddress: tcpListener.Addr().String(), Password: "wrong"})
+	require.Error(t, err)
+	// No SOCKS listener fails unless not checked
+	server.SetInfo("net/listeners/socks", "")
+	_, err = tor.Connect(ctx, &tor.ConnectConf{ControlAddress: tcpListener.Addr().String(), Password: "secret"})
+	require.EqualError(t, err, "No SOCKS listener found, Tor must have a SocksPort")
+	tr, err := tor.Connect(ctx, &tor.ConnectConf{ControlAddress: tcpListener.Addr().String(), DisableEagerAuth: true})
+	require.NoError(t, err)
+	require.NoError(t, tr.Close())
+}
+
+func TestFakeTorListenKeyStore(t *testing.T) {
+	server := controltest.NewServer()
+	defer server.Close()
+	listener, err := server.Listen()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tr, err := tor.Connect(ctx, &tor.ConnectConf{ControlAddress: listener.Addr().String()})
+	require.NoError(t, err)
+	defer tr.Close()
+	keyDir := filepath.Join(t.TempDir(), "keys")
+	store := tor.NewFileKeyStore(keyDir)
+	// First use generates and saves the key, later uses reuse it
+	onion, err := tr.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}, KeyStore: store, KeyName: "web", NoWait: true})
+	require.NoError(t, err)
+	id, key := onion.ID, onion.Key
+	require.NoError(t, onion.Close())
+	require.True(t, strings.HasPrefix(lastRequestArgs(server, "ADD_ONION"), "ED25519-V3:"))
+	fwd, err := tr.Forward(ctx, &tor.ForwardConf{
+		PortForwards: map[string][]int{"127.0.0.1:8080": {80}}, KeyStore: store, KeyName: "web", NoWait: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, id, fwd.ID)
+	require.Equal(t, key, fwd.Key)
+	require.NoError(t, fwd.Close())
+	// The key directory is a HiddenServiceDir
+	hostname, err := ioutil.ReadFile(filepath.Join(keyDir, "web", "hostname"))
+	require.NoError(t, err)
+	require.Equal(t, id+".onion\n", string(hostname))
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(keyDir, "web", "hs_ed25519_secret_key"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	// Other names get other keys
+	onion, err = tr.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}, KeyStore: store, KeyName: "other", NoWait: true})
+	require.NoError(t, err)
+	require.NotEqual(t, id, onion.ID)
+	require.NoError(t, onion.Close())
+	// Bad confs fail
+	_, err = tr.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}, KeyName: "web", NoWait: true})
+	require.Error(t, err)
+	_, err = tr.Listen(ctx, &tor.ListenConf{RemotePorts: []int{80}, KeyStore: store, KeyName: "../web", NoWait: true})
+	require.Error(t, err)
+	_, err = tr.Listen(ctx, &tor.ListenConf{
+		RemotePorts: []int{80}, Key: key, KeyStore: store, KeyName: "web", NoWait: true,
+	})
+	require.Error(t, err)
+}
+
+func TestFakeTorKeyStoreConcurrent(t *testing.T) {
+	store := tor.NewFileKeyStore(t.TempDir())
+	// Concurrent first uses of a name all get the same key
+	keys := make(chan ed25519.KeyPair, 10)
+	for i := 0; i < cap(keys); i++ {
+		go func() {
+			key, err := tor.LoadOrGenerateKey(store, "web")
+			require.NoError(t, err)
+			keys <- key
+		}()
+	}
+	first := <-keys
+	for i := 1; i < cap(keys); i++ {
+		require.Equal(t, first, <-keys)
+	}
+	// Loads during saves always see a whole key
+	saved := map[string]bool{string(first.PrivateKey()): true}
+	var saving []ed25519.KeyPair
+	for i := 0; i < 20; i++ {
+		key, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		saved[string(key.PrivateKey())] = true
+		saving = append(saving, key)
+	}
+	saveErr := make(chan error, 1)
+	go func() {
+		for _, key := range saving {
+			if err := store.SaveKey("web", key); err != nil {
+				saveErr <- err
+				return
+			}
+		}
+		saveErr <- nil
+	}()
+	for done := false; !done; {
+		select {
+		case err := <-saveErr:
+			require.NoError(t, err)
+			done = true
+		default:
+		}
+		key, err := store.LoadKey("web")
+		require.NoError(t, err)
+		require.True(t, saved[string(key.PrivateKey())])
+	}
+	// Generating a key for one name does not wait on other names
+	blocking := &blockingKeyStore{KeyStore: store, loading: make(chan struct{}), release: make(chan struct{})}
+	blockedErr := make(chan error, 1)
+	go func() {
+		_, err := tor.LoadOrGenerateKey(blocking, "blocked")
+		blockedErr <- err
+	}()
+	<-blocking.loading
+	_, err := tor.LoadOrGenerateKey(blocking, "other")
+	require.NoError(t, err)
+	close(blocking.release)
+	require.NoError(t, <-blockedErr)
+}
+
+// blockingKeyStore blocks loads of the "blocked" name until released
+type blockingKeyStore struct {
+	tor.KeyStore
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingKeyStore) LoadKey(name string) (ed25519.KeyPair, error) {
+	if name == "blocked" {
+		close(b.loading)
+		<-b.release
+	}
+	return b.KeyStore.LoadKey(name)
+}
+
+func lastRequestArgs(server *controltest.Server, keyword string) string {
+	reqs := server.Requests()
+	for i := len(reqs) - 1; i >= 0; i-- {
+		if reqs[i].Keyword == keyword {
+			return reqs[i].Args
+		}
+	}
+	return ""
+}
+
+func TestFakeTorControlSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Control sockets not supported on Windows")
+	}
+	for _, groupWritable := range []bool{false, true} {
+		server := controltest.NewServer()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		tr, err := tor.Start(ctx, &tor.StartConf{
+			ProcessCreator:             server.Creator(),
+			TempDataDirBase:            os.TempDir(),
+			UseControlSocket:           true,
+			ControlSocketGroupWritable: groupWritable,
+		})
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(tr.DataDir, "control.sock"), tr.ControlSocket)
+		require.Zero(t, tr.ControlPort)
+		_, hasControlPort := server.Conf("ControlPort")
+		require.False(t, hasControlPort)
+		// Cookie auth over the socket works
+		require.True(t, tr.Control.IsAuthenticated())
+		info, err := os.Stat(tr.DataDir)
+		require.NoError(t, err)
+		groupVal, _ := server.Conf("ControlSocketsGroupWritable")
+		cookieGroupVal, _ := server.Conf("CookieAuthFileGroupReadable")
+		if groupWritable {
+			require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+			require.Equal(t, "1", groupVal)
+			require.Equal(t, "1", cookieGroupVal)
+		} else {
+			require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+			require.Empty(t, groupVal)
+			require.Empty(t, cookieGroupVal)
+		}
+		require.NoError(t, tr.Close())
+	}
+}
+
+type stuckProcess struct {
+	ctx      context.Context
+	exitErr  error
+	logLines []string
+}
+
+func (s *stuckProcess) RecentLogLines() []*process.LogLine {
+	ret := make([]*process.LogLine, len(s.logLines))
+	for i, line := range s.logLines {
+		ret[i] = process.ParseLogLine(line)
+	}
+	return ret
+}
+
+func (s *stuckProcess) Start() error { return nil }
+
+// Wait returns immediately if there is an exit error, otherwise it never exits
+// on its own
+func (s *stuckProcess) Wait() error {
+	if s.exitErr != nil {
+		return s.exitErr
+	}
+	<-s.ctx.Done()
+	return s.ctx.Err()
+}
+
+func (s *stuckProcess) EmbeddedControlConn() (net.Conn, error) {
+	return nil, process.ErrControlConnUnsupported
+}
+
+type stuckCreator struct {
+	exitErr  error
+	logLines []string
+}
+
+func (s stuckCreator) New(ctx context.Context, args ...string) (process.Process, error) {
+	return &stuckProcess{ctx: ctx, exitErr: s.exitErr, logLines: s.logLines}, nil
+}
+
+func TestFakeTorStartNotReady(t *testing.T) {
+	// Exits early
+	start := time.Now()
+	_, err := tor.Start(nil, &tor.StartConf{
+		ProcessCreator: stuckCreator{exitErr: fmt.Errorf("exit status 1"), logLines: []string{
+			"Oct 17 12:34:56.789 [notice] Tor 0.4.7.13 running on Linux",
+			"Oct 17 12:34:56.789 [warn] Failed to parse/validate config: Unknown option 'Foo'.  Failing.",
+			"Oct 17 12:34:56.789 [err] Reading config failed--see warnings above.",
+		}},
+		TempDataDirBase: os.TempDir(),
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Tor exited before creating control port file")
+	require.Contains(t, err.Error(), "exit status 1")
+	// Tor's own errors are included
+	require.Contains(t, err.Error(), "(recent Tor errors: Failed to parse/validate config: Unknown option 'Foo'.  "+
+		"Failing.; Reading config failed--see warnings above.)")
+	require.NotContains(t, err.Error(), "running on Linux")
+	require.True(t, time.Since(start) < 5*time.Second)
+	// Never gets ready
+	_, err = tor.Start(nil, &tor.StartConf{
+		ProcessCreator:  stuckCreator{},
+		TempDataDirBase: os.TempDir(),
+		StartTimeout:    100 * time.Millisecond,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Timed out after 100ms waiting for Tor to create control port file")
+	// Canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = tor.Start(ctx, &tor.StartConf{ProcessCreator: stuckCreator{}, TempDataDirBase: os.TempDir()})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Canceled while waiting for control port file")
+}
+
+type delayedProcess struct {
+	process.Process
+	startedCh chan struct{}
+}
+
+func (d *delayedProcess) Start() error {
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if err := d.Process.Start(); err != nil {
+			panic(err)
+		}
+		close(d.startedCh)
+	}()
+	return nil
+}
+
+func (d *delayedProcess) Wait() error {
+	<-d.startedCh
+	return d.Process.Wait()
+}
+
+type delayedCreator struct{ process.Creator }
+
+func (d delayedCreator) New(ctx context.Context, args ...string) (process.Process, error) {
+	p, err := d.Creator.New(ctx, args...)
+	return &delayedProcess{Process: p, startedCh: make(chan struct{})}, err
+}
+
+func TestFakeTorStartDelayed(t *testing.T) {
+	for _, controlSocket := range []bool{false, runtime.GOOS != "windows"} {
+		server := controltest.NewServer()
+		tr, err := tor.Start(nil, &tor.StartConf{
+			ProcessCreator:   delayedCreator{server.Creator()},
+			TempDataDirBase:  os.TempDir(),
+			UseControlSocket: controlSocket,
+		})
+		require.NoError(t, err)
+		require.True(t, tr.Control.IsAuthenticated())
+		require.NoError(t, tr.Close())
+	}
+}
@@ -0,0 +1,119 @@
+package tor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/control/transcript"
+)
+
+// ConnectConf is the configuration used for Connect when connecting to an
+// already-running Tor instance.
+type ConnectConf struct {
+	// ControlAddress is the control endpoint of the running Tor. It can be a
+	// TCP address (e.g. "127.0.0.1:9051"), just a port which is assumed to be
+	// on 127.0.0.1 (e.g. "9051"), or a Unix socket path optionally prefixed
+	// with "unix:" (e.g. "/run/tor/control"). Required unless ControlNetwork is
+	// set.
+	ControlAddress string
+
+	// ControlNetwork is the network for ControlAddress, e.g. "tcp" or "unix".
+	// If empty, it is determined from ControlAddress.
+	ControlNetwork string
+
+	// Password is the password for HASHEDPASSWORD authentication. It is not
+	// needed for cookie or NULL authentication.
+	Password string
+
+	// DisableEagerAuth, if true, will not authenticate on Connect. Note, the
+	// SOCKS listener is not checked either, so this must be set to connect to
+	// a Tor without one.
+	DisableEagerAuth bool
+
+	// DebugWriter is the writer to use for debug logs, or nil for no debug
+	// logs.
+	DebugWriter io.Writer
+
+	// ControlRecorder, if set, records every line sent and received on the
+	// control connection. See the control/transcript package.
+	ControlRecorder *transcript.Recorder
+}
+
+// Connect connects to an already-running Tor instance instead of starting one.
+// If ctx is nil, context.Background() is used. Unless DisableEagerAuth is set,
+// this authenticates and fails if Tor has no SOCKS listener. The
+// result can be used like one from Start except that Close only closes the
+// control connection, it never stops the Tor process or deletes its data
+// directory.
+func Connect(ctx context.Context, conf *ConnectConf) (*Tor, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if conf == nil || (conf.ControlAddress == "" && conf.ControlNetwork == "") {
+		return nil, fmt.Errorf("Missing control address")
+	}
+	tor := &Tor{DebugWriter: conf.DebugWriter}
+	network, address := conf.ControlNetwork, conf.ControlAddress
+	if network == "" {
+		switch {
+		case strings.HasPrefix(address, "unix:"):
+			network, address = "unix", address[5:]
+		case strings.HasPrefix(address, "/"):
+			network = "unix"
+		default:
+			network = "tcp"
+			if _, err := strconv.Atoi(address); err == nil {
+				address = "127.0.0.1:" + address
+			}
+		}
+	}
+	if network == "unix" {
+		tor.ControlSocket = address
+	} else if network == "tcp" {
+		if _, portStr, err := net.SplitHostPort(address); err == nil {
+			tor.ControlPort, _ = strconv.Atoi(portStr)
+		}
+	}
+	tor.Debugf("Connecting to control %v address %v", network, address)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to control address: %v", err)
+	}
+	if conf.ControlRecorder != nil {
+		conn = conf.ControlRecorder.Conn(conn)
+	}
+	tor.Control = control.NewConnWithDebugWriter(textproto.NewConn(conn), tor.DebugWriter)
+	if !conf.DisableEagerAuth {
+		err = tor.Control.AuthenticateContext(ctx, conf.Password)
+		// Populate the data dir for informational purposes
+		if err == nil {
+			var vals []*control.KeyVal
+			if vals, err = tor.Control.GetConfContext(ctx, "DataDirectory"); err == nil && len(vals) > 0 {
+				tor.DataDir = vals[0].Val
+			}
+		}
+		if err == nil {
+			var listeners []net.Addr
+			if listeners, err = tor.Control.GetInfoListenersContext(ctx, control.ListenerTypeSocks); err != nil {
+				err = fmt.Errorf("Unable to get SOCKS listeners: %v", err)
+			} else if len(listeners) == 0 {
+				err = fmt.Errorf("No SOCKS listener found, Tor must have a SocksPort")
+			} else {
+				tor.Debugf("Found SOCKS listeners: %v", listeners)
+			}
+		}
+	}
+	if err != nil {
+		if closeErr := tor.Close(); closeErr != nil {
+			err = fmt.Errorf("Error on connect: %v (also got error trying to close: %v)", err, closeErr)
+		}
+	}
+	return tor, err
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"strings"
 
+	"github.com/cretz/bine/control"
 	"golang.org/x/net/proxy"
 )
 
@@ -39,6 +39,12 @@ type DialConf struct {
 
 	// Forward is the dialer to forward to. If nil, just uses normal net dialer.
 	Forward proxy.Dialer
+
+	// ClientAuths are x25519 private keys, keyed by onion address with or
+	// without the ".onion" suffix, for onion services that require client
+	// authorization. They are registered via ONION_CLIENT_AUTH_ADD (not
+	// permanently) when the dialer is created.
+	ClientAuths map[string][]byte
 }
 
 // Dialer creates a new Dialer for the given configuration. Context can be nil.
@@ -56,24 +62,24 @@ func (t *Tor) Dialer(ctx context.Context, conf *DialConf) (*Dialer, error) {
 			return nil, err
 		}
 	}
+	// Register client auth keys
+	for address, key := range conf.ClientAuths {
+		auth := &control.OnionClientAuth{Address: address, PrivateKey: key}
+		if _, err := t.Control.AddOnionClientAuthContext(ctx, auth); err != nil {
+			return nil, fmt.Errorf("Unable to add client auth for %v: %v", address, err)
+		}
+	}
 	// Lookup proxy address as needed
 	proxyNetwork := conf.ProxyNetwork
 	proxyAddress := conf.ProxyAddress
 	if proxyAddress == "" {
-		info, err := t.Control.GetInfo("net/listeners/socks")
+		listeners, err := t.Control.GetInfoListenersContext(ctx, control.ListenerTypeSocks)
 		if err != nil {
 			return nil, err
-		}
-		if len(info) != 1 || info[0].Key != "net/listeners/socks" {
+		} else if len(listeners) == 0 {
 			return nil, fmt.Errorf("Unable to get socks proxy address")
 		}
-		proxyAddress = info[0].Val
-		if strings.HasPrefix(proxyAddress, "unix:") {
-			proxyAddress = proxyAddress[5:]
-			proxyNetwork = "unix"
-		} else {
-			proxyNetwork = "tcp"
-		}
+		proxyNetwork, proxyAddress = listeners[0].Network(), listeners[0].String()
 	} else if proxyNetwork == "" {
 		proxyNetwork = "tcp"
 	}
@@ -1,7 +1,8 @@
 // Package tor is the high-level client for Tor.
 //
 // The Tor type is a combination of a Tor instance and a connection to it.
-// Use Start to create Tor. Then Dialer or Listener can be used.
+// Use Start to create Tor, or Connect to use an already-running Tor. Then Dialer
+// or Listener can be used.
 //
 // Some of this code is lifted from https://github.com/yawning/bulb with thanks.
 package tor
@@ -39,11 +39,22 @@ type ForwardConf struct {
 	// present, it must be an instance of
 	// github.com/cretz/bine/torutil/ed25519.KeyPair, a
 	// golang.org/x/crypto/ed25519.PrivateKey, or a
-	// github.com/cretz/bine/control.Key.
+	// github.com/cretz/bine/control.Key. This must not be set if KeyName is
+	// set.
 	Key crypto.PrivateKey
 
+	// KeyStore is where KeyName is loaded from. It is required if KeyName is
+	// set and ignored otherwise.
+	KeyStore KeyStore
+
+	// KeyName, if set, is the name of the key in KeyStore to use. If the store
+	// has no key by that name, one is generated and saved to it, so the onion
+	// service keeps the same ID on subsequent calls.
+	KeyName string
+
 	// ClientAuths is the credential set for clients. The values are
-	// base32-encoded ed25519 public keys.
+	// base32-encoded x25519 public keys as returned by
+	// github.com/cretz/bine/torutil.ClientAuthPublicKey.String.
 	ClientAuths []string
 
 	// MaxStreams is the maximum number of streams the service will accept. 0
@@ -104,8 +115,9 @@ func (t *Tor) Forward(ctx context.Context, conf *ForwardConf) (*OnionForward, er
 	if conf.MaxStreamsCloseCircuit {
 		req.Flags = append(req.Flags, "MaxStreamsCloseCircuit")
 	}
-	// Set the key
-	switch key := conf.Key.(type) {
+	// Set the key, loading it from the store if named
+	confKey, err := storedKey(conf.Key, conf.KeyStore, conf.KeyName)
+	switch key := confKey.(type) {
 	case nil:
 		req.Key = control.GenKey(control.KeyAlgoED25519V3)
 	case control.GenKey:
@@ -141,7 +153,7 @@ func (t *Tor) Forward(ctx context.Context, conf *ForwardConf) (*OnionForward, er
 	// Create the onion service
 	var resp *control.AddOnionResponse
 	if err == nil {
-		resp, err = t.Control.AddOnion(req)
+		resp, err = t.Control.AddOnionContext(ctx, req)
 	}
 
 	// Apply the response to the service
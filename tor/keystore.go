@@ -0,0 +1,161 @@
+package tor
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// KeyStore persists onion service keys by name so a service can keep the same
+// address across restarts. It is used via ListenConf.KeyStore and
+// ForwardConf.KeyStore. Implementations must be safe for concurrent use.
+type KeyStore interface {
+	// LoadKey returns the key stored for name, or nil and no error if there
+	// is no key for name.
+	LoadKey(name string) (ed25519.KeyPair, error)
+
+	// SaveKey stores key for name, replacing any existing key.
+	SaveKey(name string, key ed25519.KeyPair) error
+}
+
+// FileKeyStore is a KeyStore that stores each key as a Tor HiddenServiceDir
+// named for the key inside Dir. The directories are created with 0700
+// permissions and the files with 0600, so each directory can also be served
+// by a stock Tor.
+type FileKeyStore struct {
+	// Dir is the directory to store keys in. It is created on first save if
+	// it does not exist.
+	Dir string
+
+	// Held for writing while saving so loads never see some files of the old
+	// key and some of the new. Each file is also replaced atomically, so
+	// other processes never see a partially written file.
+	lock sync.RWMutex
+}
+
+// NewFileKeyStore creates a FileKeyStore for the given directory.
+func NewFileKeyStore(dir string) *FileKeyStore {
+	return &FileKeyStore{Dir: dir}
+}
+
+// LoadKey implements KeyStore.LoadKey.
+func (f *FileKeyStore) LoadKey(name string) (ed25519.KeyPair, error) {
+	dir, err := f.keyDir(name)
+	if err != nil {
+		return nil, err
+	}
+	f.lock.RLock()
+	key, err := torutil.LoadHiddenServiceDir(dir)
+	f.lock.RUnlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to load key %v: %v", name, err)
+	}
+	return key, nil
+}
+
+// SaveKey implements KeyStore.SaveKey.
+func (f *FileKeyStore) SaveKey(name string, key ed25519.KeyPair) error {
+	dir, err := f.keyDir(name)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := os.MkdirAll(f.Dir, 0700); err != nil {
+		return err
+	}
+	if err := torutil.SaveHiddenServiceDir(dir, key); err != nil {
+		return fmt.Errorf("Unable to save key %v: %v", name, err)
+	}
+	return nil
+}
+
+func (f *FileKeyStore) keyDir(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("Invalid key name: %q", name)
+	}
+	return filepath.Join(f.Dir, name), nil
+}
+
+// Locks held by LoadOrGenerateKey per store and name so concurrent first uses
+// of a name agree on the key. Entries are removed when no longer used.
+var (
+	keyNameLocksLock sync.Mutex
+	keyNameLocks     = map[keyNameLockKey]*keyNameLock{}
+)
+
+type keyNameLockKey struct {
+	// Nil if the store is not comparable, then names are locked across stores
+	store KeyStore
+	name  string
+}
+
+type keyNameLock struct {
+	sync.Mutex
+	refs int
+}
+
+func lockKeyName(store KeyStore, name string) (unlock func()) {
+	lockKey := keyNameLockKey{name: name}
+	if reflect.TypeOf(store).Comparable() {
+		lockKey.store = store
+	}
+	keyNameLocksLock.Lock()
+	lock := keyNameLocks[lockKey]
+	if lock == nil {
+		lock = &keyNameLock{}
+		keyNameLocks[lockKey] = lock
+	}
+	lock.refs++
+	keyNameLocksLock.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		keyNameLocksLock.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(keyNameLocks, lockKey)
+		}
+		keyNameLocksLock.Unlock()
+	}
+}
+
+// LoadOrGenerateKey returns the key for name in store. If there is no key for
+// name, one is generated and saved first. Concurrent calls for the same store
+// and name return the same key.
+func LoadOrGenerateKey(store KeyStore, name string) (ed25519.KeyPair, error) {
+	unlock := lockKeyName(store, name)
+	defer unlock()
+	key, err := store.LoadKey(name)
+	if err != nil || key != nil {
+		return key, err
+	}
+	if key, err = ed25519.GenerateKey(nil); err != nil {
+		return nil, err
+	} else if err = store.SaveKey(name, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// storedKey returns the key from the store for the Key, KeyStore, and KeyName
+// values of ListenConf or ForwardConf. If keyName is empty, key is returned
+// as is.
+func storedKey(key crypto.PrivateKey, store KeyStore, keyName string) (crypto.PrivateKey, error) {
+	if keyName == "" {
+		return key, nil
+	} else if key != nil {
+		return nil, fmt.Errorf("Cannot set both Key and KeyName")
+	} else if store == nil {
+		return nil, fmt.Errorf("KeyStore is required with KeyName")
+	}
+	return LoadOrGenerateKey(store, keyName)
+}
@@ -0,0 +1,123 @@
+package tor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/process"
+)
+
+// DefaultStartTimeout is the StartConf.StartTimeout used when not set.
+const DefaultStartTimeout = time.Minute
+
+// processDone returns a channel that is closed once the process has exited, at
+// which point processErr is set. This is how the process is waited on so it's
+// only done once.
+func (t *Tor) processDone() <-chan struct{} {
+	t.processWaitOnce.Do(func() {
+		t.processDoneCh = make(chan struct{})
+		p := t.Process
+		go func() {
+			t.processErr = p.Wait()
+			close(t.processDoneCh)
+		}()
+	})
+	return t.processDoneCh
+}
+
+// waitReady waits for the started process to open its control port or socket.
+// The port file is only used when not on a control socket.
+func (t *Tor) waitReady(ctx context.Context, conf *StartConf, controlPortFileName string) error {
+	timeout := conf.StartTimeout
+	if timeout == 0 {
+		timeout = DefaultStartTimeout
+	}
+	var watchCtx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		watchCtx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		watchCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	// Stop watching if the process exits
+	processDone := t.processDone()
+	go func() {
+		select {
+		case <-processDone:
+			cancel()
+		case <-watchCtx.Done():
+		}
+	}()
+	var path, what string
+	var check func() bool
+	if conf.UseControlSocket {
+		path, what = t.ControlSocket, "control socket "+t.ControlSocket
+		check = func() bool {
+			info, err := os.Stat(path)
+			return err == nil && info.Mode()&os.ModeSocket != 0
+		}
+	} else {
+		path, what = controlPortFileName, "control port file "+controlPortFileName
+		check = func() bool {
+			byts, err := ioutil.ReadFile(path)
+			if err == nil {
+				t.ControlPort, err = process.ControlPortFromFileContents(string(byts))
+			}
+			return err == nil
+		}
+	}
+	t.Debugf("Waiting up to %v for %v", timeout, what)
+	start := time.Now()
+	err := watchDir(watchCtx, filepath.Dir(path), check)
+	if err == nil {
+		t.Debugf("Tor ready after %v", time.Since(start))
+		return nil
+	}
+	// Give a clear reason. Canceling ctx also kills the process, so that's
+	// checked before process exit.
+	if ctx.Err() != nil {
+		return fmt.Errorf("Canceled while waiting for %v: %v", what, ctx.Err())
+	}
+	select {
+	case <-processDone:
+		if t.processErr != nil {
+			return fmt.Errorf("Tor exited before creating %v: %v", what, t.processErr)
+		}
+		return fmt.Errorf("Tor exited successfully before creating %v, check the args and torrc", what)
+	default:
+	}
+	if watchCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Timed out after %v waiting for Tor to create %v", timeout, what)
+	}
+	return fmt.Errorf("Failed waiting for %v: %v", what, err)
+}
+
+// withRecentProcessErrors adds the most recent error lines Tor output, if the
+// process keeps them, to the given error.
+func (t *Tor) withRecentProcessErrors(err error) error {
+	tailer, _ := t.Process.(process.LogTailer)
+	if tailer == nil {
+		return err
+	}
+	// Give the process a moment to finish writing if it is exiting
+	select {
+	case <-t.processDone():
+	case <-time.After(100 * time.Millisecond):
+	}
+	msgs := []string{}
+	for _, line := range tailer.RecentLogLines() {
+		if line.IsError() {
+			msgs = append(msgs, line.Message)
+		}
+	}
+	if len(msgs) == 0 {
+		return err
+	}
+	return fmt.Errorf("%v (recent Tor errors: %v)", err, strings.Join(msgs, "; "))
+}
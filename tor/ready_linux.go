@@ -0,0 +1,52 @@
+package tor
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// watchDir calls check each time a file in dir is created, written, or moved
+// into it until check returns true or the context is done. It uses inotify so
+// there is no polling delay.
+func watchDir(ctx context.Context, dir string, check func() bool) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return pollDir(ctx, dir, check)
+	}
+	// Non-blocking so reads can be interrupted by closing
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+	const mask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MODIFY
+	if _, err = syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		return pollDir(ctx, dir, check)
+	}
+	// Check after the watch is set so nothing is missed
+	if check() {
+		return nil
+	}
+	readCh := make(chan error, 1)
+	go func() {
+		// Contents don't matter, each read means something changed
+		buf := make([]byte, 4096)
+		for {
+			if _, err := f.Read(buf); err != nil {
+				readCh <- err
+				return
+			}
+			if check() {
+				readCh <- nil
+				return
+			}
+		}
+	}()
+	select {
+	case err = <-readCh:
+		return err
+	case <-ctx.Done():
+		// Closing unblocks the read, wait so check isn't called after return
+		f.Close()
+		<-readCh
+		return ctx.Err()
+	}
+}
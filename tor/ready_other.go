@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package tor
+
+import "context"
+
+// watchDir calls check until it returns true or the context is done.
+func watchDir(ctx context.Context, dir string, check func() bool) error {
+	return pollDir(ctx, dir, check)
+}
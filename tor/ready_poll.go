@@ -0,0 +1,23 @@
+package tor
+
+import (
+	"context"
+	"time"
+)
+
+// pollDir is watchDir for when file notifications are unavailable. The
+// interval starts small and backs off.
+func pollDir(ctx context.Context, dir string, check func() bool) error {
+	interval := 10 * time.Millisecond
+	for !check() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		if interval < 200*time.Millisecond {
+			interval *= 2
+		}
+	}
+	return nil
+}
@@ -5,22 +5,27 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/control/transcript"
 
 	"github.com/cretz/bine/process"
 )
 
 // Tor is the wrapper around the Tor process and control port connection. It
-// should be created with Start and developers should always call Close when
+// should be created with Start or Connect and developers should always call Close when
 // done.
 type Tor struct {
-	// Process is the Tor instance that is running.
+	// Process is the Tor instance that is running. It is nil if created with
+	// Connect.
 	Process process.Process
 
 	// Control is the Tor controller connection.
@@ -31,9 +36,13 @@ type Tor struct {
 	ProcessCancelFunc context.CancelFunc
 
 	// ControlPort is the port that Control is connected on. It is 0 if the
-	// connection is an embedded control connection.
+	// connection is an embedded control connection or a Unix socket.
 	ControlPort int
 
+	// ControlSocket is the path to the Unix socket that Control is connected
+	// on. It is empty if the connection is not over a Unix socket.
+	ControlSocket string
+
 	// DataDir is the path to the data directory that Tor is using.
 	DataDir string
 
@@ -55,6 +64,11 @@ type Tor struct {
 	// GeoIPv6CreatedFile is the path, relative to DataDir, that was created
 	// from StartConf.GeoIPFileReader. It is empty if no file was created.
 	GeoIPv6CreatedFile string
+
+	// Process.Wait can only be called once, so it is shared via these
+	processWaitOnce sync.Once
+	processDoneCh   chan struct{}
+	processErr      error
 }
 
 // StartConf is the configuration used for Start when starting a Tor instance. A
@@ -66,9 +80,16 @@ type StartConf struct {
 	ExePath string
 
 	// ProcessCreator is the override to use a specific process creator. If set,
-	// ExePath is ignored.
+	// ExePath and ProcessLogHandler are ignored.
 	ProcessCreator process.Creator
 
+	// ProcessLogHandler, if set, is called with every line of Tor's stdout and
+	// stderr instead of them being written to os.Stdout and os.Stderr. This
+	// includes messages from before the control port is available such as
+	// torrc errors. It is called from another goroutine and should not block.
+	// This is ignored if ProcessCreator is set.
+	ProcessLogHandler func(*process.LogLine)
+
 	// UseEmbeddedControlConn can be set to true to use
 	// process.Process.EmbeddedControlConn() instead of creating a connection
 	// via ControlPort. Note, this only works when ProcessCreator is an
@@ -76,9 +97,31 @@ type StartConf struct {
 	UseEmbeddedControlConn bool
 
 	// ControlPort is the port to use for the Tor controller. If it is 0, Tor
-	// picks a port for use. This is ignored if UseEmbeddedControlConn is true.
+	// picks a port for use. This is ignored if UseEmbeddedControlConn or
+	// UseControlSocket is true.
 	ControlPort int
 
+	// UseControlSocket, if true, puts the Tor controller on a Unix socket
+	// named "control.sock" in the data directory instead of on a TCP port.
+	// Unlike a loopback TCP port, the socket is only reachable by users that
+	// can access the data directory. This is ignored if UseEmbeddedControlConn
+	// is true and is not supported on Windows.
+	UseControlSocket bool
+
+	// ControlSocketGroupWritable, if true, lets members of the data
+	// directory's group use the control socket. This sets
+	// ControlSocketsGroupWritable, makes the data directory group readable
+	// (and sets DataDirectoryGroupReadable so Tor accepts it), and, if cookie
+	// auth is enabled, sets CookieAuthFileGroupReadable. This is ignored
+	// unless UseControlSocket is true.
+	ControlSocketGroupWritable bool
+
+	// StartTimeout is the total amount of time to wait for Tor to open its
+	// control port or socket after the process is started. If 0,
+	// DefaultStartTimeout is used. If negative, only ctx limits the wait. This
+	// does not apply to embedded control connections.
+	StartTimeout time.Duration
+
 	// DataDir is the directory used by Tor. If it is empty, a temporary
 	// directory is created in TempDataDirBase.
 	DataDir string
@@ -134,6 +177,11 @@ type StartConf struct {
 	// This can be set to torutil/geoipembed.GeoIPReader to use an embedded
 	// source.
 	GeoIPFileReader func(ipv6 bool) (io.ReadCloser, error)
+
+	// ControlRecorder, if set, records every line sent and received on the
+	// control connection. This works for both the control port and the
+	// embedded control connection. See the control/transcript package.
+	ControlRecorder *transcript.Recorder
 }
 
 // Start a Tor instance and connect to it. If ctx is nil, context.Background()
@@ -179,10 +227,11 @@ func Start(ctx context.Context, conf *StartConf) (*Tor, error) {
 	}
 	// Attempt eager auth w/ no password
 	if err == nil && !conf.DisableEagerAuth {
-		err = tor.Control.Authenticate("")
+		err = tor.Control.AuthenticateContext(ctx, "")
 	}
 	// If there was an error, we have to try to close here but it may leave the process open
 	if err != nil {
+		err = tor.withRecentProcessErrors(err)
 		if closeErr := tor.Close(); closeErr != nil {
 			err = fmt.Errorf("Error on start: %v (also got error trying to close: %v)", err, closeErr)
 		}
@@ -235,7 +284,11 @@ func (t *Tor) startProcess(ctx context.Context, conf *StartConf) error {
 		if torPath == "" {
 			torPath = "tor"
 		}
-		creator = process.NewCreator(torPath)
+		creatorConf := &process.CreatorConf{LogHandler: conf.ProcessLogHandler}
+		if conf.ProcessLogHandler == nil {
+			creatorConf.Stdout, creatorConf.Stderr = os.Stdout, os.Stderr
+		}
+		creator = process.NewCreatorWithConf(torPath, creatorConf)
 	}
 	// Build the args
 	args := []string{"--DataDirectory", t.DataDir}
@@ -270,11 +323,16 @@ func (t *Tor) startProcess(ctx context.Context, conf *StartConf) error {
 		}
 	}
 	args = append(args, "-f", torrcFileName)
-	// Create file for Tor to write the control port to if it's not told to us and we're not embedded
+	// Create file for Tor to write the control port to if we're not embedded
 	var controlPortFileName string
 	var err error
 	if !conf.UseEmbeddedControlConn {
-		if conf.ControlPort == 0 {
+		if conf.UseControlSocket {
+			if args, err = t.controlSocketArgs(conf, args); err != nil {
+				return err
+			}
+		} else {
+			// Tor writes this file once the port is open, even if it's not auto
 			controlPortFile, err := ioutil.TempFile(t.DataDir, "control-port-")
 			if err != nil {
 				return err
@@ -283,9 +341,11 @@ func (t *Tor) startProcess(ctx context.Context, conf *StartConf) error {
 			if err = controlPortFile.Close(); err != nil {
 				return err
 			}
-			args = append(args, "--ControlPort", "auto", "--ControlPortWriteToFile", controlPortFile.Name())
-		} else {
-			args = append(args, "--ControlPort", strconv.Itoa(conf.ControlPort))
+			controlPort := "auto"
+			if conf.ControlPort != 0 {
+				controlPort = strconv.Itoa(conf.ControlPort)
+			}
+			args = append(args, "--ControlPort", controlPort, "--ControlPortWriteToFile", controlPortFile.Name())
 		}
 	}
 	// Create process creator with args
@@ -303,8 +363,10 @@ func (t *Tor) startProcess(ctx context.Context, conf *StartConf) error {
 		if err != nil {
 			return fmt.Errorf("Unable to get embedded control conn: %v", err)
 		}
-		t.Control = control.NewConn(textproto.NewConn(conn))
-		t.Control.DebugWriter = t.DebugWriter
+		if conf.ControlRecorder != nil {
+			conn = conf.ControlRecorder.Conn(conn)
+		}
+		t.Control = control.NewConnWithDebugWriter(textproto.NewConn(conn), t.DebugWriter)
 	}
 	// Start process with the args
 	t.Debugf("Starting tor with args %v", args)
@@ -312,47 +374,61 @@ func (t *Tor) startProcess(ctx context.Context, conf *StartConf) error {
 		return err
 	}
 	t.Process = p
-	// If not embedded, try a few times to read the control port file if we need to
+	// Wait for the control port or socket unless embedded
 	if !conf.UseEmbeddedControlConn {
-		t.ControlPort = conf.ControlPort
-		if t.ControlPort == 0 {
-		ControlPortCheck:
-			for i := 0; i < 10; i++ {
-				select {
-				case <-ctx.Done():
-					err = ctx.Err()
-					break ControlPortCheck
-				default:
-					// Try to read the controlport file, or wait a bit
-					var byts []byte
-					if byts, err = ioutil.ReadFile(controlPortFileName); err != nil {
-						break ControlPortCheck
-					} else if t.ControlPort, err = process.ControlPortFromFileContents(string(byts)); err == nil {
-						break ControlPortCheck
-					}
-					time.Sleep(200 * time.Millisecond)
-				}
-			}
-			if err != nil {
-				return fmt.Errorf("Unable to read control port file: %v", err)
-			}
-		}
+		return t.waitReady(ctx, conf, controlPortFileName)
 	}
 	return nil
 }
 
+// Longest Unix socket path that works on all supported platforms
+const maxControlSocketPathLen = 103
+
+func (t *Tor) controlSocketArgs(conf *StartConf, args []string) ([]string, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("Control sockets are not supported on Windows")
+	}
+	t.ControlSocket = filepath.Join(t.DataDir, "control.sock")
+	if len(t.ControlSocket) > maxControlSocketPathLen {
+		return nil, fmt.Errorf("Control socket path %v is longer than %v characters, use a shorter data dir",
+			t.ControlSocket, maxControlSocketPathLen)
+	}
+	args = append(args, "--ControlSocket", t.ControlSocket)
+	if conf.ControlSocketGroupWritable {
+		// Tor refuses a socket dir more open than this, and the data dir
+		// must be marked as intentionally group readable
+		if err := os.Chmod(t.DataDir, 0750); err != nil {
+			return nil, fmt.Errorf("Unable to make data dir group readable: %v", err)
+		}
+		args = append(args, "--ControlSocketsGroupWritable", "1", "--DataDirectoryGroupReadable", "1")
+		if !conf.DisableCookieAuth {
+			args = append(args, "--CookieAuthFileGroupReadable", "1")
+		}
+	}
+	return args, nil
+}
+
 func (t *Tor) connectController(ctx context.Context, conf *StartConf) error {
 	// This doesn't apply if already connected (e.g. using embedded conn)
 	if t.Control != nil {
 		return nil
 	}
-	t.Debugf("Connecting to control port %v", t.ControlPort)
-	textConn, err := textproto.Dial("tcp", "127.0.0.1:"+strconv.Itoa(t.ControlPort))
+	var conn net.Conn
+	var err error
+	if t.ControlSocket != "" {
+		t.Debugf("Connecting to control socket %v", t.ControlSocket)
+		conn, err = net.Dial("unix", t.ControlSocket)
+	} else {
+		t.Debugf("Connecting to control port %v", t.ControlPort)
+		conn, err = net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(t.ControlPort))
+	}
 	if err != nil {
 		return err
 	}
-	t.Control = control.NewConn(textConn)
-	t.Control.DebugWriter = t.DebugWriter
+	if conf.ControlRecorder != nil {
+		conn = conf.ControlRecorder.Conn(conn)
+	}
+	t.Control = control.NewConnWithDebugWriter(textproto.NewConn(conn), t.DebugWriter)
 	return nil
 }
 
@@ -364,13 +440,13 @@ func (t *Tor) EnableNetwork(ctx context.Context, wait bool) error {
 		ctx = context.Background()
 	}
 	// Only enable if DisableNetwork is 1
-	if vals, err := t.Control.GetConf("DisableNetwork"); err != nil {
+	if vals, err := t.Control.GetConfContext(ctx, "DisableNetwork"); err != nil {
 		return err
 	} else if len(vals) == 0 || vals[0].Key != "DisableNetwork" || vals[0].Val != "1" {
 		return nil
 	}
 	// Enable the network
-	if err := t.Control.SetConf(control.KeyVals("DisableNetwork", "0")...); err != nil {
+	if err := t.Control.SetConfContext(ctx, control.KeyVals("DisableNetwork", "0")...); err != nil {
 		return nil
 	}
 	// If not waiting, leave
@@ -393,14 +469,15 @@ func (t *Tor) EnableNetwork(ctx context.Context, wait bool) error {
 }
 
 // Close sends a halt to the Tor process if it can, closes the controller
-// connection, and stops the process.
+// connection, and stops the process. For instances created with Connect, only
+// the controller connection is closed.
 func (t *Tor) Close() error {
 	t.Debugf("Closing Tor")
 	errs := []error{}
 	// If controller is authenticated, send the quit signal to the process. Otherwise, just close the controller.
 	sentHalt := false
 	if t.Control != nil {
-		if t.Control.Authenticated && t.StopProcessOnClose {
+		if t.Control.IsAuthenticated() && t.StopProcessOnClose {
 			if err := t.Control.Signal("HALT"); err != nil {
 				errs = append(errs, fmt.Errorf("Unable to signal halt: %v", err))
 			} else {
@@ -420,12 +497,10 @@ func (t *Tor) Close() error {
 			t.ProcessCancelFunc()
 		}
 		// Wait for a bit to make sure it stopped
-		errCh := make(chan error, 1)
 		var waitErr error
-		go func() { errCh <- t.Process.Wait() }()
 		select {
-		case waitErr = <-errCh:
-			if waitErr != nil {
+		case <-t.processDone():
+			if waitErr = t.processErr; waitErr != nil {
 				errs = append(errs, fmt.Errorf("Process wait failed: %v", waitErr))
 			}
 		case <-time.After(300 * time.Millisecond):
@@ -0,0 +1,135 @@
+package torutil
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Tor encodes client auth keys as lowercase, unpadded base32
+var clientAuthKeyEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// ClientAuthPrivateKey is a 32-byte x25519 private key used by a client to
+// access a v3 onion service that requires client authorization.
+type ClientAuthPrivateKey []byte
+
+// ClientAuthPublicKey is a 32-byte x25519 public key that an onion service
+// authorizes. Its String form is what ListenConf.ClientAuths and the
+// ADD_ONION ClientAuthV3 values expect.
+type ClientAuthPublicKey []byte
+
+// ClientAuthKeyPair is an x25519 key pair for onion service client
+// authorization.
+type ClientAuthKeyPair struct {
+	PrivateKey ClientAuthPrivateKey
+	PublicKey  ClientAuthPublicKey
+}
+
+// GenerateClientAuthKeyPair generates a client auth key pair using entropy
+// from rand. If rand is nil, crypto/rand.Reader will be used.
+func GenerateClientAuthKeyPair(rnd io.Reader) (*ClientAuthKeyPair, error) {
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	key := make(ClientAuthPrivateKey, 32)
+	if _, err := io.ReadFull(rnd, key); err != nil {
+		return nil, err
+	}
+	// Clamp the same way Tor does so the stored key matches
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	return &ClientAuthKeyPair{PrivateKey: key, PublicKey: key.PublicKey()}, nil
+}
+
+// PublicKey derives the public key for this private key. This panics if the
+// key is not 32 bytes.
+func (k ClientAuthPrivateKey) PublicKey() ClientAuthPublicKey {
+	pub, err := curve25519.X25519(k, curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	return pub
+}
+
+// String encodes the key as Tor does, lowercase base32 without padding.
+func (k ClientAuthPrivateKey) String() string { return clientAuthKeyEncoding.EncodeToString(k) }
+
+// String encodes the key as Tor does, lowercase base32 without padding.
+func (k ClientAuthPublicKey) String() string { return clientAuthKeyEncoding.EncodeToString(k) }
+
+// DecodeClientAuthPrivateKey decodes a base32 private key as encoded by
+// ClientAuthPrivateKey.String. Case and trailing padding are ignored.
+func DecodeClientAuthPrivateKey(s string) (ClientAuthPrivateKey, error) {
+	return decodeClientAuthKey(s)
+}
+
+// DecodeClientAuthPublicKey decodes a base32 public key as encoded by
+// ClientAuthPublicKey.String. Case and trailing padding are ignored.
+func DecodeClientAuthPublicKey(s string) (ClientAuthPublicKey, error) {
+	return decodeClientAuthKey(s)
+}
+
+func decodeClientAuthKey(s string) ([]byte, error) {
+	byts, err := clientAuthKeyEncoding.DecodeString(strings.ToLower(strings.TrimRight(s, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid client auth key: %v", err)
+	} else if len(byts) != 32 {
+		return nil, fmt.Errorf("Invalid client auth key length: %v", len(byts))
+	}
+	return byts, nil
+}
+
+// ClientAuthFile returns the contents of a ".auth" file for the given public
+// key. These files are placed in the service's
+// HiddenServiceDir/authorized_clients directory and have the form
+// "descriptor:x25519:<base32-public-key>".
+func ClientAuthFile(key ClientAuthPublicKey) string {
+	return "descriptor:x25519:" + key.String() + "\n"
+}
+
+// ParseClientAuthFile parses the contents of a ".auth" file as written by
+// ClientAuthFile.
+func ParseClientAuthFile(s string) (ClientAuthPublicKey, error) {
+	pieces := strings.Split(strings.TrimSpace(s), ":")
+	if len(pieces) != 3 {
+		return nil, fmt.Errorf("Invalid client auth file, expected 3 fields, got %v", len(pieces))
+	} else if pieces[0] != "descriptor" {
+		return nil, fmt.Errorf("Invalid client auth type: %v", pieces[0])
+	} else if pieces[1] != "x25519" {
+		return nil, fmt.Errorf("Invalid client auth key type: %v", pieces[1])
+	}
+	return DecodeClientAuthPublicKey(pieces[2])
+}
+
+// ClientAuthPrivateFile returns the contents of a ".auth_private" file for
+// the given onion service ID (with or without the ".onion" suffix) and
+// private key. These files are placed in the client's ClientOnionAuthDir and
+// have the form "<service-id>:descriptor:x25519:<base32-private-key>".
+func ClientAuthPrivateFile(serviceID string, key ClientAuthPrivateKey) string {
+	return strings.TrimSuffix(serviceID, ".onion") + ":descriptor:x25519:" + key.String() + "\n"
+}
+
+// ParseClientAuthPrivateFile parses the contents of a ".auth_private" file as
+// written by ClientAuthPrivateFile. The service ID is returned without the
+// ".onion" suffix.
+func ParseClientAuthPrivateFile(s string) (serviceID string, key ClientAuthPrivateKey, err error) {
+	pieces := strings.Split(strings.TrimSpace(s), ":")
+	if len(pieces) != 4 {
+		return "", nil, fmt.Errorf("Invalid client auth private file, expected 4 fields, got %v", len(pieces))
+	}
+	serviceID = strings.TrimSuffix(pieces[0], ".onion")
+	if _, err = PublicKeyFromV3OnionServiceID(serviceID); err != nil {
+		return "", nil, fmt.Errorf("Invalid onion service ID %v: %v", serviceID, err)
+	} else if pieces[1] != "descriptor" {
+		return "", nil, fmt.Errorf("Invalid client auth type: %v", pieces[1])
+	} else if pieces[2] != "x25519" {
+		return "", nil, fmt.Errorf("Invalid client auth key type: %v", pieces[2])
+	}
+	key, err = DecodeClientAuthPrivateKey(pieces[3])
+	return
+}
@@ -0,0 +1,64 @@
+package torutil
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAuthKeyPair(t *testing.T) {
+	// RFC 7748 section 6.1 test vector
+	priv, err := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	require.NoError(t, err)
+	pub, err := hex.DecodeString("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+	require.NoError(t, err)
+	require.Equal(t, ClientAuthPublicKey(pub), ClientAuthPrivateKey(priv).PublicKey())
+	// Encoding round trips and is case insensitive
+	pubStr := ClientAuthPublicKey(pub).String()
+	require.Len(t, pubStr, 52)
+	require.Equal(t, strings.ToLower(pubStr), pubStr)
+	decodedPub, err := DecodeClientAuthPublicKey(strings.ToUpper(pubStr))
+	require.NoError(t, err)
+	require.Equal(t, ClientAuthPublicKey(pub), decodedPub)
+	decodedPriv, err := DecodeClientAuthPrivateKey(ClientAuthPrivateKey(priv).String())
+	require.NoError(t, err)
+	require.Equal(t, ClientAuthPrivateKey(priv), decodedPriv)
+	_, err = DecodeClientAuthPublicKey(pubStr[:40])
+	require.Error(t, err)
+	// Generated keys are clamped and match their public key
+	keyPair, err := GenerateClientAuthKeyPair(nil)
+	require.NoError(t, err)
+	require.Len(t, keyPair.PrivateKey, 32)
+	require.Zero(t, keyPair.PrivateKey[0]&7)
+	require.Equal(t, byte(64), keyPair.PrivateKey[31]&192)
+	require.Equal(t, keyPair.PrivateKey.PublicKey(), keyPair.PublicKey)
+}
+
+func TestClientAuthFiles(t *testing.T) {
+	keyPair, err := GenerateClientAuthKeyPair(nil)
+	require.NoError(t, err)
+	serviceID := OnionServiceIDFromPrivateKey(genEd25519(t))
+	// Public file
+	file := ClientAuthFile(keyPair.PublicKey)
+	require.Equal(t, "descriptor:x25519:"+keyPair.PublicKey.String()+"\n", file)
+	pub, err := ParseClientAuthFile(file)
+	require.NoError(t, err)
+	require.Equal(t, keyPair.PublicKey, pub)
+	_, err = ParseClientAuthFile("descriptor:ed25519:" + keyPair.PublicKey.String())
+	require.Error(t, err)
+	_, err = ParseClientAuthFile(keyPair.PublicKey.String())
+	require.Error(t, err)
+	// Private file
+	file = ClientAuthPrivateFile(serviceID+".onion", keyPair.PrivateKey)
+	require.Equal(t, serviceID+":descriptor:x25519:"+keyPair.PrivateKey.String()+"\n", file)
+	id, priv, err := ParseClientAuthPrivateFile(file)
+	require.NoError(t, err)
+	require.Equal(t, serviceID, id)
+	require.Equal(t, keyPair.PrivateKey, priv)
+	_, _, err = ParseClientAuthPrivateFile("notanonion:descriptor:x25519:" + keyPair.PrivateKey.String())
+	require.Error(t, err)
+	_, _, err = ParseClientAuthPrivateFile("descriptor:x25519:" + keyPair.PrivateKey.String())
+	require.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package ed25519
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+
+	"github.com/cretz/bine/torutil/ed25519/internal/edwards25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// The ed25519 base point as written in rend-spec-v3 for the blinding factor
+const blindBasePointString = "(15112221349535400772501151409588531511454012693041857206046113283949847762202, " +
+	"46316835694926478169428394003475163141307993866256225615783033603165251855960)"
+
+// BlindingFactor returns the clamped rend-spec-v3 blinding factor h for the
+// identity public key, time period number, and time period length in minutes.
+// It is H("Derive temporary signing key" | INT_1(0) | A | B | N) where N is
+// "key-blind" | INT_8(periodNum) | INT_8(periodLength).
+func BlindingFactor(identity PublicKey, periodNum uint64, periodLength uint64) [32]byte {
+	h := sha3.New256()
+	h.Write([]byte("Derive temporary signing key\x00"))
+	h.Write(identity)
+	h.Write([]byte(blindBasePointString))
+	var nonce [len("key-blind") + 16]byte
+	copy(nonce[:], "key-blind")
+	binary.BigEndian.PutUint64(nonce[9:], periodNum)
+	binary.BigEndian.PutUint64(nonce[17:], periodLength)
+	h.Write(nonce[:])
+	var factor [32]byte
+	h.Sum(factor[:0])
+	factor[0] &= 248
+	factor[31] &= 63
+	factor[31] |= 64
+	return factor
+}
+
+// BlindPublicKey returns the blinded public key for the identity public key
+// in the given time period number and length in minutes. This is the key
+// onion service descriptors are signed and fetched with. An error is returned
+// if the identity is not a valid point.
+func BlindPublicKey(identity PublicKey, periodNum uint64, periodLength uint64) (PublicKey, error) {
+	if len(identity) != PublicKeySize {
+		return nil, errors.New("ed25519: bad public key length")
+	}
+	var identityBytes [32]byte
+	copy(identityBytes[:], identity)
+	var A edwards25519.ExtendedGroupElement
+	if !A.FromBytes(&identityBytes) {
+		return nil, errors.New("ed25519: invalid public key")
+	}
+	factor := BlindingFactor(identity, periodNum, periodLength)
+	var blinded edwards25519.ProjectiveGroupElement
+	edwards25519.GeDoubleScalarMultVartime(&blinded, &factor, &A, &[32]byte{})
+	var ret [32]byte
+	blinded.ToBytes(&ret)
+	return ret[:], nil
+}
+
+// BlindKeyPair returns the blinded key pair for the identity key pair in the
+// given time period number and length in minutes. Its public key is the same
+// as BlindPublicKey's and it can sign descriptor signing key certificates.
+func BlindKeyPair(identity KeyPair, periodNum uint64, periodLength uint64) KeyPair {
+	factor := BlindingFactor(identity.PublicKey(), periodNum, periodLength)
+	var privateKeyA [32]byte
+	copy(privateKeyA[:], identity.PrivateKey())
+	var blindedA [32]byte
+	edwards25519.ScMulAdd(&blindedA, &factor, &privateKeyA, &[32]byte{})
+	prefix := sha512.New()
+	prefix.Write([]byte("Derive temporary signing key hash input"))
+	prefix.Write(identity.PrivateKey()[32:])
+	blinded := make(PrivateKey, PrivateKeySize)
+	copy(blinded, blindedA[:])
+	copy(blinded[32:], prefix.Sum(nil)[:32])
+	return blinded.KeyPair()
+}
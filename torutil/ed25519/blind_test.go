@@ -0,0 +1,58 @@
+package ed25519
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Vectors from test_blinding_basics in Tor's src/test/test_hs_common.c, time
+// period 1234 of length 1440
+const (
+	torBlindingPublicKey = "833990B085C1A688C1D4C8B1F6B56AFAF5A2ECA674449E1D704F83765CCB7BC6"
+	torBlindingSecretKey = "D8C7FF0E31295B66540D789AF3E3DF992038A9592EEA01D8B7CBA06D6E66D159" +
+		"4D6167696320576F7264733A20737065697373636F62616C742062697669756D"
+	// Tor clamps the parameter when blinding, this is before
+	torBlindingParam            = "379E50DB31FEE6775ABD0AF6FB7C371E060308F4F847DB09FE4CFE13AF602287"
+	torBlindingBlindedPublicKey = "3A50BF210E8F9EE955AE0014F7A6917FB65EBF098A86305ABB508D1A7291B6D5"
+	torBlindingBlindedSecretKey = "A958DC83AC885F6814C67035DE817A2C604D5D2F715282079448F789B656350B" +
+		"4540FE1F80AA3F7E91306B7BF7A8E367293352B14A29FDCC8C19F3558075524B"
+)
+
+func decodeHex(t *testing.T, str string) []byte {
+	byts, err := hex.DecodeString(str)
+	require.NoError(t, err)
+	return byts
+}
+
+func TestBlindingFactor(t *testing.T) {
+	expected := decodeHex(t, torBlindingParam)
+	expected[0] &= 248
+	expected[31] &= 63
+	expected[31] |= 64
+	factor := BlindingFactor(decodeHex(t, torBlindingPublicKey), 1234, 1440)
+	require.Equal(t, expected, factor[:])
+}
+
+func TestBlindKey(t *testing.T) {
+	identity := PrivateKey(decodeHex(t, torBlindingSecretKey)).KeyPair()
+	require.Equal(t, PublicKey(decodeHex(t, torBlindingPublicKey)), identity.PublicKey())
+	blindedPub, err := BlindPublicKey(identity.PublicKey(), 1234, 1440)
+	require.NoError(t, err)
+	require.Equal(t, PublicKey(decodeHex(t, torBlindingBlindedPublicKey)), blindedPub)
+	blindedPair := BlindKeyPair(identity, 1234, 1440)
+	require.Equal(t, PrivateKey(decodeHex(t, torBlindingBlindedSecretKey)), blindedPair.PrivateKey())
+	require.Equal(t, blindedPub, blindedPair.PublicKey())
+	// The blinded key signs like any other
+	sig := Sign(blindedPair, []byte("test"))
+	require.True(t, blindedPub.Verify([]byte("test"), sig))
+	require.False(t, identity.PublicKey().Verify([]byte("test"), sig))
+	// Invalid keys fail
+	_, err = BlindPublicKey(make(PublicKey, 31), 1234, 1440)
+	require.Error(t, err)
+	invalid := make(PublicKey, 32)
+	invalid[0] = 2
+	_, err = BlindPublicKey(invalid, 1234, 1440)
+	require.Error(t, err)
+}
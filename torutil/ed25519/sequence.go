@@ -0,0 +1,121 @@
+package ed25519
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+
+	"github.com/cretz/bine/torutil/ed25519/internal/edwards25519"
+)
+
+// maxKeySequenceLen is the number of keys a KeySequence can generate before
+// its scalar could carry into the clamped bits.
+const maxKeySequenceLen = 1 << 60
+
+// KeySequence generates a sequence of key pairs where each private scalar is
+// 8 more than the one before it. This means each public key only costs a
+// point addition instead of a scalar multiplication, and public keys are
+// encoded in batches that share a single field inversion. It is meant for
+// searching for a key with a particular public key, such as a vanity onion
+// address, and only one key from a sequence should ever be used. A
+// KeySequence is not safe for concurrent use.
+type KeySequence struct {
+	start  [32]byte
+	prefix [32]byte
+	// The public point of the key at index
+	next  edwards25519.ExtendedGroupElement
+	step  edwards25519.CachedGroupElement
+	index uint64
+	// Scratch space reused across NextPublicKeys calls
+	points   []edwards25519.ExtendedGroupElement
+	inverses []edwards25519.FieldElement
+}
+
+// NewKeySequence creates a KeySequence starting at a random key using entropy
+// from rand. If rand is nil, crypto/rand.Reader will be used.
+func NewKeySequence(rnd io.Reader) (*KeySequence, error) {
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	rndByts := make([]byte, 32)
+	if _, err := io.ReadFull(rnd, rndByts); err != nil {
+		return nil, err
+	}
+	digest := sha512.Sum512(rndByts)
+	k := &KeySequence{}
+	copy(k.start[:], digest[:32])
+	copy(k.prefix[:], digest[32:])
+	// Clamp like GenerateKey but also clear bit 253 so adding to the scalar
+	// never reaches the clamped high bits
+	k.start[0] &= 248
+	k.start[31] &= 31
+	k.start[31] |= 64
+	edwards25519.GeScalarMultBase(&k.next, &k.start)
+	var step edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&step, &[32]byte{8})
+	step.ToCached(&k.step)
+	return k, nil
+}
+
+// NextPublicKeys sets pubs to the public keys of the next len(pubs) keys in
+// the sequence and returns the index of the first one. KeyPair returns the
+// full key pair for an index. Larger batches amortize the cost of encoding
+// better, a few hundred is reasonable. This panics if the sequence is
+// exhausted, which will not happen in practice.
+func (k *KeySequence) NextPublicKeys(pubs [][32]byte) uint64 {
+	n := len(pubs)
+	if k.index+uint64(n) > maxKeySequenceLen {
+		panic("Key sequence exhausted")
+	}
+	if cap(k.points) < n {
+		k.points = make([]edwards25519.ExtendedGroupElement, n)
+		k.inverses = make([]edwards25519.FieldElement, n)
+	}
+	points, inverses := k.points[:n], k.inverses[:n]
+	var sum edwards25519.CompletedGroupElement
+	for i := range points {
+		points[i] = k.next
+		edwards25519.GeAdd(&sum, &k.next, &k.step)
+		sum.ToExtended(&k.next)
+	}
+	// Invert all Z values at once with Montgomery's trick. Each inverse first
+	// holds the product of the Z values before it.
+	var acc, inv edwards25519.FieldElement
+	edwards25519.FeOne(&acc)
+	for i := range points {
+		inverses[i] = acc
+		edwards25519.FeMul(&acc, &acc, &points[i].Z)
+	}
+	edwards25519.FeInvert(&inv, &acc)
+	for i := n - 1; i >= 0; i-- {
+		edwards25519.FeMul(&inverses[i], &inverses[i], &inv)
+		edwards25519.FeMul(&inv, &inv, &points[i].Z)
+	}
+	// Encode like ExtendedGroupElement.ToBytes
+	var x, y edwards25519.FieldElement
+	for i := range points {
+		edwards25519.FeMul(&x, &points[i].X, &inverses[i])
+		edwards25519.FeMul(&y, &points[i].Y, &inverses[i])
+		edwards25519.FeToBytes(&pubs[i], &y)
+		pubs[i][31] ^= edwards25519.FeIsNegative(&x) << 7
+	}
+	first := k.index
+	k.index += uint64(n)
+	return first
+}
+
+// KeyPair returns the key pair at the given index in the sequence.
+func (k *KeySequence) KeyPair(index uint64) KeyPair {
+	if index >= maxKeySequenceLen {
+		panic("Key sequence index out of range")
+	}
+	priv := make(PrivateKey, PrivateKeySize)
+	// Little-endian start + 8 * index
+	add, carry := index<<3, uint64(0)
+	for i := 0; i < 32; i++ {
+		sum := uint64(k.start[i]) + add&0xff + carry
+		priv[i], add, carry = byte(sum), add>>8, sum>>8
+	}
+	copy(priv[32:], k.prefix[:])
+	return priv.KeyPair()
+}
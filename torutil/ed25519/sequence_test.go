@@ -0,0 +1,31 @@
+package ed25519
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySequence(t *testing.T) {
+	seq, err := NewKeySequence(nil)
+	require.NoError(t, err)
+	// Check a couple of batches of differing sizes
+	first, second := make([][32]byte, 100), make([][32]byte, 37)
+	require.Equal(t, uint64(0), seq.NextPublicKeys(first))
+	require.Equal(t, uint64(100), seq.NextPublicKeys(second))
+	pubs := append(first, second...)
+	seen := map[[32]byte]bool{}
+	for i, pub := range pubs {
+		keyPair := seq.KeyPair(uint64(i))
+		require.Equal(t, PublicKey(pub[:]), keyPair.PublicKey())
+		require.False(t, seen[pub])
+		seen[pub] = true
+		// Keys stay clamped
+		require.Zero(t, keyPair.PrivateKey()[0]&7)
+		require.Equal(t, byte(64), keyPair.PrivateKey()[31]&192)
+	}
+	// Keys are usable for signing
+	keyPair := seq.KeyPair(123)
+	sig := Sign(keyPair, []byte("test"))
+	require.True(t, keyPair.PublicKey().Verify([]byte("test"), sig))
+}
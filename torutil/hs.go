@@ -0,0 +1,117 @@
+package torutil
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// Onion service time period lengths in minutes. The length comes from the
+// "hsdir-interval" consensus parameter.
+const (
+	HSTimePeriodLengthDefault = 1440
+	HSTimePeriodLengthMin     = 30
+	HSTimePeriodLengthMax     = 14400
+)
+
+// HSDefaultVotingInterval is the voting interval of the live Tor network.
+const HSDefaultVotingInterval = time.Hour
+
+// HSTimePeriodLength returns the time period length in minutes for the given
+// "hsdir-interval" consensus parameter value. If the value is 0 or out of
+// range, HSTimePeriodLengthDefault is returned.
+func HSTimePeriodLength(hsDirInterval int64) uint64 {
+	if hsDirInterval < HSTimePeriodLengthMin || hsDirInterval > HSTimePeriodLengthMax {
+		return HSTimePeriodLengthDefault
+	}
+	return uint64(hsDirInterval)
+}
+
+// hsTimePeriodOffset is how far time periods are shifted from the epoch. This
+// is the shared random phase duration, 12 voting intervals, in minutes.
+func hsTimePeriodOffset(votingInterval time.Duration) uint64 {
+	if votingInterval <= 0 {
+		votingInterval = HSDefaultVotingInterval
+	}
+	return uint64(12 * votingInterval / time.Minute)
+}
+
+// HSTimePeriodNum returns the onion service time period number for a
+// consensus valid-after time. The voting interval is the consensus
+// fresh-until minus valid-after time, HSDefaultVotingInterval if 0. The
+// length is in minutes, HSTimePeriodLengthDefault if 0. On the live network
+// time periods start at 12:00 UTC each day.
+func HSTimePeriodNum(validAfter time.Time, votingInterval time.Duration, length uint64) uint64 {
+	if length == 0 {
+		length = HSTimePeriodLengthDefault
+	}
+	minutes := uint64(validAfter.Unix() / 60)
+	if offset := hsTimePeriodOffset(votingInterval); minutes > offset {
+		minutes -= offset
+	} else {
+		minutes = 0
+	}
+	return minutes / length
+}
+
+// HSTimePeriodStart returns the start time of the given time period number.
+// The voting interval and length are as in HSTimePeriodNum.
+func HSTimePeriodStart(num uint64, votingInterval time.Duration, length uint64) time.Time {
+	if length == 0 {
+		length = HSTimePeriodLengthDefault
+	}
+	minutes := num*length + hsTimePeriodOffset(votingInterval)
+	return time.Unix(int64(minutes*60), 0).UTC()
+}
+
+// HSCredential returns the onion service credential for the identity public
+// key, H("credential" | identity).
+func HSCredential(identity ed25519.PublicKey) []byte {
+	credential := sha3.Sum256(append([]byte("credential"), identity...))
+	return credential[:]
+}
+
+// HSSubcredential returns the onion service subcredential for the identity
+// public key and blinded public key of a time period, H("subcredential" |
+// credential | blinded). It is used to encrypt descriptors and in the
+// introduction protocol.
+func HSSubcredential(identity ed25519.PublicKey, blinded ed25519.PublicKey) []byte {
+	subcredential := sha3.Sum256(append(append([]byte("subcredential"), HSCredential(identity)...), blinded...))
+	return subcredential[:]
+}
+
+// HSDescriptorID returns the index on the hash ring where the descriptor for
+// the blinded key is stored for the given replica, which starts at 1. This is
+// H("store-at-idx" | blinded | INT_8(replica) | INT_8(length) |
+// INT_8(periodNum)), the "hs_index" of rend-spec-v3.
+func HSDescriptorID(blinded ed25519.PublicKey, replica uint64, periodNum uint64, length uint64) []byte {
+	h := sha3.New256()
+	h.Write([]byte("store-at-idx"))
+	h.Write(blinded)
+	writeUint64s(h, replica, length, periodNum)
+	return h.Sum(nil)
+}
+
+// HSDirIndex returns the index on the hash ring of the HSDir with the given
+// ed25519 identity for the shared random value and time period. This is
+// H("node-idx" | identity | srv | INT_8(periodNum) | INT_8(length)), the
+// "hsdir_index" of rend-spec-v3.
+func HSDirIndex(identity ed25519.PublicKey, sharedRandom []byte, periodNum uint64, length uint64) []byte {
+	h := sha3.New256()
+	h.Write([]byte("node-idx"))
+	h.Write(identity)
+	h.Write(sharedRandom)
+	writeUint64s(h, periodNum, length)
+	return h.Sum(nil)
+}
+
+func writeUint64s(w io.Writer, vals ...uint64) {
+	var b [8]byte
+	for _, val := range vals {
+		binary.BigEndian.PutUint64(b[:], val)
+		w.Write(b[:])
+	}
+}
@@ -0,0 +1,57 @@
+package torutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHSTimePeriod(t *testing.T) {
+	// Example from rend-spec-v3 [TIME-PERIODS], the next period starts at noon
+	validAfter := time.Date(2016, 4, 13, 11, 0, 0, 0, time.UTC)
+	require.Equal(t, uint64(16903), HSTimePeriodNum(validAfter, 0, 0))
+	require.Equal(t, time.Date(2016, 4, 13, 12, 0, 0, 0, time.UTC), HSTimePeriodStart(16903+1, 0, 0))
+	require.Equal(t, uint64(16904), HSTimePeriodNum(validAfter.Add(time.Hour), time.Hour, HSTimePeriodLengthDefault))
+	require.Equal(t, uint64(16904), HSTimePeriodNum(validAfter.Add(25*time.Hour-time.Second), 0, 0))
+	require.Equal(t, uint64(16905), HSTimePeriodNum(validAfter.Add(25*time.Hour), 0, 0))
+	// Shorter voting interval and length, as on test networks
+	require.Equal(t, uint64(24342420-12*10)/30, HSTimePeriodNum(validAfter, 10*time.Minute, 30))
+	require.Equal(t, validAfter, HSTimePeriodStart((24342420-12*10)/30, 10*time.Minute, 30))
+	// From test_blinding_basics in Tor's src/test/test_hs_common.c
+	require.Equal(t, uint64(1234), HSTimePeriodNum(time.Date(1973, 5, 20, 1, 50, 33, 0, time.UTC), 0, 0))
+	// Lengths
+	require.Equal(t, uint64(1440), HSTimePeriodLength(0))
+	require.Equal(t, uint64(1440), HSTimePeriodLength(20))
+	require.Equal(t, uint64(60), HSTimePeriodLength(60))
+}
+
+func TestHSSubcredential(t *testing.T) {
+	identity := genEd25519(t).PublicKey()
+	blinded, err := ed25519.BlindPublicKey(identity, 16903, HSTimePeriodLengthDefault)
+	require.NoError(t, err)
+	require.Len(t, HSCredential(identity), 32)
+	subcredential := HSSubcredential(identity, blinded)
+	require.Len(t, subcredential, 32)
+	require.NotEqual(t, HSCredential(identity), subcredential)
+	// Each period has its own
+	otherBlinded, err := ed25519.BlindPublicKey(identity, 16904, HSTimePeriodLengthDefault)
+	require.NoError(t, err)
+	require.NotEqual(t, subcredential, HSSubcredential(identity, otherBlinded))
+}
+
+func TestHSDescriptorID(t *testing.T) {
+	// Vectors from test_hs_indexes in Tor's src/test/test_hs_common.c
+	key := ed25519.PublicKey(bytes.Repeat([]byte{0x42}, 32))
+	srv := bytes.Repeat([]byte{0x43}, 32)
+	require.Equal(t, "37e5cbbd56a22823714f18f1623ece5983a0d64c78495a8cfab854245e5f9a8a",
+		hex.EncodeToString(HSDescriptorID(key, 1, 42, 1440)))
+	require.Equal(t, "db475361014a09965e7e5e4d4a25b8f8d4b8f16cb1d8a7e95eed50249cc1a2d5",
+		hex.EncodeToString(HSDirIndex(key, srv, 42, 1440)))
+	// Different replicas and periods differ
+	require.NotEqual(t, HSDescriptorID(key, 1, 42, 1440), HSDescriptorID(key, 2, 42, 1440))
+	require.NotEqual(t, HSDescriptorID(key, 1, 42, 1440), HSDescriptorID(key, 1, 43, 1440))
+}
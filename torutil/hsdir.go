@@ -0,0 +1,157 @@
+package torutil
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// File names used by Tor in a v3 HiddenServiceDir.
+const (
+	HSSecretKeyFileName = "hs_ed25519_secret_key"
+	HSPublicKeyFileName = "hs_ed25519_public_key"
+	HSHostnameFileName  = "hostname"
+)
+
+const (
+	hsSecretKeyHeader = "== ed25519v1-secret: type0 =="
+	hsPublicKeyHeader = "== ed25519v1-public: type0 =="
+	// Headers are NUL padded to this length
+	hsKeyHeaderLen = 32
+)
+
+// HSSecretKeyFile returns the contents of an hs_ed25519_secret_key file for
+// the given key. This is the NUL-padded 32-byte header followed by the 64-byte
+// expanded private key.
+func HSSecretKeyFile(key ed25519.KeyPair) []byte {
+	return hsKeyFile(hsSecretKeyHeader, key.PrivateKey())
+}
+
+// ParseHSSecretKeyFile parses the contents of an hs_ed25519_secret_key file.
+func ParseHSSecretKeyFile(b []byte) (ed25519.KeyPair, error) {
+	byts, err := parseHSKeyFile(hsSecretKeyHeader, b, ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PrivateKey(byts).KeyPair(), nil
+}
+
+// HSPublicKeyFile returns the contents of an hs_ed25519_public_key file for
+// the given key. This is the NUL-padded 32-byte header followed by the 32-byte
+// public key.
+func HSPublicKeyFile(key ed25519.PublicKey) []byte {
+	return hsKeyFile(hsPublicKeyHeader, key)
+}
+
+// ParseHSPublicKeyFile parses the contents of an hs_ed25519_public_key file.
+func ParseHSPublicKeyFile(b []byte) (ed25519.PublicKey, error) {
+	byts, err := parseHSKeyFile(hsPublicKeyHeader, b, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(byts), nil
+}
+
+func hsKeyFile(header string, key []byte) []byte {
+	ret := make([]byte, hsKeyHeaderLen, hsKeyHeaderLen+len(key))
+	copy(ret, header)
+	return append(ret, key...)
+}
+
+func parseHSKeyFile(header string, b []byte, keyLen int) ([]byte, error) {
+	if len(b) != hsKeyHeaderLen+keyLen {
+		return nil, fmt.Errorf("Invalid key file length %v, expected %v", len(b), hsKeyHeaderLen+keyLen)
+	} else if actual := string(bytes.TrimRight(b[:hsKeyHeaderLen], "\x00")); actual != header {
+		return nil, fmt.Errorf("Invalid key file header %q, expected %q", actual, header)
+	}
+	return append([]byte(nil), b[hsKeyHeaderLen:]...), nil
+}
+
+// LoadHiddenServiceDir loads the v3 onion service key from a Tor
+// HiddenServiceDir. The hs_ed25519_secret_key file must exist. If
+// hs_ed25519_public_key or hostname exist, they must match the secret key.
+// The result can be used as ListenConf.Key in the tor package.
+func LoadHiddenServiceDir(dir string) (ed25519.KeyPair, error) {
+	byts, err := ioutil.ReadFile(filepath.Join(dir, HSSecretKeyFileName))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseHSSecretKeyFile(byts)
+	if err != nil {
+		return nil, err
+	}
+	if byts, err = ioutil.ReadFile(filepath.Join(dir, HSPublicKeyFileName)); err == nil {
+		if pubKey, err := ParseHSPublicKeyFile(byts); err != nil {
+			return nil, err
+		} else if !bytes.Equal(pubKey, key.PublicKey()) {
+			return nil, fmt.Errorf("Public key file does not match secret key")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if byts, err = ioutil.ReadFile(filepath.Join(dir, HSHostnameFileName)); err == nil {
+		expected := OnionServiceIDFromV3PublicKey(key.PublicKey()) + ".onion"
+		if hostname := strings.TrimSpace(string(byts)); hostname != expected {
+			return nil, fmt.Errorf("Hostname %v does not match secret key, expected %v", hostname, expected)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SaveHiddenServiceDir writes hs_ed25519_secret_key, hs_ed25519_public_key,
+// and hostname for the given key into dir the way Tor does, so a stock Tor
+// can serve it with HiddenServiceDir. The directory is created with 0700
+// permissions if it does not exist and the files are written with 0600.
+// Existing files are replaced, each one atomically.
+func SaveHiddenServiceDir(dir string, key ed25519.KeyPair) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		byts []byte
+	}{
+		{HSSecretKeyFileName, HSSecretKeyFile(key)},
+		{HSPublicKeyFileName, HSPublicKeyFile(key.PublicKey())},
+		{HSHostnameFileName, []byte(OnionServiceIDFromV3PublicKey(key.PublicKey()) + ".onion\n")},
+	}
+	for _, file := range files {
+		if err := writeFileAtomic(filepath.Join(dir, file.name), file.byts, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file via a temporary file in the same directory
+// and a rename so it is never seen partially written.
+func writeFileAtomic(path string, byts []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(byts)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
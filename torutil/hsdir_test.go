@@ -0,0 +1,72 @@
+package torutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHSKeyFiles(t *testing.T) {
+	key := genEd25519(t)
+	secretFile := HSSecretKeyFile(key)
+	require.Len(t, secretFile, 96)
+	require.Equal(t, "== ed25519v1-secret: type0 ==\x00\x00\x00", string(secretFile[:32]))
+	require.Equal(t, []byte(key.PrivateKey()), secretFile[32:])
+	parsedKey, err := ParseHSSecretKeyFile(secretFile)
+	require.NoError(t, err)
+	require.Equal(t, key.PrivateKey(), parsedKey.PrivateKey())
+	require.Equal(t, key.PublicKey(), parsedKey.PublicKey())
+	publicFile := HSPublicKeyFile(key.PublicKey())
+	require.Len(t, publicFile, 64)
+	require.Equal(t, "== ed25519v1-public: type0 ==\x00\x00\x00", string(publicFile[:32]))
+	parsedPubKey, err := ParseHSPublicKeyFile(publicFile)
+	require.NoError(t, err)
+	require.Equal(t, key.PublicKey(), parsedPubKey)
+	// Mixing up the files or truncating fails
+	_, err = ParseHSSecretKeyFile(publicFile)
+	require.Error(t, err)
+	_, err = ParseHSPublicKeyFile(append(secretFile[:32:32], publicFile[32:]...))
+	require.Error(t, err)
+	_, err = ParseHSSecretKeyFile(secretFile[:95])
+	require.Error(t, err)
+}
+
+func TestHiddenServiceDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hs")
+	key := genEd25519(t)
+	require.NoError(t, SaveHiddenServiceDir(dir, key))
+	hostname, err := ioutil.ReadFile(filepath.Join(dir, HSHostnameFileName))
+	require.NoError(t, err)
+	require.Equal(t, OnionServiceIDFromPrivateKey(key)+".onion\n", string(hostname))
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(dir, HSSecretKeyFileName))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	// Files are written via temporary files that are renamed into place
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	loadedKey, err := LoadHiddenServiceDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, key.PrivateKey(), loadedKey.PrivateKey())
+	require.Equal(t, key.PublicKey(), loadedKey.PublicKey())
+	// Only the secret key is required
+	require.NoError(t, os.Remove(filepath.Join(dir, HSPublicKeyFileName)))
+	require.NoError(t, os.Remove(filepath.Join(dir, HSHostnameFileName)))
+	_, err = LoadHiddenServiceDir(dir)
+	require.NoError(t, err)
+	// Mismatched hostname fails
+	otherID := OnionServiceIDFromPrivateKey(genEd25519(t))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, HSHostnameFileName), []byte(otherID+".onion\n"), 0600))
+	_, err = LoadHiddenServiceDir(dir)
+	require.Error(t, err)
+	// Missing secret key fails
+	require.NoError(t, os.Remove(filepath.Join(dir, HSSecretKeyFileName)))
+	_, err = LoadHiddenServiceDir(dir)
+	require.Error(t, err)
+}
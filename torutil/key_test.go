@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
+	"encoding/hex"
 	"math/big"
 	"testing"
 
@@ -87,6 +88,11 @@ func TestOnionServiceIDFromV2PublicKey(t *testing.T) {
 }
 
 func TestOnionServiceIDFromV3PublicKey(t *testing.T) {
+	// From test_build_address in Tor's src/test/test_hs_common.c
+	torKey, err := hex.DecodeString("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+	require.NoError(t, err)
+	require.Equal(t, "25njqamcweflpvkl73j4szahhihoc4xt3ktcgjnpaingr5yhkenl5sid",
+		OnionServiceIDFromV3PublicKey(torKey))
 	base64Keys := []string{
 		"SLne6D/uawqUj23619GbeYCd6HnzYPqyUvF8/xyz/3XNVpkgnonQI+J5NQVSGkppD1b0M87+qOtUBmVXsd7H3w",
 		"kPUs5aPoqISZVbg0q7coW+mNCODlcL4O7k2QWFOCC0gOQBiDm+g4Xz48lqucA7o2HIQ3gBdL5rlB6+q1tFdJwQ",
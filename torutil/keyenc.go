@@ -0,0 +1,134 @@
+package torutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	onionKeyMagic      = "BINEOKEY"
+	onionKeyVersion1   = 1
+	onionKeySaltLen    = 16
+	onionKeyNonceLen   = 12
+	onionKeyHeaderLen  = len(onionKeyMagic) + 4 + onionKeySaltLen
+	onionKeyLen        = onionKeyHeaderLen + onionKeyNonceLen + ed25519.PrivateKeySize + 16
+	onionKeyMaxScryptN = 22
+	onionKeyMaxScryptR = 32
+	onionKeyMaxScryptP = 16
+	// scrypt needs 128 * r * N bytes of memory
+	onionKeyMaxScryptMem = 1 << 30
+)
+
+// OnionKeyScryptParams are the scrypt parameters for EncryptOnionKey. The
+// memory scrypt uses, 128 * R * N bytes, must be at most 1GiB. The limits are
+// checked by DecryptOnionKey before deriving since the parameters are not
+// authenticated until after.
+type OnionKeyScryptParams struct {
+	// LogN is log2 of the CPU/memory cost N. It must be between 1 and 22.
+	LogN int
+	// R is the block size. It must be between 1 and 32.
+	R int
+	// P is the parallelization. It must be between 1 and 16.
+	P int
+}
+
+// DefaultOnionKeyScryptParams are the parameters used by EncryptOnionKey when
+// none are given. They use 32MiB of memory.
+var DefaultOnionKeyScryptParams = OnionKeyScryptParams{LogN: 15, R: 8, P: 1}
+
+func (o OnionKeyScryptParams) validate() error {
+	if o.LogN < 1 || o.LogN > onionKeyMaxScryptN {
+		return fmt.Errorf("Invalid scrypt log N: %v", o.LogN)
+	} else if o.R < 1 || o.R > onionKeyMaxScryptR {
+		return fmt.Errorf("Invalid scrypt r: %v", o.R)
+	} else if o.P < 1 || o.P > onionKeyMaxScryptP {
+		return fmt.Errorf("Invalid scrypt p: %v", o.P)
+	} else if mem := int64(128*o.R) << uint(o.LogN); mem > onionKeyMaxScryptMem {
+		return fmt.Errorf("Invalid scrypt params, %v bytes of memory exceeds max of %v", mem, onionKeyMaxScryptMem)
+	}
+	return nil
+}
+
+// EncryptOnionKey encrypts the v3 onion service key with the passphrase. If
+// params is nil, DefaultOnionKeyScryptParams is used. Use DecryptOnionKey to
+// get the key back.
+//
+// The result is a 120-byte container with these fields in order:
+//
+//	magic      8 bytes   "BINEOKEY"
+//	version    1 byte    1
+//	log2(N)    1 byte    scrypt cost parameter
+//	r          1 byte    scrypt block size parameter
+//	p          1 byte    scrypt parallelization parameter
+//	salt      16 bytes   random scrypt salt
+//	nonce     12 bytes   random AES-GCM nonce
+//	sealed    80 bytes   AES-256-GCM sealed 64-byte expanded private key
+//
+// The AES key is the 32-byte scrypt(passphrase, salt, N, r, p) and the fields
+// before the nonce are authenticated as additional data. Future formats will
+// use a new version number and this version will remain readable.
+func EncryptOnionKey(key ed25519.KeyPair, passphrase []byte, params *OnionKeyScryptParams) ([]byte, error) {
+	if params == nil {
+		params = &DefaultOnionKeyScryptParams
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	ret := make([]byte, onionKeyHeaderLen+onionKeyNonceLen, onionKeyLen)
+	copy(ret, onionKeyMagic)
+	ret[8], ret[9], ret[10], ret[11] = onionKeyVersion1, byte(params.LogN), byte(params.R), byte(params.P)
+	// Salt and nonce are contiguous
+	if _, err := io.ReadFull(rand.Reader, ret[12:]); err != nil {
+		return nil, err
+	}
+	aead, err := onionKeyAEAD(passphrase, ret[12:onionKeyHeaderLen], *params)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(ret, ret[onionKeyHeaderLen:], key.PrivateKey(), ret[:onionKeyHeaderLen]), nil
+}
+
+// DecryptOnionKey decrypts a key encrypted with EncryptOnionKey. An error is
+// returned if the passphrase is wrong or the data was tampered with.
+func DecryptOnionKey(data []byte, passphrase []byte) (ed25519.KeyPair, error) {
+	if len(data) < onionKeyHeaderLen || !bytes.Equal(data[:8], []byte(onionKeyMagic)) {
+		return nil, fmt.Errorf("Invalid encrypted onion key")
+	} else if data[8] != onionKeyVersion1 {
+		return nil, fmt.Errorf("Unsupported encrypted onion key version: %v", data[8])
+	} else if len(data) != onionKeyLen {
+		return nil, fmt.Errorf("Invalid encrypted onion key length: %v", len(data))
+	}
+	params := OnionKeyScryptParams{LogN: int(data[9]), R: int(data[10]), P: int(data[11])}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	aead, err := onionKeyAEAD(passphrase, data[12:onionKeyHeaderLen], params)
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[onionKeyHeaderLen : onionKeyHeaderLen+onionKeyNonceLen]
+	key, err := aead.Open(nil, nonce, data[onionKeyHeaderLen+onionKeyNonceLen:], data[:onionKeyHeaderLen])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt onion key, invalid passphrase or corrupt data")
+	}
+	return ed25519.PrivateKey(key).KeyPair(), nil
+}
+
+func onionKeyAEAD(passphrase []byte, salt []byte, params OnionKeyScryptParams) (cipher.AEAD, error) {
+	aesKey, err := scrypt.Key(passphrase, salt, 1<<uint(params.LogN), params.R, params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,67 @@
+package torutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptOnionKey(t *testing.T) {
+	key := genEd25519(t)
+	// Use cheap params to keep the test fast
+	params := &OnionKeyScryptParams{LogN: 10, R: 8, P: 1}
+	encrypted, err := EncryptOnionKey(key, []byte("secret"), params)
+	require.NoError(t, err)
+	require.Len(t, encrypted, 120)
+	require.Equal(t, "BINEOKEY", string(encrypted[:8]))
+	require.Equal(t, []byte{1, 10, 8, 1}, encrypted[8:12])
+	decrypted, err := DecryptOnionKey(encrypted, []byte("secret"))
+	require.NoError(t, err)
+	require.Equal(t, key.PrivateKey(), decrypted.PrivateKey())
+	require.Equal(t, key.PublicKey(), decrypted.PublicKey())
+	// Salt and nonce differ each time
+	encryptedAgain, err := EncryptOnionKey(key, []byte("secret"), params)
+	require.NoError(t, err)
+	require.NotEqual(t, encrypted, encryptedAgain)
+	// Wrong passphrase fails
+	_, err = DecryptOnionKey(encrypted, []byte("wrong"))
+	require.Error(t, err)
+	// Tampering with the header or ciphertext fails
+	for _, index := range []int{11, 20, 40, 119} {
+		tampered := append([]byte(nil), encrypted...)
+		tampered[index] ^= 1
+		_, err = DecryptOnionKey(tampered, []byte("secret"))
+		require.Error(t, err)
+	}
+	// Unknown versions and truncated data fail
+	tampered := append([]byte(nil), encrypted...)
+	tampered[8] = 2
+	_, err = DecryptOnionKey(tampered, []byte("secret"))
+	require.Error(t, err)
+	_, err = DecryptOnionKey(encrypted[:119], []byte("secret"))
+	require.Error(t, err)
+	// Invalid params fail
+	_, err = EncryptOnionKey(key, []byte("secret"), &OnionKeyScryptParams{LogN: 30, R: 8, P: 1})
+	require.Error(t, err)
+}
+
+func TestDecryptOnionKeyCostLimit(t *testing.T) {
+	encrypted, err := EncryptOnionKey(genEd25519(t), []byte("secret"), &OnionKeyScryptParams{LogN: 10, R: 8, P: 1})
+	require.NoError(t, err)
+	// Headers asking for too much are rejected by validation before deriving
+	for params, expected := range map[[3]byte]string{
+		{22, 32, 1}:  "Invalid scrypt params, 17179869184 bytes of memory exceeds max of 1073741824",
+		{21, 16, 1}:  "Invalid scrypt params, 4294967296 bytes of memory exceeds max of 1073741824",
+		{22, 255, 1}: "Invalid scrypt r: 255",
+		{10, 8, 255}: "Invalid scrypt p: 255",
+	} {
+		tampered := append([]byte(nil), encrypted...)
+		copy(tampered[9:], params[:])
+		_, err = DecryptOnionKey(tampered, []byte("secret"))
+		require.EqualError(t, err, expected)
+	}
+	// Up to 1GiB of memory is allowed
+	require.NoError(t, OnionKeyScryptParams{LogN: 20, R: 8, P: 16}.validate())
+	require.NoError(t, OnionKeyScryptParams{LogN: 22, R: 2, P: 1}.validate())
+	require.Error(t, OnionKeyScryptParams{LogN: 22, R: 3, P: 1}.validate())
+}
@@ -0,0 +1,261 @@
+package torutil
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// vanityBatchSize is how many keys a worker checks between cancellation and
+// progress checks.
+const vanityBatchSize = 512
+
+// VanityConf is the configuration for GenerateVanityKey. At least one prefix
+// or pattern is required.
+type VanityConf struct {
+	// Prefixes are base32 prefixes of the v3 onion service ID. A key is a
+	// match if its service ID starts with any of them. They are case
+	// insensitive and can be up to 56 characters, but each character makes
+	// the search 32 times longer.
+	Prefixes []string
+
+	// Patterns are matched against the 56-character v3 onion service ID
+	// without the ".onion" suffix. A key is a match if any of them match. They
+	// are slower to check than Prefixes.
+	Patterns []*regexp.Regexp
+
+	// Workers is the number of goroutines to search with. If 0, it is
+	// runtime.NumCPU().
+	Workers int
+
+	// Progress, if set, is called periodically from another goroutine with
+	// the search progress. It should not block.
+	Progress func(*VanityProgress)
+
+	// ProgressInterval is how often Progress is called. If 0, it is one
+	// second.
+	ProgressInterval time.Duration
+}
+
+// VanityProgress is the progress of a GenerateVanityKey search.
+type VanityProgress struct {
+	// Attempts is the number of keys checked so far.
+	Attempts uint64
+
+	// Elapsed is the time since the search started.
+	Elapsed time.Duration
+
+	// Rate is the number of keys checked per second.
+	Rate float64
+
+	// Expected is the average number of keys that must be checked to find a
+	// match. It is 0 if unknown, which is the case when there are Patterns.
+	Expected uint64
+
+	// Probability is the chance that a match would have been found by now. It
+	// is 0 if Expected is unknown.
+	Probability float64
+
+	// ETA is the estimated time until Expected keys have been checked. It is
+	// 0 if Expected is unknown or already passed. The search is random, so a
+	// match can be found well before or well after this.
+	ETA time.Duration
+}
+
+// vanityPrefix is a prefix as bits of the public key. IDs longer than 51
+// characters contain checksum bits, so those are compared as strings.
+type vanityPrefix struct {
+	str  string
+	want []byte
+	mask []byte
+}
+
+func newVanityPrefix(prefix string) (*vanityPrefix, error) {
+	p := &vanityPrefix{str: strings.ToLower(prefix)}
+	if p.str == "" || len(p.str) > 56 {
+		return nil, fmt.Errorf("Invalid prefix length: %v", len(p.str))
+	} else if len(p.str) > 51 {
+		return p, nil
+	}
+	// Put each 5-bit char in place big endian
+	p.want = make([]byte, (len(p.str)*5+7)/8)
+	p.mask = make([]byte, len(p.want))
+	for i, ch := range p.str {
+		var val byte
+		switch {
+		case ch >= 'a' && ch <= 'z':
+			val = byte(ch - 'a')
+		case ch >= '2' && ch <= '7':
+			val = byte(ch-'2') + 26
+		default:
+			return nil, fmt.Errorf("Invalid prefix char %q in %v", ch, prefix)
+		}
+		for bit := 0; bit < 5; bit++ {
+			pos := i*5 + bit
+			p.mask[pos/8] |= 0x80 >> uint(pos%8)
+			if val&(0x10>>uint(bit)) != 0 {
+				p.want[pos/8] |= 0x80 >> uint(pos%8)
+			}
+		}
+	}
+	return p, nil
+}
+
+func (v *vanityPrefix) matches(pub *[32]byte, id func() string) bool {
+	if v.mask == nil {
+		return strings.HasPrefix(id(), v.str)
+	}
+	for i, mask := range v.mask {
+		if pub[i]&mask != v.want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateVanityKey searches for a v3 onion service key whose service ID
+// matches one of the prefixes or patterns in conf. The search runs until a
+// match is found or the context is done, in which case the context error is
+// returned. The result can be used as ListenConf.Key in the tor package.
+//
+// Keys are generated with an ed25519.KeySequence per worker, so most
+// candidates cost a point addition instead of a full scalar multiplication.
+func GenerateVanityKey(ctx context.Context, conf *VanityConf) (ed25519.KeyPair, error) {
+	if len(conf.Prefixes) == 0 && len(conf.Patterns) == 0 {
+		return nil, fmt.Errorf("At least one prefix or pattern required")
+	}
+	prefixes := make([]*vanityPrefix, len(conf.Prefixes))
+	// Probability that a single key matches one of the prefixes
+	matchChance := 0.0
+	for i, prefix := range conf.Prefixes {
+		var err error
+		if prefixes[i], err = newVanityPrefix(prefix); err != nil {
+			return nil, err
+		}
+		matchChance += math.Pow(32, -float64(len(prefix)))
+	}
+	var expected uint64
+	if len(conf.Patterns) == 0 {
+		expected = uint64(math.Ceil(1 / math.Min(matchChance, 1)))
+	}
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Start the workers
+	var attempts uint64
+	resultCh := make(chan ed25519.KeyPair, 1)
+	errCh := make(chan error, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			seq, err := ed25519.NewKeySequence(nil)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			pubs := make([][32]byte, vanityBatchSize)
+			for ctx.Err() == nil {
+				first := seq.NextPublicKeys(pubs)
+				for j := range pubs {
+					if vanityMatches(&pubs[j], prefixes, conf.Patterns) {
+						select {
+						case resultCh <- seq.KeyPair(first + uint64(j)):
+							cancel()
+						default:
+						}
+						return
+					}
+				}
+				atomic.AddUint64(&attempts, vanityBatchSize)
+			}
+		}()
+	}
+	doneCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+
+	// Report progress until done
+	start := time.Now()
+	var progressCh <-chan time.Time
+	if conf.Progress != nil {
+		interval := conf.ProgressInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		progressCh = ticker.C
+	}
+	for {
+		select {
+		case <-progressCh:
+			conf.Progress(newVanityProgress(atomic.LoadUint64(&attempts), time.Since(start), expected, matchChance))
+		case err := <-errCh:
+			cancel()
+			<-doneCh
+			return nil, err
+		case <-doneCh:
+			select {
+			case key := <-resultCh:
+				return key, nil
+			default:
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+func vanityMatches(pub *[32]byte, prefixes []*vanityPrefix, patterns []*regexp.Regexp) bool {
+	// The ID is only built if needed and then only once
+	var id string
+	getID := func() string {
+		if id == "" {
+			id = OnionServiceIDFromV3PublicKey(pub[:])
+		}
+		return id
+	}
+	for _, prefix := range prefixes {
+		if prefix.matches(pub, getID) {
+			return true
+		}
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(getID()) {
+			return true
+		}
+	}
+	return false
+}
+
+func newVanityProgress(attempts uint64, elapsed time.Duration, expected uint64, matchChance float64) *VanityProgress {
+	p := &VanityProgress{Attempts: attempts, Elapsed: elapsed, Expected: expected}
+	if elapsed > 0 {
+		p.Rate = float64(attempts) / elapsed.Seconds()
+	}
+	if expected > 0 {
+		p.Probability = 1
+		if matchChance < 1 {
+			p.Probability = -math.Expm1(float64(attempts) * math.Log1p(-matchChance))
+		}
+		if p.Rate > 0 && attempts < expected {
+			p.ETA = time.Duration(float64(expected-attempts) / p.Rate * float64(time.Second))
+		}
+	}
+	return p
+}
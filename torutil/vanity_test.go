@@ -0,0 +1,86 @@
+package torutil
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateVanityKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// Prefixes
+	key, err := GenerateVanityKey(ctx, &VanityConf{Prefixes: []string{"ab", "C7"}})
+	require.NoError(t, err)
+	id := OnionServiceIDFromPrivateKey(key)
+	require.True(t, strings.HasPrefix(id, "ab") || strings.HasPrefix(id, "c7"), id)
+	// The key is valid for signing
+	require.True(t, key.PublicKey().Verify([]byte("test"), ed25519.Sign(key, []byte("test"))))
+	// Patterns
+	key, err = GenerateVanityKey(ctx, &VanityConf{Patterns: []*regexp.Regexp{regexp.MustCompile("^.z.q")}, Workers: 2})
+	require.NoError(t, err)
+	require.Regexp(t, "^.z.q", OnionServiceIDFromPrivateKey(key))
+	// Invalid confs
+	_, err = GenerateVanityKey(ctx, &VanityConf{})
+	require.Error(t, err)
+	_, err = GenerateVanityKey(ctx, &VanityConf{Prefixes: []string{"ab1"}})
+	require.Error(t, err)
+	_, err = GenerateVanityKey(ctx, &VanityConf{Prefixes: []string{strings.Repeat("a", 57)}})
+	require.Error(t, err)
+}
+
+func TestGenerateVanityKeyCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var lock sync.Mutex
+	var progress []*VanityProgress
+	_, err := GenerateVanityKey(ctx, &VanityConf{
+		Prefixes:         []string{"aaaaaaaaaaaa"},
+		ProgressInterval: 20 * time.Millisecond,
+		Progress: func(p *VanityProgress) {
+			lock.Lock()
+			defer lock.Unlock()
+			progress = append(progress, p)
+		},
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+	lock.Lock()
+	defer lock.Unlock()
+	require.NotEmpty(t, progress)
+	last := progress[len(progress)-1]
+	require.Equal(t, uint64(1)<<60, last.Expected)
+	require.NotZero(t, last.Attempts)
+	require.NotZero(t, last.Rate)
+	require.NotZero(t, last.ETA)
+	require.True(t, last.Probability > 0 && last.Probability < 0.01)
+}
+
+func TestVanityPrefixMatches(t *testing.T) {
+	key := genEd25519(t)
+	id := OnionServiceIDFromPrivateKey(key)
+	var pub [32]byte
+	copy(pub[:], key.PublicKey())
+	getID := func() string { return id }
+	// Every length, including those that reach the checksum, matches
+	for i := 1; i <= len(id); i++ {
+		prefix, err := newVanityPrefix(strings.ToUpper(id[:i]))
+		require.NoError(t, err)
+		require.True(t, prefix.matches(&pub, getID), id[:i])
+		// Changing the last char fails the match
+		other := []byte(id[:i])
+		if other[i-1] == 'a' {
+			other[i-1] = 'b'
+		} else {
+			other[i-1] = 'a'
+		}
+		prefix, err = newVanityPrefix(string(other))
+		require.NoError(t, err)
+		require.False(t, prefix.matches(&pub, getID), string(other))
+	}
+}